@@ -3,7 +3,7 @@ module github.com/romnn/bsonpb
 go 1.13
 
 require (
-	github.com/golang/protobuf v1.4.2 // indirect
+	github.com/golang/protobuf v1.4.2
 	github.com/google/go-cmp v0.5.0
 	github.com/lunemec/as v1.0.0
 	github.com/reiver/go-cast v0.0.0-20170210005224-b977979c1903 // indirect
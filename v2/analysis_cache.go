@@ -0,0 +1,87 @@
+package bsonpb
+
+import (
+	"container/list"
+	"sync"
+
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// maxCachedAnalyses bounds the number of descriptor analyses that are cached.
+// Descriptors of dynamic messages are created anew whenever their descriptor
+// set is loaded, so the cache must not grow with them.
+const maxCachedAnalyses = 4096
+
+// analysisKind tells apart the analyses of a descriptor.
+type analysisKind int
+
+const (
+	analysisCatchAll analysisKind = iota
+	analysisInline
+	analysisKeys
+	analysisKeyField
+	analysisBinaryFormat
+)
+
+type analysisKey struct {
+	kind analysisKind
+	desc pref.Descriptor
+}
+
+type analysisEntry struct {
+	key analysisKey
+	val interface{}
+	err error
+}
+
+// analysisCache is a least recently used cache of descriptor analyses.
+type analysisCache struct {
+	mu      sync.Mutex
+	max     int
+	entries map[analysisKey]*list.Element
+	order   *list.List
+}
+
+// analyses caches the analyses of descriptors done by marshaling and
+// unmarshaling, e.g. which field of a message is its catch-all field.
+var analyses = newAnalysisCache(maxCachedAnalyses)
+
+func newAnalysisCache(max int) *analysisCache {
+	return &analysisCache{max: max, entries: make(map[analysisKey]*list.Element), order: list.New()}
+}
+
+// load returns the cached analysis of desc or computes and caches it. The
+// analysis is computed without holding the lock, so that analyses may depend
+// on each other.
+func (c *analysisCache) load(kind analysisKind, desc pref.Descriptor, analyze func() (interface{}, error)) (interface{}, error) {
+	key := analysisKey{kind: kind, desc: desc}
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		entry := elem.Value.(*analysisEntry)
+		c.mu.Unlock()
+		return entry.val, entry.err
+	}
+	c.mu.Unlock()
+
+	val, err := analyze()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.entries[key] = c.order.PushFront(&analysisEntry{key: key, val: val, err: err})
+		for c.order.Len() > c.max {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*analysisEntry).key)
+		}
+	}
+	return val, err
+}
+
+// len returns the number of cached analyses.
+func (c *analysisCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,43 @@
+package bsonpb
+
+import (
+	"testing"
+
+	pb2 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb2_proto"
+	pb3 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb3_proto"
+)
+
+func TestAnalysisCache(t *testing.T) {
+	c := newAnalysisCache(2)
+	calls := 0
+	analyze := func() (interface{}, error) {
+		calls++
+		return calls, nil
+	}
+	first := (&pb2.Cart{}).ProtoReflect().Descriptor()
+	second := (&pb2.Item{}).ProtoReflect().Descriptor()
+	third := (&pb3.Nested{}).ProtoReflect().Descriptor()
+
+	if v, _ := c.load(analysisInline, first, analyze); v != 1 {
+		t.Errorf("load() got %v, want 1", v)
+	}
+	if v, _ := c.load(analysisInline, first, analyze); v != 1 {
+		t.Errorf("load() got %v, want cached 1", v)
+	}
+	if v, _ := c.load(analysisCatchAll, first, analyze); v != 2 {
+		t.Errorf("load() of another kind got %v, want 2", v)
+	}
+	c.load(analysisInline, first, analyze)
+	c.load(analysisInline, second, analyze)
+	c.load(analysisInline, third, analyze)
+	if got := c.len(); got != 2 {
+		t.Errorf("len() got %d, want 2", got)
+	}
+	// The least recently used analysis was evicted.
+	if v, _ := c.load(analysisCatchAll, first, analyze); v != 5 {
+		t.Errorf("load() got %v, want recomputed 5", v)
+	}
+	if v, _ := c.load(analysisInline, third, analyze); v != 4 {
+		t.Errorf("load() got %v, want cached 4", v)
+	}
+}
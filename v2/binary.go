@@ -0,0 +1,233 @@
+package bsonpb
+
+import (
+	"encoding/hex"
+
+	"github.com/romnn/bsonpb/v2/internal/genid"
+	"github.com/romnn/bsonpb/v2/options"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// uuidLen is the length of UUIDs and MD5 digests in bytes.
+const uuidLen = 16
+
+// binaryFormat describes how the values of a bytes or string field are
+// stored as BSON binary.
+type binaryFormat struct {
+	// subtype is the binary subtype of a bytes field if hasSubtype is set.
+	subtype    byte
+	hasSubtype bool
+	// uuid stores a string field as binary of subtype 4.
+	uuid bool
+}
+
+// fieldBinaryFormat returns the format selected by the (bsonpb.binary_subtype)
+// and (bsonpb.uuid) field options of fd. The options of map fields apply to
+// their values.
+func fieldBinaryFormat(fd pref.FieldDescriptor) (binaryFormat, error) {
+	v, err := analyses.load(analysisBinaryFormat, fd, func() (interface{}, error) {
+		return findBinaryFormat(fd)
+	})
+	format, _ := v.(binaryFormat)
+	return format, err
+}
+
+func findBinaryFormat(fd pref.FieldDescriptor) (binaryFormat, error) {
+	var format binaryFormat
+	ofd := mapField(fd)
+	if ofd == nil {
+		ofd = fd
+	}
+	if subtype, ok := uint32FieldOption(ofd, options.E_BinarySubtype); ok {
+		if fd.Kind() != pref.BytesKind {
+			return format, newError(CategoryUnsupported, "binary subtype of %v requires a bytes field", ofd.FullName())
+		}
+		if err := checkBinarySubtype(subtype); err != nil {
+			return format, err
+		}
+		format = binaryFormat{subtype: byte(subtype), hasSubtype: true}
+	}
+	if boolFieldOption(ofd, options.E_Uuid) {
+		if fd.Kind() != pref.StringKind {
+			return binaryFormat{}, newError(CategoryUnsupported, "uuid field %v must be a string field", ofd.FullName())
+		}
+		format.uuid = true
+	}
+	return format, nil
+}
+
+// mapField returns the map field whose entries have the value field fd or nil
+// if fd is not the value of a map entry.
+func mapField(fd pref.FieldDescriptor) pref.FieldDescriptor {
+	entry := fd.ContainingMessage()
+	if entry == nil || !entry.IsMapEntry() || entry.Fields().ByNumber(genid.MapEntry_Value_field_number) != fd {
+		return nil
+	}
+	parent, ok := entry.Parent().(pref.MessageDescriptor)
+	if !ok {
+		return nil
+	}
+	fields := parent.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		if f := fields.Get(i); f.IsMap() && f.Message() == entry {
+			return f
+		}
+	}
+	return nil
+}
+
+// checkBinarySubtype reports whether bytes fields may be stored as binary of
+// the given subtype: generic, UUID, MD5 or user-defined.
+func checkBinarySubtype(subtype uint32) error {
+	switch {
+	case subtype == uint32(bsontype.BinaryGeneric),
+		subtype == uint32(bsontype.BinaryUUID),
+		subtype == uint32(bsontype.BinaryMD5),
+		uint32(bsontype.BinaryUserDefined) <= subtype && subtype <= 0xff:
+		return nil
+	}
+	return newError(CategoryUnsupported, "unsupported binary subtype %d", subtype)
+}
+
+// isFixedLength reports whether values of the subtype must be 16 bytes long,
+// which is the case for UUIDs and MD5 digests.
+func isFixedLength(subtype byte) bool {
+	return subtype == bsontype.BinaryUUID || subtype == bsontype.BinaryMD5
+}
+
+// checkBinaryLength reports whether data has the length required by the
+// subtype.
+func checkBinaryLength(subtype byte, data []byte) error {
+	if isFixedLength(subtype) && len(data) != uuidLen {
+		return newValueError(CategoryInvalidValue, pref.BytesKind, data, "binary subtype %d requires %d bytes, got %d", subtype, uuidLen, len(data))
+	}
+	return nil
+}
+
+// bytesSubtype returns the binary subtype of the bytes field fd.
+func bytesSubtype(fd pref.FieldDescriptor, fallback byte) (byte, error) {
+	format, err := fieldBinaryFormat(fd)
+	if err != nil {
+		return 0, err
+	}
+	if format.hasSubtype {
+		return format.subtype, nil
+	}
+	return fallback, nil
+}
+
+// marshalBytes marshals the value of the bytes field fd as binary of the
+// subtype selected for it. Empty values of UUID and MD5 fields, e.g.
+// unpopulated ones, are marshaled as null.
+func (e encoder) marshalBytes(b []byte, fd pref.FieldDescriptor) (interface{}, error) {
+	subtype, err := bytesSubtype(fd, e.opts.BinarySubtype)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 && isFixedLength(subtype) {
+		return primitive.Null{}, nil
+	}
+	if err := checkBinaryLength(subtype, b); err != nil {
+		return nil, err
+	}
+	return primitive.Binary{Subtype: subtype, Data: b}, nil
+}
+
+// unmarshalBytes unmarshals binary or, unless Strict is set, a UUID string
+// into the bytes field fd. In strict mode the subtype must be the one
+// selected for the field.
+func (d decoder) unmarshalBytes(doc interface{}, fd pref.FieldDescriptor) (pref.Value, bool, error) {
+	subtype, err := bytesSubtype(fd, d.opts.BinarySubtype)
+	if err != nil {
+		return pref.Value{}, true, err
+	}
+	switch v := doc.(type) {
+	case primitive.Binary:
+		if d.opts.Strict {
+			if v.Subtype != subtype {
+				return pref.Value{}, true, newValueError(CategoryTypeMismatch, pref.BytesKind, doc, "strict mode requires binary subtype %d for %v, got %d", subtype, fd.FullName(), v.Subtype)
+			}
+			if err := checkBinaryLength(subtype, v.Data); err != nil {
+				return pref.Value{}, true, err
+			}
+		}
+		if err := d.countBytes(len(v.Data)); err != nil {
+			return pref.Value{}, true, err
+		}
+		return pref.ValueOfBytes(v.Data), true, nil
+	case string:
+		if d.opts.Strict || subtype != bsontype.BinaryUUID {
+			return pref.Value{}, false, nil
+		}
+		b, err := parseUUID(v)
+		if err != nil {
+			return pref.Value{}, true, err
+		}
+		return pref.ValueOfBytes(b), true, nil
+	case primitive.Null:
+		if isFixedLength(subtype) {
+			return pref.ValueOfBytes(nil), true, nil
+		}
+	}
+	return pref.Value{}, false, nil
+}
+
+// marshalUUID marshals the UUID string s as binary of subtype 4 or as null
+// if it is empty, e.g. unpopulated.
+func marshalUUID(s string) (interface{}, error) {
+	if s == "" {
+		return primitive.Null{}, nil
+	}
+	b, err := parseUUID(s)
+	if err != nil {
+		return nil, err
+	}
+	return primitive.Binary{Subtype: bsontype.BinaryUUID, Data: b}, nil
+}
+
+// unmarshalUUID unmarshals binary of subtype 4 into a string field marked
+// with the (bsonpb.uuid) field option. Unless Strict is set, binary of the
+// legacy subtype 3 and UUID strings are accepted as well.
+func (d decoder) unmarshalUUID(doc interface{}) (pref.Value, error) {
+	switch v := doc.(type) {
+	case primitive.Binary:
+		if v.Subtype == bsontype.BinaryUUID || (!d.opts.Strict && v.Subtype == bsontype.BinaryUUIDOld) {
+			if len(v.Data) != uuidLen {
+				return pref.Value{}, newValueError(CategoryInvalidValue, pref.StringKind, doc, "invalid UUID of %d bytes", len(v.Data))
+			}
+			return pref.ValueOfString(formatUUID(v.Data)), nil
+		}
+		return pref.Value{}, newValueError(CategoryTypeMismatch, pref.StringKind, doc, "invalid binary subtype %d for UUID", v.Subtype)
+	case string:
+		if !d.opts.Strict {
+			if _, err := parseUUID(v); err != nil {
+				return pref.Value{}, err
+			}
+			return pref.ValueOfString(v), nil
+		}
+	case primitive.Null:
+		return pref.ValueOfString(""), nil
+	}
+	return pref.Value{}, newValueError(CategoryTypeMismatch, pref.StringKind, doc, "invalid value for UUID: %v (has type %T)", doc, doc)
+}
+
+// parseUUID parses a UUID in its canonical text form, e.g.
+// "123e4567-e89b-12d3-a456-426614174000".
+func parseUUID(s string) ([]byte, error) {
+	if len(s) != 2*uuidLen+4 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return nil, newValueError(CategoryInvalidValue, pref.StringKind, s, "invalid UUID %q", s)
+	}
+	b, err := hex.DecodeString(s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:])
+	if err != nil {
+		return nil, newValueError(CategoryInvalidValue, pref.StringKind, s, "invalid UUID %q", s)
+	}
+	return b, nil
+}
+
+// formatUUID formats the 16 bytes of a UUID in its canonical text form.
+func formatUUID(b []byte) string {
+	s := hex.EncodeToString(b)
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
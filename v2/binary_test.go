@@ -0,0 +1,244 @@
+package bsonpb
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	pb2 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb2_proto"
+	pb3 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb3_proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/proto"
+)
+
+const testUUID = "123e4567-e89b-12d3-a456-426614174000"
+
+var testUUIDBytes = []byte{0x12, 0x3e, 0x45, 0x67, 0xe8, 0x9b, 0x12, 0xd3, 0xa4, 0x56, 0x42, 0x66, 0x14, 0x17, 0x40, 0x00}
+
+func TestBinarySubtype(t *testing.T) {
+	tests := []struct {
+		desc  string
+		mo    MarshalOptions
+		input proto.Message
+		want  bson.D
+	}{{
+		desc: "field options",
+		input: &pb2.BinaryFields{
+			Data:     []byte("d"),
+			Checksum: bytes.Repeat([]byte{1}, 16),
+			RawId:    testUUIDBytes,
+			Blob:     []byte("b"),
+		},
+		want: bson.D{
+			{Key: "data", Value: primitive.Binary{Data: []byte("d")}},
+			{Key: "checksum", Value: primitive.Binary{Subtype: 5, Data: bytes.Repeat([]byte{1}, 16)}},
+			{Key: "rawId", Value: primitive.Binary{Subtype: 4, Data: testUUIDBytes}},
+			{Key: "blob", Value: primitive.Binary{Subtype: 128, Data: []byte("b")}},
+		},
+	}, {
+		desc:  "global subtype",
+		mo:    MarshalOptions{BinarySubtype: 0x81},
+		input: &pb2.BinaryFields{Data: []byte("d"), Blob: []byte("b")},
+		want: bson.D{
+			{Key: "data", Value: primitive.Binary{Subtype: 0x81, Data: []byte("d")}},
+			{Key: "blob", Value: primitive.Binary{Subtype: 128, Data: []byte("b")}},
+		},
+	}, {
+		desc:  "uuid strings",
+		input: &pb2.BinaryFields{Id: proto.String(testUUID), Refs: []string{"00000000-0000-0000-0000-000000000000"}},
+		want: bson.D{
+			{Key: "id", Value: primitive.Binary{Subtype: 4, Data: testUUIDBytes}},
+			{Key: "refs", Value: bson.A{primitive.Binary{Subtype: 4, Data: make([]byte, 16)}}},
+		},
+	}, {
+		desc: "map values",
+		input: &pb2.BinaryFields{
+			NamedRefs: map[string]string{"a": testUUID},
+			Checksums: map[string][]byte{"b": testUUIDBytes},
+		},
+		want: bson.D{
+			{Key: "namedRefs", Value: bson.D{{Key: "a", Value: primitive.Binary{Subtype: 4, Data: testUUIDBytes}}}},
+			{Key: "checksums", Value: bson.D{{Key: "b", Value: primitive.Binary{Subtype: 5, Data: testUUIDBytes}}}},
+		},
+	}, {
+		desc:  "unpopulated",
+		mo:    MarshalOptions{EmitUnpopulated: true},
+		input: &pb3.UUIDs{},
+		want: bson.D{
+			{Key: "id", Value: primitive.Null{}},
+			{Key: "checksum", Value: primitive.Null{}},
+			{Key: "refs", Value: bson.A{}},
+			{Key: "rawRefs", Value: bson.A{}},
+		},
+	}, {
+		desc:  "empty elements",
+		mo:    MarshalOptions{EmitUnpopulated: true},
+		input: &pb3.UUIDs{Id: testUUID, Refs: []string{"", testUUID}, RawRefs: [][]byte{{}}},
+		want: bson.D{
+			{Key: "id", Value: primitive.Binary{Subtype: 4, Data: testUUIDBytes}},
+			{Key: "checksum", Value: primitive.Null{}},
+			{Key: "refs", Value: bson.A{primitive.Null{}, primitive.Binary{Subtype: 4, Data: testUUIDBytes}}},
+			{Key: "rawRefs", Value: bson.A{primitive.Null{}}},
+		},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := tt.mo.Marshal(tt.input)
+			if err != nil {
+				t.Fatalf("Marshal() got error: %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Marshal() diff -want +got\n%v\n", diff)
+			}
+
+			decoded := tt.input.ProtoReflect().New().Interface()
+			umo := UnmarshalOptions{Strict: true, BinarySubtype: tt.mo.BinarySubtype}
+			if err := umo.Unmarshal(got, decoded); err != nil {
+				t.Fatalf("Unmarshal() got error: %v", err)
+			}
+			if !proto.Equal(decoded, tt.input) {
+				t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", decoded, tt.input)
+			}
+		})
+	}
+}
+
+func TestUnmarshalBinarySubtype(t *testing.T) {
+	tests := []struct {
+		desc        string
+		umo         UnmarshalOptions
+		inputBson   bson.D
+		wantMessage proto.Message
+		wantErr     string
+	}{{
+		desc:        "any subtype",
+		inputBson:   bson.D{{Key: "data", Value: primitive.Binary{Subtype: 4, Data: []byte("d")}}},
+		wantMessage: &pb2.BinaryFields{Data: []byte("d")},
+	}, {
+		desc:      "strict subtype",
+		umo:       UnmarshalOptions{Strict: true},
+		inputBson: bson.D{{Key: "data", Value: primitive.Binary{Subtype: 4, Data: []byte("d")}}},
+		wantErr:   "data: strict mode requires binary subtype 0 for textpb2_proto.BinaryFields.data, got 4",
+	}, {
+		desc:      "strict global subtype",
+		umo:       UnmarshalOptions{Strict: true, BinarySubtype: 0x80},
+		inputBson: bson.D{{Key: "data", Value: primitive.Binary{Data: []byte("d")}}},
+		wantErr:   "data: strict mode requires binary subtype 128",
+	}, {
+		desc:      "strict length",
+		umo:       UnmarshalOptions{Strict: true},
+		inputBson: bson.D{{Key: "checksum", Value: primitive.Binary{Subtype: 5, Data: []byte("d")}}},
+		wantErr:   "checksum: binary subtype 5 requires 16 bytes, got 1",
+	}, {
+		desc:        "uuid string into bytes",
+		inputBson:   bson.D{{Key: "rawId", Value: testUUID}},
+		wantMessage: &pb2.BinaryFields{RawId: testUUIDBytes},
+	}, {
+		desc:      "strict uuid string into bytes",
+		umo:       UnmarshalOptions{Strict: true},
+		inputBson: bson.D{{Key: "rawId", Value: testUUID}},
+		wantErr:   "rawId: strict mode requires BSON binary",
+	}, {
+		desc:        "uuid string",
+		inputBson:   bson.D{{Key: "id", Value: testUUID}},
+		wantMessage: &pb2.BinaryFields{Id: proto.String(testUUID)},
+	}, {
+		desc:        "legacy uuid",
+		inputBson:   bson.D{{Key: "id", Value: primitive.Binary{Subtype: 3, Data: testUUIDBytes}}},
+		wantMessage: &pb2.BinaryFields{Id: proto.String(testUUID)},
+	}, {
+		desc:      "strict legacy uuid",
+		umo:       UnmarshalOptions{Strict: true},
+		inputBson: bson.D{{Key: "id", Value: primitive.Binary{Subtype: 3, Data: testUUIDBytes}}},
+		wantErr:   "id: invalid binary subtype 3 for UUID",
+	}, {
+		desc:      "strict uuid string",
+		umo:       UnmarshalOptions{Strict: true},
+		inputBson: bson.D{{Key: "id", Value: testUUID}},
+		wantErr:   "id: invalid value for UUID",
+	}, {
+		desc:      "invalid uuid string",
+		inputBson: bson.D{{Key: "refs", Value: bson.A{"not-a-uuid"}}},
+		wantErr:   `refs[0]: invalid UUID "not-a-uuid"`,
+	}, {
+		desc:      "invalid uuid length",
+		inputBson: bson.D{{Key: "id", Value: primitive.Binary{Subtype: 4, Data: []byte("d")}}},
+		wantErr:   "id: invalid UUID of 1 bytes",
+	}, {
+		desc:      "invalid global subtype",
+		umo:       UnmarshalOptions{BinarySubtype: 6},
+		inputBson: bson.D{},
+		wantErr:   "unsupported binary subtype 6",
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			got := &pb2.BinaryFields{}
+			err := tt.umo.Unmarshal(tt.inputBson, got)
+			if err != nil {
+				if tt.wantErr == "" {
+					t.Errorf("Unmarshal() got unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Unmarshal() error got %q, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if tt.wantErr != "" {
+				t.Errorf("Unmarshal() got nil error, want error %q", tt.wantErr)
+			}
+			if !proto.Equal(got, tt.wantMessage) {
+				t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", got, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestBinarySubtypeErrors(t *testing.T) {
+	tests := []struct {
+		desc    string
+		mo      MarshalOptions
+		input   proto.Message
+		wantErr string
+	}{{
+		desc:    "invalid uuid",
+		input:   &pb2.BinaryFields{Id: proto.String("123e4567e89b12d3a456426614174000")},
+		wantErr: `id: invalid UUID "123e4567e89b12d3a456426614174000"`,
+	}, {
+		desc:    "invalid md5 length",
+		input:   &pb2.BinaryFields{Checksum: []byte("short")},
+		wantErr: "checksum: binary subtype 5 requires 16 bytes, got 5",
+	}, {
+		desc:    "invalid global subtype",
+		mo:      MarshalOptions{BinarySubtype: 2},
+		input:   &pb2.BinaryFields{},
+		wantErr: "unsupported binary subtype 2",
+	}, {
+		desc:    "invalid field subtype",
+		input:   &pb2.InvalidBinarySubtype{Data: []byte("d")},
+		wantErr: "data: unsupported binary subtype 6",
+	}, {
+		desc:    "uuid bytes field",
+		input:   &pb2.InvalidUUIDField{Id: []byte("d")},
+		wantErr: "uuid field textpb2_proto.InvalidUUIDField.id must be a string field",
+	}, {
+		desc:    "uuid map of bytes",
+		input:   &pb2.InvalidUUIDMap{Ids: map[string][]byte{"a": []byte("d")}},
+		wantErr: `ids["a"]: uuid field textpb2_proto.InvalidUUIDMap.ids must be a string field`,
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			_, err := tt.mo.Marshal(tt.input)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Marshal() got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
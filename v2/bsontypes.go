@@ -0,0 +1,113 @@
+package bsonpb
+
+import (
+	"math"
+	"reflect"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// bsonTypeOf returns the BSON type the given Go value is encoded as by the
+// default registry of the mongo driver. It returns 0 if the value has no
+// BSON representation.
+func bsonTypeOf(v interface{}) bsontype.Type {
+	switch vv := v.(type) {
+	case nil, primitive.Null:
+		return bsontype.Null
+	case primitive.Undefined:
+		return bsontype.Undefined
+	case primitive.Binary, []byte:
+		return bsontype.Binary
+	case primitive.DateTime, time.Time:
+		return bsontype.DateTime
+	case primitive.ObjectID:
+		return bsontype.ObjectID
+	case primitive.Regex:
+		return bsontype.Regex
+	case primitive.DBPointer:
+		return bsontype.DBPointer
+	case primitive.JavaScript:
+		return bsontype.JavaScript
+	case primitive.Symbol:
+		return bsontype.Symbol
+	case primitive.CodeWithScope:
+		return bsontype.CodeWithScope
+	case primitive.Timestamp:
+		return bsontype.Timestamp
+	case primitive.Decimal128:
+		return bsontype.Decimal128
+	case primitive.MinKey:
+		return bsontype.MinKey
+	case primitive.MaxKey:
+		return bsontype.MaxKey
+	case bson.Raw:
+		return bsontype.EmbeddedDocument
+	case bson.RawValue:
+		return vv.Type
+	case bson.D, bson.M:
+		return bsontype.EmbeddedDocument
+	case bson.A:
+		return bsontype.Array
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		return bsontype.Boolean
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return bsontype.Int32
+	case reflect.Int:
+		if i := rv.Int(); math.MinInt32 <= i && i <= math.MaxInt32 {
+			return bsontype.Int32
+		}
+		return bsontype.Int64
+	case reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return bsontype.Int64
+	case reflect.Float32, reflect.Float64:
+		return bsontype.Double
+	case reflect.String:
+		return bsontype.String
+	case reflect.Map, reflect.Struct:
+		return bsontype.EmbeddedDocument
+	case reflect.Slice, reflect.Array:
+		return bsontype.Array
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return bsontype.Null
+		}
+		return bsonTypeOf(rv.Elem().Interface())
+	}
+	return 0
+}
+
+// scalarBSONTypes returns the BSON types the encoder produces for a scalar
+// value of the given field.
+func scalarBSONTypes(fd pref.FieldDescriptor) []bsontype.Type {
+	switch fd.Kind() {
+	case pref.BoolKind:
+		return []bsontype.Type{bsontype.Boolean}
+	case pref.StringKind:
+		return []bsontype.Type{bsontype.String}
+	case pref.Int32Kind, pref.Sint32Kind, pref.Sfixed32Kind:
+		return []bsontype.Type{bsontype.Int32}
+	case pref.Int64Kind, pref.Sint64Kind, pref.Sfixed64Kind,
+		pref.Uint32Kind, pref.Fixed32Kind,
+		pref.Uint64Kind, pref.Fixed64Kind:
+		return []bsontype.Type{bsontype.Int64}
+	case pref.FloatKind, pref.DoubleKind:
+		return []bsontype.Type{bsontype.Double}
+	case pref.BytesKind:
+		return []bsontype.Type{bsontype.Binary}
+	case pref.EnumKind:
+		if isNullValue(fd) {
+			return []bsontype.Type{bsontype.Null}
+		}
+		// Deterministic output encodes enum numbers as int32.
+		return []bsontype.Type{bsontype.String, bsontype.Int64, bsontype.Int32}
+	}
+	return nil
+}
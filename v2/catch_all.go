@@ -0,0 +1,101 @@
+package bsonpb
+
+import (
+	"strings"
+
+	"github.com/romnn/bsonpb/v2/internal/genid"
+	"github.com/romnn/bsonpb/v2/options"
+	"go.mongodb.org/mongo-driver/bson"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// catchAllField returns the field of md marked with the (bsonpb.catch_all)
+// field option or nil if there is none.
+func catchAllField(md pref.MessageDescriptor) (pref.FieldDescriptor, error) {
+	v, err := analyses.load(analysisCatchAll, md, func() (interface{}, error) {
+		return findCatchAllField(md)
+	})
+	fd, _ := v.(pref.FieldDescriptor)
+	return fd, err
+}
+
+func findCatchAllField(md pref.MessageDescriptor) (pref.FieldDescriptor, error) {
+	var catchAll pref.FieldDescriptor
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if !boolFieldOption(fd, options.E_CatchAll) {
+			continue
+		}
+		switch od := fd.ContainingOneof(); {
+		case catchAll != nil:
+			return nil, newError(CategoryUnsupported, "message %v has more than one catch-all field", md.FullName())
+		case !isCatchAllType(fd):
+			return nil, newError(CategoryUnsupported, "catch-all field %v must be a %v or a map of %v", fd.FullName(), genid.Struct_message_fullname, genid.Value_message_fullname)
+		case od != nil && !od.IsSynthetic():
+			return nil, newError(CategoryUnsupported, "catch-all field %v can not be part of a oneof", fd.FullName())
+		case isSensitive(fd) || isEncrypted(fd):
+			return nil, newError(CategoryUnsupported, "catch-all field %v can not be sensitive or encrypted", fd.FullName())
+		}
+		catchAll = fd
+	}
+	return catchAll, nil
+}
+
+// isCatchAllType reports whether fd is a google.protobuf.Struct or a
+// map<string, google.protobuf.Value> field.
+func isCatchAllType(fd pref.FieldDescriptor) bool {
+	if fd.IsMap() {
+		key, val := fd.MapKey(), fd.MapValue()
+		return key.Kind() == pref.StringKind && val.Message() != nil && val.Message().FullName() == genid.Value_message_fullname
+	}
+	return !fd.IsList() && fd.Message() != nil && fd.Message().FullName() == genid.Struct_message_fullname
+}
+
+// catchAllEntries returns the marshaled entries of the catch-all field fd,
+// which are written inline.
+func catchAllEntries(fd pref.FieldDescriptor, marshaled interface{}) (bson.D, error) {
+	doc, ok := marshaled.(bson.D)
+	if !ok {
+		return nil, newError(CategoryUnsupported, "catch-all field %v is not encoded as a document", fd.FullName())
+	}
+	return doc, nil
+}
+
+// checkCatchAllKeys reports keys captured by the catch-all field that would
+// be decoded as something else: a key of another field or oneof of the
+// message, an extension, the unknown fields or another key of the result.
+func checkCatchAllKeys(fd pref.FieldDescriptor, captured, result bson.D, unknownKey string) error {
+	keys, err := messageKeySet(fd.ContainingMessage())
+	if err != nil {
+		return err
+	}
+	for _, elem := range captured {
+		key := elem.Key
+		src, isKey := keys.sources[key]
+		isExtension := strings.HasPrefix(key, "[") && strings.HasSuffix(key, "]")
+		isUnknown := unknownKey != "" && (key == unknownKey || strings.HasPrefix(key, unknownKey+"."))
+		if (isKey && src != fd) || isExtension || isUnknown {
+			return withField(newError(CategoryDuplicateField, "key %q of catch-all field %v conflicts with a field", key, fd.FullName()), key)
+		}
+	}
+	seen := make(map[string]bool, len(result))
+	for _, elem := range result {
+		if seen[elem.Key] {
+			return withField(newError(CategoryDuplicateField, "key %q of catch-all field %v conflicts with a field", elem.Key, fd.FullName()), elem.Key)
+		}
+		seen[elem.Key] = true
+	}
+	return nil
+}
+
+// unmarshalCatchAll sets the captured document keys in the catch-all field fd
+// of the message m.
+func (d decoder) unmarshalCatchAll(captured bson.D, m pref.Message, fd pref.FieldDescriptor) error {
+	if fd.IsMap() {
+		return d.unmarshalMap(captured, m.Mutable(fd).Map(), fd)
+	}
+	sm := m.Mutable(fd).Message()
+	sfd := sm.Descriptor().Fields().ByNumber(genid.Struct_Fields_field_number)
+	return d.unmarshalMap(captured, sm.Mutable(sfd).Map(), sfd)
+}
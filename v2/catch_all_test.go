@@ -0,0 +1,187 @@
+package bsonpb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	pb2 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb2_proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestCatchAll(t *testing.T) {
+	tests := []struct {
+		desc  string
+		mo    MarshalOptions
+		input proto.Message
+		want  bson.D
+	}{{
+		desc: "struct",
+		input: &pb2.CatchAll{
+			Name: proto.String("x"),
+			Extra: &structpb.Struct{Fields: map[string]*structpb.Value{
+				"b":   structpb.NewStringValue("s"),
+				"a":   structpb.NewNumberValue(1),
+				"obj": structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{"c": structpb.NewBoolValue(true)}}),
+			}},
+		},
+		want: bson.D{
+			{Key: "name", Value: "x"},
+			{Key: "a", Value: float64(1)},
+			{Key: "b", Value: "s"},
+			{Key: "obj", Value: bson.D{{Key: "c", Value: true}}},
+		},
+	}, {
+		desc: "name of the catch-all field",
+		input: &pb2.CatchAll{Extra: &structpb.Struct{Fields: map[string]*structpb.Value{
+			"extra": structpb.NewNullValue(),
+		}}},
+		want: bson.D{{Key: "extra", Value: primitive.Null{}}},
+	}, {
+		desc: "map in submessage",
+		mo:   MarshalOptions{UseProtoNames: true, Deterministic: true, FieldOrder: OrderByName},
+		input: &pb2.CatchAll{Child: &pb2.CatchAllMap{
+			Count: proto.Int32(2),
+			Attributes: map[string]*structpb.Value{
+				"tags": structpb.NewListValue(&structpb.ListValue{Values: []*structpb.Value{structpb.NewStringValue("t")}}),
+				"at":   structpb.NewStringValue("now"),
+			},
+		}},
+		want: bson.D{{Key: "child", Value: bson.D{
+			{Key: "at", Value: "now"},
+			{Key: "count", Value: int32(2)},
+			{Key: "tags", Value: bson.A{"t"}},
+		}}},
+	}, {
+		desc:  "empty catch-all field",
+		mo:    MarshalOptions{EmitUnpopulated: true},
+		input: &pb2.CatchAllMap{Count: proto.Int32(1)},
+		want:  bson.D{{Key: "count", Value: int32(1)}},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := tt.mo.Marshal(tt.input)
+			if err != nil {
+				t.Fatalf("Marshal() got error: %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Marshal() diff -want +got\n%v\n", diff)
+			}
+
+			decoded := tt.input.ProtoReflect().New().Interface()
+			if err := Unmarshal(got, decoded); err != nil {
+				t.Fatalf("Unmarshal() got error: %v", err)
+			}
+			if !proto.Equal(decoded, tt.input) {
+				t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", decoded, tt.input)
+			}
+		})
+	}
+}
+
+func TestUnmarshalCatchAll(t *testing.T) {
+	tests := []struct {
+		desc        string
+		umo         UnmarshalOptions
+		inputBson   bson.D
+		wantMessage proto.Message
+		wantErr     string
+	}{{
+		desc: "unknown keys",
+		inputBson: bson.D{
+			{Key: "_id", Value: "1"},
+			{Key: "name", Value: "x"},
+			{Key: "total", Value: int32(3)},
+		},
+		wantMessage: &pb2.CatchAll{
+			Name: proto.String("x"),
+			Extra: &structpb.Struct{Fields: map[string]*structpb.Value{
+				"_id":   structpb.NewStringValue("1"),
+				"total": structpb.NewNumberValue(3),
+			}},
+		},
+	}, {
+		desc:        "masked out",
+		umo:         UnmarshalOptions{Mask: &fieldmaskpb.FieldMask{Paths: []string{"name"}}},
+		inputBson:   bson.D{{Key: "name", Value: "x"}, {Key: "total", Value: int32(3)}},
+		wantMessage: &pb2.CatchAll{Name: proto.String("x")},
+	}, {
+		desc:      "elements are counted once",
+		umo:       UnmarshalOptions{MaxElements: 3},
+		inputBson: bson.D{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}, {Key: "c", Value: "3"}},
+		wantMessage: &pb2.CatchAll{Extra: &structpb.Struct{Fields: map[string]*structpb.Value{
+			"a": structpb.NewStringValue("1"),
+			"b": structpb.NewStringValue("2"),
+			"c": structpb.NewStringValue("3"),
+		}}},
+	}, {
+		desc:      "duplicate key",
+		inputBson: bson.D{{Key: "a", Value: "1"}, {Key: "a", Value: "2"}},
+		wantErr:   `["a"]: duplicate map key a`,
+	}, {
+		desc:      "invalid value",
+		inputBson: bson.D{{Key: "a", Value: primitive.MinKey{}}},
+		wantErr:   `["a"]:`,
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			got := &pb2.CatchAll{}
+			err := tt.umo.Unmarshal(tt.inputBson, got)
+			if err != nil {
+				if tt.wantErr == "" {
+					t.Errorf("Unmarshal() got unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Unmarshal() error got %q, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if tt.wantErr != "" {
+				t.Errorf("Unmarshal() got nil error, want error %q", tt.wantErr)
+			}
+			if !proto.Equal(got, tt.wantMessage) {
+				t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", got, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestCatchAllErrors(t *testing.T) {
+	conflicts := []struct {
+		mo  MarshalOptions
+		key string
+	}{
+		{key: "name"},
+		{key: "display_name"},
+		{mo: MarshalOptions{UseProtoNames: true}, key: "displayName"},
+		{key: "contact"},
+		{key: "contactCase"},
+		{key: "[textpb2_proto.opt_ext_string]"},
+		{mo: MarshalOptions{UnknownFieldsKey: DefaultUnknownFieldsKey}, key: "_unknown"},
+	}
+	for _, c := range conflicts {
+		_, err := c.mo.Marshal(&pb2.CatchAll{
+			Name:  proto.String("x"),
+			Extra: &structpb.Struct{Fields: map[string]*structpb.Value{c.key: structpb.NewStringValue("y")}},
+		})
+		if want := c.key + `: key "` + c.key + `" of catch-all field textpb2_proto.CatchAll.extra conflicts with a field`; err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Marshal() got error %v, want %q", err, want)
+		}
+	}
+
+	want := "catch-all field textpb2_proto.InvalidCatchAll.extra must be a google.protobuf.Struct or a map of google.protobuf.Value"
+	if _, err := Marshal(&pb2.InvalidCatchAll{Name: proto.String("x")}); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Marshal() got error %v, want %q", err, want)
+	}
+	if err := Unmarshal(bson.D{{Key: "name", Value: "x"}}, &pb2.InvalidCatchAll{}); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Unmarshal() got error %v, want %q", err, want)
+	}
+}
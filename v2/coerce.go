@@ -0,0 +1,116 @@
+package bsonpb
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// CoercionPolicy selects which lenient conversions the decoder applies to
+// values whose BSON type does not match the proto kind of the field. A
+// coercion that would lose information is reported as an error.
+type CoercionPolicy struct {
+	// IntegralDoubles accepts doubles with an integral value, e.g. 5.0, for
+	// integer fields.
+	IntegralDoubles bool
+
+	// NumericStrings accepts strings such as "42" or "1.5" for numeric fields.
+	NumericStrings bool
+
+	// NumbersToStrings accepts numbers for string fields. They are formatted
+	// in their shortest decimal representation.
+	NumbersToStrings bool
+
+	// IntsToBools accepts the integers 0 and 1 for bool fields.
+	IntsToBools bool
+}
+
+// coerce converts doc into a value that unmarshalScalar accepts for the
+// given kind. It reports whether a coercion was applied.
+func (c CoercionPolicy) coerce(doc interface{}, kind pref.Kind) (interface{}, bool, error) {
+	vdoc := reflect.ValueOf(doc)
+	docKind := vdoc.Kind()
+	isInt := reflect.Int <= docKind && docKind <= reflect.Int64
+	isUint := reflect.Uint <= docKind && docKind <= reflect.Uint64
+	isFloat := docKind == reflect.Float32 || docKind == reflect.Float64
+
+	switch kind {
+	case pref.BoolKind:
+		if !c.IntsToBools || !(isInt || isUint) {
+			break
+		}
+		switch {
+		case isInt && vdoc.Int() == 0, isUint && vdoc.Uint() == 0:
+			return false, true, nil
+		case isInt && vdoc.Int() == 1, isUint && vdoc.Uint() == 1:
+			return true, true, nil
+		}
+		return nil, true, newValueError(CategoryInvalidValue, kind, doc, "cannot coerce %v to bool without loss", doc)
+
+	case pref.Int32Kind, pref.Sint32Kind, pref.Sfixed32Kind,
+		pref.Int64Kind, pref.Sint64Kind, pref.Sfixed64Kind,
+		pref.Uint32Kind, pref.Fixed32Kind,
+		pref.Uint64Kind, pref.Fixed64Kind:
+		switch {
+		case c.IntegralDoubles && isFloat:
+			return coerceIntegral(vdoc.Float(), kind, doc)
+		case c.NumericStrings && docKind == reflect.String:
+			s := vdoc.String()
+			if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return i, true, nil
+			}
+			if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+				return u, true, nil
+			}
+			if c.IntegralDoubles {
+				if f, err := strconv.ParseFloat(s, 64); err == nil {
+					return coerceIntegral(f, kind, doc)
+				}
+			}
+			return nil, true, newValueError(CategoryInvalidValue, kind, doc, "cannot coerce %q to %v", s, kind)
+		}
+
+	case pref.FloatKind, pref.DoubleKind:
+		if c.NumericStrings && docKind == reflect.String {
+			f, err := strconv.ParseFloat(vdoc.String(), 64)
+			if err != nil {
+				return nil, true, newValueError(CategoryInvalidValue, kind, doc, "cannot coerce %q to %v", vdoc.String(), kind)
+			}
+			return f, true, nil
+		}
+
+	case pref.StringKind:
+		if !c.NumbersToStrings {
+			break
+		}
+		switch {
+		case isInt:
+			return strconv.FormatInt(vdoc.Int(), 10), true, nil
+		case isUint:
+			return strconv.FormatUint(vdoc.Uint(), 10), true, nil
+		case docKind == reflect.Float32:
+			return strconv.FormatFloat(vdoc.Float(), 'g', -1, 32), true, nil
+		case docKind == reflect.Float64:
+			return strconv.FormatFloat(vdoc.Float(), 'g', -1, 64), true, nil
+		}
+	}
+	return doc, false, nil
+}
+
+// coerceIntegral converts f to an int64 or uint64 if it has an integral value
+// that fits into 64 bits. Range checks for narrower kinds are left to
+// unmarshalScalar.
+func coerceIntegral(f float64, kind pref.Kind, doc interface{}) (interface{}, bool, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) || math.Trunc(f) != f {
+		return nil, true, newValueError(CategoryInvalidValue, kind, doc, "cannot coerce %v to %v without loss", doc, kind)
+	}
+	switch {
+	case f >= math.MinInt64 && f < math.MaxInt64:
+		return int64(f), true, nil
+	case f >= 0 && f < math.MaxUint64:
+		return uint64(f), true, nil
+	}
+	return nil, true, newValueError(CategoryInvalidValue, kind, doc, "cannot coerce %v to %v: out of range", doc, kind)
+}
@@ -0,0 +1,171 @@
+package bsonpb
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	pb3 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb3_proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestUnmarshalCoercion(t *testing.T) {
+	all := UnmarshalOptions{Coerce: CoercionPolicy{
+		IntegralDoubles:  true,
+		NumericStrings:   true,
+		NumbersToStrings: true,
+		IntsToBools:      true,
+	}}
+
+	tests := []struct {
+		desc         string
+		umo          UnmarshalOptions
+		inputMessage proto.Message
+		inputBson    interface{}
+		wantMessage  proto.Message
+		wantErr      string
+		wantCategory ErrorCategory
+	}{{
+		desc:         "no coercion by default",
+		inputMessage: &pb3.Scalars{},
+		inputBson:    bson.D{{Key: "sInt32", Value: 5.0}},
+		wantErr:      "invalid value for int32 type: 5",
+		wantCategory: CategoryTypeMismatch,
+	}, {
+		desc:         "integral doubles",
+		umo:          UnmarshalOptions{Coerce: CoercionPolicy{IntegralDoubles: true}},
+		inputMessage: &pb3.Scalars{},
+		inputBson: bson.D{
+			{Key: "sInt32", Value: 5.0},
+			{Key: "sInt64", Value: -3.0},
+			{Key: "sUint32", Value: float32(7)},
+			{Key: "sFixed64", Value: 1e19},
+		},
+		wantMessage: &pb3.Scalars{SInt32: 5, SInt64: -3, SUint32: 7, SFixed64: 1e19},
+	}, {
+		desc:         "fractional double is lossy",
+		umo:          all,
+		inputMessage: &pb3.Scalars{},
+		inputBson:    bson.D{{Key: "sInt64", Value: 5.5}},
+		wantErr:      "cannot coerce 5.5 to int64 without loss",
+		wantCategory: CategoryInvalidValue,
+	}, {
+		desc:         "integral double out of range",
+		umo:          all,
+		inputMessage: &pb3.Scalars{},
+		inputBson:    bson.D{{Key: "sInt32", Value: 5e9}},
+		wantErr:      "invalid value for int32 type: 5e+09 (has type float64)",
+		wantCategory: CategoryInvalidValue,
+	}, {
+		desc:         "negative double for unsigned field",
+		umo:          all,
+		inputMessage: &pb3.Scalars{},
+		inputBson:    bson.D{{Key: "sUint64", Value: -1.0}},
+		wantErr:      "invalid value for uint64 type: -1",
+		wantCategory: CategoryInvalidValue,
+	}, {
+		desc:         "numeric strings",
+		umo:          UnmarshalOptions{Coerce: CoercionPolicy{NumericStrings: true}},
+		inputMessage: &pb3.Scalars{},
+		inputBson: bson.D{
+			{Key: "sInt32", Value: "42"},
+			{Key: "sUint64", Value: "18446744073709551615"},
+			{Key: "sFloat", Value: "1.5"},
+			{Key: "sDouble", Value: "-2e3"},
+		},
+		wantMessage: &pb3.Scalars{SInt32: 42, SUint64: 18446744073709551615, SFloat: 1.5, SDouble: -2e3},
+	}, {
+		desc:         "non numeric string",
+		umo:          all,
+		inputMessage: &pb3.Scalars{},
+		inputBson:    bson.D{{Key: "sInt32", Value: "forty-two"}},
+		wantErr:      `cannot coerce "forty-two" to int32`,
+		wantCategory: CategoryInvalidValue,
+	}, {
+		desc:         "numeric string out of range",
+		umo:          all,
+		inputMessage: &pb3.Scalars{},
+		inputBson:    bson.D{{Key: "sUint32", Value: "-1"}},
+		wantErr:      `invalid value for uint32 type: "-1"`,
+		wantCategory: CategoryInvalidValue,
+	}, {
+		desc:         "integral numeric string needs IntegralDoubles",
+		umo:          UnmarshalOptions{Coerce: CoercionPolicy{NumericStrings: true}},
+		inputMessage: &pb3.Scalars{},
+		inputBson:    bson.D{{Key: "sInt32", Value: "5.0"}},
+		wantErr:      `cannot coerce "5.0" to int32`,
+		wantCategory: CategoryInvalidValue,
+	}, {
+		desc:         "integral numeric string",
+		umo:          all,
+		inputMessage: &pb3.Scalars{},
+		inputBson:    bson.D{{Key: "sInt32", Value: "5.0"}},
+		wantMessage:  &pb3.Scalars{SInt32: 5},
+	}, {
+		desc:         "numbers to strings",
+		umo:          UnmarshalOptions{Coerce: CoercionPolicy{NumbersToStrings: true}},
+		inputMessage: &pb3.Repeats{},
+		inputBson: bson.D{
+			{Key: "rptString", Value: bson.A{int32(1), int64(-2), 0.5, float32(0.1), "x"}},
+		},
+		wantMessage: &pb3.Repeats{RptString: []string{"1", "-2", "0.5", "0.1", "x"}},
+	}, {
+		desc:         "ints to bools",
+		umo:          UnmarshalOptions{Coerce: CoercionPolicy{IntsToBools: true}},
+		inputMessage: &pb3.Repeats{},
+		inputBson:    bson.D{{Key: "rptBool", Value: bson.A{int32(0), int64(1), true}}},
+		wantMessage:  &pb3.Repeats{RptBool: []bool{false, true, true}},
+	}, {
+		desc:         "int to bool is lossy",
+		umo:          all,
+		inputMessage: &pb3.Scalars{},
+		inputBson:    bson.D{{Key: "sBool", Value: int32(2)}},
+		wantErr:      "cannot coerce 2 to bool without loss",
+		wantCategory: CategoryInvalidValue,
+	}, {
+		desc:         "map values",
+		umo:          all,
+		inputMessage: &pb3.Maps{},
+		inputBson: bson.D{
+			{Key: "int32ToStr", Value: bson.D{{Key: "1", Value: 10.0}}},
+			{Key: "boolToUint32", Value: bson.D{{Key: "true", Value: "7"}}},
+		},
+		wantMessage: &pb3.Maps{
+			Int32ToStr:   map[int32]string{1: "10"},
+			BoolToUint32: map[bool]uint32{true: 7},
+		},
+	}, {
+		desc:         "wrapper type",
+		umo:          all,
+		inputMessage: &wrapperspb.Int64Value{},
+		inputBson:    "123",
+		wantMessage:  &wrapperspb.Int64Value{Value: 123},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			if err := tt.umo.Unmarshal(tt.inputBson, tt.inputMessage); err != nil {
+				if tt.wantErr == "" {
+					t.Errorf("Unmarshal() got unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Unmarshal() error got %q, want %q", err, tt.wantErr)
+				}
+				var e *Error
+				if errors.As(err, &e) && e.Category != tt.wantCategory {
+					t.Errorf("Unmarshal() error category got %v, want %v", e.Category, tt.wantCategory)
+				}
+				return
+			}
+			if tt.wantErr != "" {
+				t.Errorf("Unmarshal() got nil error, want error %q", tt.wantErr)
+			}
+			if tt.wantMessage != nil && !proto.Equal(tt.inputMessage, tt.wantMessage) {
+				t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", tt.inputMessage, tt.wantMessage)
+			}
+		})
+	}
+}
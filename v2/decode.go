@@ -1,7 +1,6 @@
 package bsonpb
 
 import (
-	"errors"
 	"fmt"
 	"math"
 	"reflect"
@@ -17,6 +16,7 @@ import (
 	"google.golang.org/protobuf/proto"
 	pref "google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
 // Unmarshal reads the given bson.D into the given proto.Message.
@@ -35,25 +35,104 @@ type UnmarshalOptions struct {
 	// If DiscardUnknown is set, unknown fields are ignored.
 	DiscardUnknown bool
 
+	// If Merge is set, the document is merged into the message instead of
+	// replacing its contents, following proto.Merge semantics: populated
+	// singular fields are overwritten, singular messages are merged
+	// recursively, repeated fields are appended to and map entries are set by
+	// key. Well-known and custom types are replaced as a whole. Duplicate fields, map
+	// keys and oneof conflicts are still reported within the document.
+	Merge bool
+
+	// If ReplaceLists is set, repeated fields that are present in the
+	// document replace the existing elements when merging instead of being
+	// appended to.
+	ReplaceLists bool
+
+	// If AllErrors is set, the decoder does not stop at the first error but
+	// keeps walking the document and returns every problem found as Errors.
+	// Whatever could be decoded is still populated.
+	AllErrors bool
+
+	// Coerce selects lenient conversions for values whose BSON type does not
+	// match the kind of the field. By default no coercion is applied.
+	Coerce CoercionPolicy
+
+	// If Strict is set, scalar values and timestamps must have exactly the
+	// BSON type the encoder produces for them, e.g. int32 for int32 fields
+	// and int64 for int64 and uint32 fields, even if another numeric type
+	// would fit. Strict takes precedence over Coerce.
+	Strict bool
+
+	// RecursionLimit limits how deeply messages may be nested, including
+	// google.protobuf.Struct, Value, ListValue and Any values.
+	// If zero, a default limit of 10000 is used.
+	RecursionLimit int
+
+	// MaxElements limits the total number of fields, map entries and list
+	// items that are decoded. If zero, there is no limit.
+	MaxElements int
+
+	// MaxBytes limits the total length of string and bytes values, as well as
+	// the length of the input to UnmarshalBytes. If zero, there is no limit.
+	MaxBytes int
+
+	// Mask restricts decoding to the fields selected by its paths, using the
+	// same path syntax as MarshalOptions.Mask. Fields and extensions that are
+	// not selected are ignored, but unknown fields are still reported unless
+	// DiscardUnknown is set. Combined with Merge, only the selected fields of
+	// the message are updated. If nil or empty, all fields are decoded.
+	Mask *fieldmaskpb.FieldMask
+
+	// Decryptor decrypts the values of fields that are marked with the
+	// (bsonpb.encrypted) field option and stored as BSON binary values of
+	// subtype EncryptedSubtype. Values that are not encrypted are decoded as
+	// is. Decoding an encrypted value fails if it is nil.
+	Decryptor Decryptor
+
+	// Types selects custom unmarshal functions for message types.
+	Types *TypeRegistry
+
+	// TypeKey is the key of the type written by MarshalOptions.TypeKey. If
+	// set, the key is removed from the top-level document and must name the
+	// type of the message.
+	TypeKey string
+
+	// BinarySubtype is the BSON binary subtype of bytes fields without the
+	// (bsonpb.binary_subtype) field option. In strict mode, binary values
+	// must have the subtype selected for their field. Otherwise any subtype
+	// is accepted, as are UUID strings for UUID fields.
+	BinarySubtype byte
+
+	// UnknownFieldsKey is the key of the unknown fields written by
+	// MarshalOptions.UnknownFieldsKey. If set, they are restored with
+	// SetUnknown, unless Mask is set. If empty, the key is an unknown field.
+	UnknownFieldsKey string
+
+	// If AllowUnresolvedAny is set, google.protobuf.Any messages of the form
+	// {"@type": url, "@value": Binary} written by
+	// MarshalOptions.AllowUnresolvedAny are decoded byte for byte, whether
+	// their type resolves or not.
+	AllowUnresolvedAny bool
+
 	// Resolver is used for looking up types when unmarshaling
 	// google.protobuf.Any messages or extension fields.
 	// If nil, this defaults to using protoregistry.GlobalTypes.
-	Resolver interface {
-		protoregistry.MessageTypeResolver
-		protoregistry.ExtensionTypeResolver
-	}
+	Resolver Resolver
 }
 
 // Unmarshal reads the given []byte and populates the given proto.Message using
 // options in UnmarshalOptions object. It will clear the message first before
-// setting the fields. If it returns an error, the given message may be
-// partially set.
+// setting the fields unless Merge is set. If it returns an error, the given
+// message may be partially set.
 func (o UnmarshalOptions) Unmarshal(doc interface{}, m proto.Message) error {
 	return o.unmarshal(doc, m)
 }
 
 // UnmarshalBytes ...
 func (o UnmarshalOptions) UnmarshalBytes(b []byte, m proto.Message) error {
+	if o.MaxBytes > 0 && len(b) > o.MaxBytes {
+		return newError(CategoryLimitExceeded, "document of %d bytes exceeds maximum of %d bytes", len(b), o.MaxBytes)
+	}
 	reader := bsonrw.NewBSONDocumentReader(b)
 	bsonDec, err := bson.NewDecoder(reader)
 	if err != nil {
@@ -71,30 +150,108 @@ func (o UnmarshalOptions) UnmarshalBytes(b []byte, m proto.Message) error {
 // For profiling purposes, avoid changing the name of this function or
 // introducing other code paths for unmarshal that do not go through this.
 func (o UnmarshalOptions) unmarshal(doc interface{}, m proto.Message) error {
-	proto.Reset(m)
+	mask, err := newFieldMask(m.ProtoReflect().Descriptor(), o.Mask)
+	if err != nil {
+		return err
+	}
+	if err := checkBinarySubtype(uint32(o.BinarySubtype)); err != nil {
+		return err
+	}
+	if !o.Merge {
+		proto.Reset(m)
+	}
 
 	if o.Resolver == nil {
 		o.Resolver = protoregistry.GlobalTypes
 	}
+	if o.RecursionLimit == 0 {
+		o.RecursionLimit = defaultRecursionLimit
+	}
 
-	dec := decoder{o}
-	if err := dec.unmarshalMessage(doc, m.ProtoReflect(), false); err != nil {
+	dec := decoder{opts: o, mask: mask, state: &decodeState{}}
+	if docD, ok := doc.(bson.D); ok && o.TypeKey != "" {
+		if doc, err = dec.stripTypeKey(docD, m.ProtoReflect()); err != nil {
+			return err
+		}
+	}
+	err = dec.unmarshalMessage(doc, m.ProtoReflect(), false)
+	if o.AllErrors {
+		var errs Errors
+		errs.add(err)
+		if !o.AllowPartial {
+			errs = append(errs, checkAllInitialized(m, doc)...)
+		}
+		return errs.err()
+	}
+	if err != nil {
 		return err
 	}
 
 	if o.AllowPartial {
 		return nil
 	}
-	return proto.CheckInitialized(m)
+	return requiredPaths{}.checkInitialized(m, doc)
 }
 
+// defaultRecursionLimit matches the default of the protobuf binary decoder.
+const defaultRecursionLimit = 10000
+
 type decoder struct {
 	opts UnmarshalOptions
+
+	// depth is the nesting depth of the message being decoded.
+	depth int
+
+	// mask selects the fields of the message being decoded.
+	mask fieldMask
+
+	// state is shared by all copies of the decoder.
+	state *decodeState
+}
+
+// decodeState counts what has been decoded so far to enforce limits.
+type decodeState struct {
+	elements int
+	bytes    int
+}
+
+// countElement counts a decoded field, map entry or list item.
+func (d decoder) countElement() error {
+	d.state.elements++
+	if d.opts.MaxElements > 0 && d.state.elements > d.opts.MaxElements {
+		return newError(CategoryLimitExceeded, "exceeded maximum of %d elements", d.opts.MaxElements)
+	}
+	return nil
+}
+
+// countBytes counts the length of a decoded string or bytes value.
+func (d decoder) countBytes(n int) error {
+	d.state.bytes += n
+	if d.opts.MaxBytes > 0 && d.state.bytes > d.opts.MaxBytes {
+		return newError(CategoryLimitExceeded, "exceeded maximum of %d bytes", d.opts.MaxBytes)
+	}
+	return nil
+}
+
+// collect returns err unless all errors are collected, in which case err is
+// added to errs and nil is returned so that decoding continues. Exceeded
+// limits always abort decoding.
+func (d decoder) collect(errs *Errors, err error) error {
+	if !d.opts.AllErrors || isLimitExceeded(err) {
+		return err
+	}
+	errs.add(err)
+	return nil
 }
 
 // unmarshalMessage unmarshals a message into the given protoreflect.Message.
 func (d decoder) unmarshalMessage(doc interface{}, m pref.Message, skipTypeURL bool) error {
-	if unmarshalFunc := wellKnownTypeUnmarshaler(m.Descriptor().FullName()); unmarshalFunc != nil {
+	if d.depth++; d.depth > d.opts.RecursionLimit {
+		return newError(CategoryLimitExceeded, "exceeded maximum recursion depth of %d", d.opts.RecursionLimit)
+	}
+
+	if unmarshalFunc := d.typeUnmarshaler(m.Descriptor().FullName()); unmarshalFunc != nil {
+		d.mask = nil
 		return unmarshalFunc(d, doc, m)
 	}
 
@@ -102,37 +259,95 @@ func (d decoder) unmarshalMessage(doc interface{}, m pref.Message, skipTypeURL b
 	if (isNullPrimitive || doc == nil) && m.Descriptor().FullName() == genid.Value_message_fullname {
 		return nil
 	}
+	return d.unmarshalFields(doc, m)
+}
 
+// unmarshalFields unmarshals the fields of a document into the given
+// protoreflect.Message.
+func (d decoder) unmarshalFields(doc interface{}, m pref.Message) error {
 	messageDesc := m.Descriptor()
 	if !protoLegacy && IsMessageSet(messageDesc) {
-		return errors.New("no support for proto1 MessageSets")
+		return newError(CategoryUnsupported, "no support for proto1 MessageSets")
+	}
+
+	catchAll, err := catchAllField(messageDesc)
+	if err != nil {
+		return err
+	}
+	var captured bson.D
+	inline, err := analyzeInline(messageDesc)
+	if err != nil {
+		return err
 	}
+	var inlined []inlinedFields
 
 	var seenNums Ints
 	var seenOneofs Ints
+	var seenUnknown bool
+	var discriminators []oneofDiscriminator
+	var errs Errors
 	fieldDescs := messageDesc.Fields()
 
 	docD, ok := doc.(bson.D)
 	if !ok {
-		return fmt.Errorf("unexpected message value: %v", doc)
+		return newValueError(CategoryTypeMismatch, pref.MessageKind, doc, "unexpected message value: %v", doc)
 	}
 	for _, item := range docD {
 		name := item.Key
 		val := item.Value
+		if err := d.countElement(); err != nil {
+			return withField(err, name)
+		}
+		if key := d.opts.UnknownFieldsKey; key != "" && name == key {
+			if seenUnknown {
+				if err := d.collect(&errs, withField(newError(CategoryDuplicateField, "duplicate field %q", name), name)); err != nil {
+					return err
+				}
+				continue
+			}
+			seenUnknown = true
+			if d.mask == nil {
+				if err := d.unmarshalUnknownFields(val, m); err != nil {
+					if err := d.collect(&errs, withField(err, name)); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+		if ifd := inline.unknownFieldsField(d.opts.UnknownFieldsKey, name); ifd != nil {
+			// Unknown fields of inlined messages are restored with them.
+			inlined = addInlined(inlined, ifd, item)
+			continue
+		}
 		var fd pref.FieldDescriptor
 		if strings.HasPrefix(name, "[") && strings.HasSuffix(name, "]") {
-			// Only extension names are in [name] format.
+			// Only extension names are in [name] format. They can not be
+			// selected by a mask.
+			if d.mask != nil {
+				continue
+			}
 			extName := pref.FullName(name[1 : len(name)-1])
 			extType, err := d.opts.Resolver.FindExtensionByName(extName)
 			if err != nil && err != protoregistry.NotFound {
-				return fmt.Errorf("unable to resolve %v: %v", val, err)
+				if err := d.collect(&errs, withField(newError(CategoryUnresolvable, "unable to resolve %v: %v", val, err), name)); err != nil {
+					return err
+				}
+				continue
 			}
 			if extType != nil {
 				fd = extType.TypeDescriptor()
 				if !messageDesc.ExtensionRanges().Has(fd.Number()) || fd.ContainingMessage().FullName() != messageDesc.FullName() {
-					return fmt.Errorf("message %v cannot be extended by %v", messageDesc.FullName(), fd.FullName())
+					if err := d.collect(&errs, withField(newError(CategoryUnknownField, "message %v cannot be extended by %v", messageDesc.FullName(), fd.FullName()), name)); err != nil {
+						return err
+					}
+					continue
 				}
 			}
+		} else if ifd := inline.field(name); ifd != nil {
+			// Keys of inlined messages are decoded together.
+			inlined = addInlined(inlined, ifd, item)
+			continue
 		} else {
 			// The name can either be the JSON name or the proto field name.
 			fd = fieldDescs.ByJSONName(name)
@@ -155,6 +370,26 @@ func (d decoder) unmarshalMessage(doc interface{}, m pref.Message, skipTypeURL b
 					fd = nil // reset since field name is actually the message name
 				}
 			}
+			if inline.isInline(fd) {
+				fd = nil // inline fields are not written under their name
+			}
+			if fd == nil {
+				// Oneofs may be encoded as tagged subdocuments or with a
+				// discriminator next to the set field.
+				if od, discriminator := oneofByKey(messageDesc, name); od != nil {
+					if discriminator {
+						discriminators = append(discriminators, oneofDiscriminator{key: name, oneof: od, value: val})
+						continue
+					}
+					var err error
+					if fd, val, err = unmarshalTaggedOneof(od, val); err != nil {
+						if err := d.collect(&errs, withField(err, name)); err != nil {
+							return err
+						}
+						continue
+					}
+				}
+			}
 		}
 		if protoLegacy {
 			if fd != nil && fd.IsWeak() && fd.Message().IsPlaceholder() {
@@ -162,21 +397,51 @@ func (d decoder) unmarshalMessage(doc interface{}, m pref.Message, skipTypeURL b
 			}
 		}
 
+		if catchAll != nil && (fd == nil || fd == catchAll) {
+			// Keys that do not match another field are captured, including
+			// the name of the catch-all field itself.
+			captured = append(captured, item)
+			continue
+		}
 		if fd == nil {
 			// Field is unknown.
 			if d.opts.DiscardUnknown {
 				continue
 			}
-			return fmt.Errorf("unknown field %q", name)
+			if err := d.collect(&errs, withField(newError(CategoryUnknownField, "unknown field %q", name), name)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		mask, ok := d.mask.field(fd)
+		if !ok {
+			continue
 		}
+		fdec := d
+		fdec.mask = mask
 
 		// Do not allow duplicate fields.
 		num := uint64(fd.Number())
 		if seenNums.Has(num) {
-			return fmt.Errorf("duplicate field %q", name)
+			if err := d.collect(&errs, withField(newError(CategoryDuplicateField, "duplicate field %q", name), name)); err != nil {
+				return err
+			}
+			continue
 		}
 		seenNums.Set(num)
 
+		if b, ok := isEncryptedValue(val); ok && isEncrypted(fd) {
+			decrypted, err := d.decrypt(b, fd)
+			if err != nil {
+				if err := d.collect(&errs, withField(err, name)); err != nil {
+					return err
+				}
+				continue
+			}
+			val = decrypted
+		}
+
 		// No need to set values for JSON null unless the field type is
 		// google.protobuf.Value or google.protobuf.NullValue.
 		_, isNullPrimitive := val.(primitive.Null)
@@ -187,80 +452,193 @@ func (d decoder) unmarshalMessage(doc interface{}, m pref.Message, skipTypeURL b
 		switch {
 		case fd.IsList():
 			list := m.Mutable(fd).List()
-			nested, ok := val.(bson.A)
-			if ok {
-				if err := d.unmarshalList(nested, list, fd); err != nil {
+			key, err := keyField(fd)
+			if err != nil {
+				if err := d.collect(&errs, withField(err, name)); err != nil {
+					return err
+				}
+				continue
+			}
+			switch nested := val.(type) {
+			case bson.A:
+				if d.opts.Merge && d.opts.ReplaceLists {
+					list.Truncate(0)
+				}
+				if err := fdec.unmarshalList(nested, list, fd); err != nil {
+					if err := d.collect(&errs, withField(err, name)); err != nil {
+						return err
+					}
+				}
+			case bson.D:
+				// Keyed lists are also accepted as arrays.
+				if key == nil {
+					if err := d.collect(&errs, withField(newValueError(CategoryTypeMismatch, fd.Kind(), val, "unexpected list value: %v", val), name)); err != nil {
+						return err
+					}
+					continue
+				}
+				if d.opts.Merge && d.opts.ReplaceLists {
+					list.Truncate(0)
+				}
+				if err := fdec.unmarshalKeyedList(nested, list, fd, key); err != nil {
+					if err := d.collect(&errs, withField(err, name)); err != nil {
+						return err
+					}
+				}
+			default:
+				if err := d.collect(&errs, withField(newValueError(CategoryTypeMismatch, fd.Kind(), val, "unexpected list value: %v", val), name)); err != nil {
 					return err
 				}
 			}
 		case fd.IsMap():
+			nested, ok := val.(bson.D)
+			if !ok {
+				if err := d.collect(&errs, withField(newValueError(CategoryTypeMismatch, pref.MessageKind, val, "unexpected map value: %v", val), name)); err != nil {
+					return err
+				}
+				continue
+			}
 			mmap := m.Mutable(fd).Map()
-			if err := d.unmarshalMap(val.(bson.D), mmap, fd); err != nil {
-				return err
+			if err := fdec.unmarshalMap(nested, mmap, fd); err != nil {
+				if err := d.collect(&errs, withField(err, name)); err != nil {
+					return err
+				}
 			}
 		default:
 			// If field is a oneof, check if it has already been set.
 			if od := fd.ContainingOneof(); od != nil {
 				idx := uint64(od.Index())
 				if seenOneofs.Has(idx) {
-					return fmt.Errorf("error parsing %q, oneof %v is already set", name, od.FullName())
+					if err := d.collect(&errs, withField(newError(CategoryOneofConflict, "error parsing %q, oneof %v is already set", name, od.FullName()), name)); err != nil {
+						return err
+					}
+					continue
 				}
 				seenOneofs.Set(idx)
 			}
 
 			// Required or optional fields.
-			if err := d.unmarshalSingular(val, m, fd); err != nil {
+			if err := fdec.unmarshalSingular(val, m, fd); err != nil {
+				if err := d.collect(&errs, withField(err, name)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, in := range inlined {
+		mask, ok := d.mask.field(in.fd)
+		if !ok {
+			continue
+		}
+		fdec := d
+		fdec.mask = mask
+		fdec.opts.UnknownFieldsKey = inlineUnknownFieldsKey(d.opts.UnknownFieldsKey, in.fd)
+		// The inlined keys were already counted as fields.
+		d.state.elements -= len(in.doc)
+		if err := fdec.unmarshalFields(in.doc, m.Mutable(in.fd).Message()); err != nil {
+			if err := d.collect(&errs, err); err != nil {
 				return err
 			}
 		}
 	}
-	return nil
+
+	if len(captured) > 0 {
+		if mask, ok := d.mask.field(catchAll); ok {
+			fdec := d
+			fdec.mask = mask
+			// The captured keys were already counted as fields.
+			d.state.elements -= len(captured)
+			if err := fdec.unmarshalCatchAll(captured, m, catchAll); err != nil {
+				if err := d.collect(&errs, err); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, disc := range discriminators {
+		if err := d.checkDiscriminator(disc, m); err != nil {
+			if err := d.collect(&errs, withField(err, disc.key)); err != nil {
+				return err
+			}
+		}
+	}
+	return errs.err()
 }
 
 func (d decoder) unmarshalMap(doc bson.D, mmap pref.Map, fd pref.FieldDescriptor) error {
 	// Determine ahead whether map entry is a scalar type or a message type in
 	// order to call the appropriate unmarshalMapValue func inside the for loop
 	// below.
-	var unmarshalMapValue func(val interface{}) (pref.Value, error)
+	var unmarshalMapValue func(d decoder, val interface{}) (pref.Value, error)
 	switch fd.MapValue().Kind() {
 	case pref.MessageKind, pref.GroupKind:
-		unmarshalMapValue = func(val interface{}) (pref.Value, error) {
+		unmarshalMapValue = func(d decoder, val interface{}) (pref.Value, error) {
 			mapVal := mmap.NewValue()
 			if err := d.unmarshalMessage(val, mapVal.Message(), false); err != nil {
+				if isPartial(err) {
+					return mapVal, err
+				}
 				return pref.Value{}, err
 			}
 			return mapVal, nil
 		}
 	default:
-		unmarshalMapValue = func(val interface{}) (pref.Value, error) {
+		unmarshalMapValue = func(d decoder, val interface{}) (pref.Value, error) {
 			return d.unmarshalScalar(val, fd.MapValue())
 		}
 	}
 
+	var errs Errors
+	seen := make(map[interface{}]bool, len(doc))
 	for _, item := range doc {
 		name := item.Key
 		val := item.Value
+		if err := d.countElement(); err != nil {
+			return withMapKey(err, name, fd.MapKey().Kind())
+		}
+		mask, ok := d.mask.entry(name)
+		if !ok {
+			continue
+		}
+		vdec := d
+		vdec.mask = mask
+
 		// Unmarshal field name.
 		pkey, err := d.unmarshalMapKey(name, fd.MapKey())
 		if err != nil {
-			return err
+			if err := d.collect(&errs, withMapKey(err, name, fd.MapKey().Kind())); err != nil {
+				return err
+			}
+			continue
 		}
 
-		// Check for duplicate field name.
-		if mmap.Has(pkey) {
-			return fmt.Errorf("duplicate map key %v", name)
+		// Check for duplicate field name. Keys set by earlier documents are
+		// overwritten when merging.
+		if seen[pkey.Interface()] {
+			if err := d.collect(&errs, withMapKey(newError(CategoryDuplicateField, "duplicate map key %v", name), name, fd.MapKey().Kind())); err != nil {
+				return err
+			}
+			continue
 		}
+		seen[pkey.Interface()] = true
 
 		// Read and unmarshal field value.
-		pval, err := unmarshalMapValue(val)
+		pval, err := unmarshalMapValue(vdec, val)
 		if err != nil {
-			return err
+			if err := d.collect(&errs, withMapKey(err, name, fd.MapKey().Kind())); err != nil {
+				return err
+			}
+			if !isPartial(err) {
+				continue
+			}
 		}
 
 		mmap.Set(pkey, pval)
 	}
 
-	return nil
+	return errs.err()
 }
 
 // unmarshalMapKey converts given token of Name kind into a protoreflect.MapKey.
@@ -304,32 +682,47 @@ func (d decoder) unmarshalMapKey(name string, fd pref.FieldDescriptor) (pref.Map
 		}
 
 	default:
-		panic(fmt.Sprintf("invalid kind for map key: %v", kind))
+		return pref.MapKey{}, newError(CategoryUnsupported, "invalid kind for map key: %v", kind)
 	}
 
-	return pref.MapKey{}, fmt.Errorf("invalid value for %v key: %q", kind, name)
+	return pref.MapKey{}, newValueError(CategoryInvalidValue, kind, name, "invalid value for %v key: %q", kind, name)
 }
 
 func (d decoder) unmarshalList(doc bson.A, list pref.List, fd pref.FieldDescriptor) error {
+	var errs Errors
 	switch fd.Kind() {
 	case pref.MessageKind, pref.GroupKind:
-		for _, item := range doc {
+		for i, item := range doc {
+			if err := d.countElement(); err != nil {
+				return withIndex(err, i)
+			}
 			val := list.NewElement()
 			if err := d.unmarshalMessage(item, val.Message(), false); err != nil {
-				return err
+				if err := d.collect(&errs, withIndex(err, i)); err != nil {
+					return err
+				}
+				if !isPartial(err) {
+					continue
+				}
 			}
 			list.Append(val)
 		}
 	default:
-		for _, item := range doc {
+		for i, item := range doc {
+			if err := d.countElement(); err != nil {
+				return withIndex(err, i)
+			}
 			val, err := d.unmarshalScalar(item, fd)
 			if err != nil {
-				return err
+				if err := d.collect(&errs, withIndex(err, i)); err != nil {
+					return err
+				}
+				continue
 			}
 			list.Append(val)
 		}
 	}
-	return nil
+	return errs.err()
 }
 
 // unmarshalSingular unmarshals to the non-repeated field specified
@@ -339,17 +732,21 @@ func (d decoder) unmarshalSingular(doc interface{}, m pref.Message, fd pref.Fiel
 	var err error
 	switch fd.Kind() {
 	case pref.MessageKind, pref.GroupKind:
-		val = m.NewField(fd)
+		if d.opts.Merge && m.Has(fd) && d.typeUnmarshaler(fd.Message().FullName()) == nil {
+			val = m.Mutable(fd)
+		} else {
+			val = m.NewField(fd)
+		}
 		err = d.unmarshalMessage(doc, val.Message(), false)
 	default:
 		val, err = d.unmarshalScalar(doc, fd)
 	}
 
-	if err != nil {
+	if err != nil && !isPartial(err) {
 		return err
 	}
 	m.Set(fd, val)
-	return nil
+	return err
 }
 
 // unmarshalScalar unmarshals to a scalar/enum protoreflect.Value specified by
@@ -358,7 +755,35 @@ func (d decoder) unmarshalScalar(doc interface{}, fd pref.FieldDescriptor) (pref
 	kind := fd.Kind()
 
 	if doc == nil {
-		return pref.Value{}, fmt.Errorf(`invalid value for %v type: %v (has type %T)`, kind, doc, doc)
+		return pref.Value{}, newValueError(CategoryTypeMismatch, kind, doc, `invalid value for %v type: %v (has type %T)`, kind, doc, doc)
+	}
+
+	switch kind {
+	case pref.StringKind:
+		format, err := fieldBinaryFormat(fd)
+		if err != nil {
+			return pref.Value{}, err
+		}
+		if format.uuid {
+			return d.unmarshalUUID(doc)
+		}
+	case pref.BytesKind:
+		if val, ok, err := d.unmarshalBytes(doc, fd); ok {
+			return val, err
+		}
+	}
+
+	orig := doc
+	var coerced bool
+	if d.opts.Strict {
+		if err := checkStrictType(doc, fd); err != nil {
+			return pref.Value{}, err
+		}
+	} else {
+		var err error
+		if doc, coerced, err = d.opts.Coerce.coerce(doc, kind); err != nil {
+			return pref.Value{}, err
+		}
 	}
 
 	vdoc := reflect.ValueOf(doc)
@@ -436,13 +861,19 @@ func (d decoder) unmarshalScalar(doc interface{}, fd pref.FieldDescriptor) (pref
 	case pref.StringKind:
 		if docType.Kind() == reflect.String {
 			if valid := utf8.Valid([]byte(vdoc.String())); !valid {
-				return pref.Value{}, fmt.Errorf("invalid UTF-8: %s", vdoc.String())
+				return pref.Value{}, newValueError(CategoryInvalidUTF8, kind, doc, "invalid UTF-8: %s", vdoc.String())
+			}
+			if err := d.countBytes(vdoc.Len()); err != nil {
+				return pref.Value{}, err
 			}
 			return pref.ValueOfString(vdoc.String()), nil
 		}
 
 	case pref.BytesKind:
 		if binary, ok := doc.(primitive.Binary); ok {
+			if err := d.countBytes(len(binary.Data)); err != nil {
+				return pref.Value{}, err
+			}
 			return pref.ValueOfBytes(binary.Data), nil
 		}
 	case pref.EnumKind:
@@ -468,14 +899,57 @@ func (d decoder) unmarshalScalar(doc interface{}, fd pref.FieldDescriptor) (pref
 		}
 
 	default:
-		panic(fmt.Sprintf("unmarshalScalar: invalid scalar kind %v", kind))
+		return pref.Value{}, newError(CategoryUnsupported, "invalid scalar kind %v", kind)
+	}
+	category := scalarErrorCategory(kind, doc)
+	if coerced {
+		category = CategoryInvalidValue
+	}
+	return pref.Value{}, newValueError(category, kind, orig, `invalid value for %v type: %s (has type %T)`, kind, quoted(orig), orig)
+}
+
+// checkStrictType returns an error unless doc has one of the BSON types the
+// encoder produces for the given field.
+func checkStrictType(doc interface{}, fd pref.FieldDescriptor) error {
+	want := scalarBSONTypes(fd)
+	got := bsonTypeOf(doc)
+	for _, t := range want {
+		if got == t {
+			return nil
+		}
+	}
+	return newValueError(CategoryTypeMismatch, fd.Kind(), doc, "strict mode requires BSON %v for %v type, got %v", want[0], fd.Kind(), got)
+}
+
+// scalarErrorCategory tells apart values of the wrong type from values of an
+// accepted type that are out of range for the given kind.
+func scalarErrorCategory(kind pref.Kind, doc interface{}) ErrorCategory {
+	docKind := reflect.ValueOf(doc).Kind()
+	isInt := reflect.Int <= docKind && docKind <= reflect.Uint64
+	isFloat := docKind == reflect.Float32 || docKind == reflect.Float64
+	switch kind {
+	case pref.Int32Kind, pref.Sint32Kind, pref.Sfixed32Kind,
+		pref.Int64Kind, pref.Sint64Kind, pref.Sfixed64Kind,
+		pref.Uint32Kind, pref.Fixed32Kind,
+		pref.Uint64Kind, pref.Fixed64Kind:
+		if isInt {
+			return CategoryInvalidValue
+		}
+	case pref.FloatKind:
+		if isFloat {
+			return CategoryInvalidValue
+		}
+	case pref.EnumKind:
+		if isInt || docKind == reflect.String {
+			return CategoryInvalidValue
+		}
 	}
-	return pref.Value{}, fmt.Errorf(`invalid value for %v type: %s (has type %T)`, kind, quoted(doc), doc)
+	return CategoryTypeMismatch
 }
 
 func quoted(i interface{}) string {
 	quoted := fmt.Sprintf(`%v`, i)
-	if reflect.TypeOf(i).Kind() == reflect.String {
+	if _, ok := i.(string); ok {
 		quoted = fmt.Sprintf(`"%s"`, quoted)
 	}
 	return quoted
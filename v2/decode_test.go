@@ -1,11 +1,13 @@
 package bsonpb
 
 import (
+	"errors"
 	"math"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"google.golang.org/protobuf/proto"
 	preg "google.golang.org/protobuf/reflect/protoregistry"
 
@@ -2415,3 +2417,670 @@ func TestUnmarshal(t *testing.T) {
 		})
 	}
 }
+
+func TestUnmarshalStrict(t *testing.T) {
+	strict := UnmarshalOptions{Strict: true}
+	tests := []struct {
+		desc         string
+		umo          UnmarshalOptions
+		inputMessage proto.Message
+		inputBson    interface{}
+		wantMessage  proto.Message
+		wantErr      string
+	}{{
+		desc:         "exact types",
+		umo:          strict,
+		inputMessage: &pb3.Scalars{},
+		inputBson: bson.D{
+			{Key: "sBool", Value: true},
+			{Key: "sInt32", Value: int32(1)},
+			{Key: "sInt64", Value: int64(2)},
+			{Key: "sUint32", Value: int64(3)},
+			{Key: "sUint64", Value: int64(4)},
+			{Key: "sFloat", Value: float32(5)},
+			{Key: "sDouble", Value: 6.0},
+			{Key: "sString", Value: "7"},
+		},
+		wantMessage: &pb3.Scalars{
+			SBool: true, SInt32: 1, SInt64: 2, SUint32: 3, SUint64: 4,
+			SFloat: 5, SDouble: 6, SString: "7",
+		},
+	}, {
+		desc:         "int64 for int32 is accepted by default",
+		inputMessage: &pb3.Scalars{},
+		inputBson:    bson.D{{Key: "sInt32", Value: int64(1)}},
+		wantMessage:  &pb3.Scalars{SInt32: 1},
+	}, {
+		desc:         "int64 for int32",
+		umo:          strict,
+		inputMessage: &pb3.Scalars{},
+		inputBson:    bson.D{{Key: "sInt32", Value: int64(1)}},
+		wantErr:      "sInt32: strict mode requires BSON 32-bit integer for int32 type, got 64-bit integer",
+	}, {
+		desc:         "int32 for int64",
+		umo:          strict,
+		inputMessage: &pb3.Scalars{},
+		inputBson:    bson.D{{Key: "sSfixed64", Value: int32(1)}},
+		wantErr:      "strict mode requires BSON 64-bit integer for sfixed64 type",
+	}, {
+		desc:         "uint for int64",
+		umo:          strict,
+		inputMessage: &pb3.Scalars{},
+		inputBson:    bson.D{{Key: "sInt64", Value: uint8(1)}},
+		wantErr:      "strict mode requires BSON 64-bit integer for int64 type",
+	}, {
+		desc:         "int for double",
+		umo:          strict,
+		inputMessage: &pb3.Repeats{},
+		inputBson:    bson.D{{Key: "rptDouble", Value: bson.A{1.5, int32(2)}}},
+		wantErr:      "rptDouble[1]: strict mode requires BSON double for double type",
+	}, {
+		desc:         "int32 enum number",
+		umo:          strict,
+		inputMessage: &pb3.Enums{},
+		inputBson:    bson.D{{Key: "sEnum", Value: int32(1)}},
+		wantMessage:  &pb3.Enums{SEnum: pb3.Enum_ONE},
+	}, {
+		desc:         "double enum number",
+		umo:          strict,
+		inputMessage: &pb3.Enums{},
+		inputBson:    bson.D{{Key: "sEnum", Value: float64(1)}},
+		wantErr:      "strict mode requires BSON string for enum type",
+	}, {
+		desc:         "strict takes precedence over coercion",
+		umo:          UnmarshalOptions{Strict: true, Coerce: CoercionPolicy{NumericStrings: true}},
+		inputMessage: &pb3.Scalars{},
+		inputBson:    bson.D{{Key: "sInt32", Value: "1"}},
+		wantErr:      "strict mode requires BSON 32-bit integer for int32 type, got string",
+	}, {
+		desc:         "timestamp as datetime",
+		umo:          strict,
+		inputMessage: &timestamppb.Timestamp{},
+		inputBson:    primitive.NewDateTimeFromTime(time.Unix(10, 0)),
+		wantMessage:  &timestamppb.Timestamp{Seconds: 10},
+	}, {
+		desc:         "timestamp as seconds",
+		umo:          strict,
+		inputMessage: &pb2.KnownTypes{},
+		inputBson:    bson.D{{Key: "optTimestamp", Value: int64(10)}},
+		wantErr:      "optTimestamp: strict mode requires BSON UTC datetime for google.protobuf.Timestamp, got 64-bit integer",
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			if err := tt.umo.Unmarshal(tt.inputBson, tt.inputMessage); err != nil {
+				if tt.wantErr == "" {
+					t.Errorf("Unmarshal() got unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Unmarshal() error got %q, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if tt.wantErr != "" {
+				t.Errorf("Unmarshal() got nil error, want error %q", tt.wantErr)
+			}
+			if tt.wantMessage != nil && !proto.Equal(tt.inputMessage, tt.wantMessage) {
+				t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", tt.inputMessage, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestUnmarshalStrictRoundTrip(t *testing.T) {
+	want := &pb2.Scalars{
+		OptBool:     proto.Bool(true),
+		OptInt32:    proto.Int32(-1),
+		OptInt64:    proto.Int64(-2),
+		OptUint32:   proto.Uint32(math.MaxUint32),
+		OptUint64:   proto.Uint64(math.MaxInt64),
+		OptSint32:   proto.Int32(3),
+		OptFixed32:  proto.Uint32(4),
+		OptSfixed64: proto.Int64(5),
+		OptFloat:    proto.Float32(1.5),
+		OptDouble:   proto.Float64(2.5),
+		OptBytes:    []byte("bytes"),
+		OptString:   proto.String("string"),
+	}
+	doc, err := Marshal(want)
+	if err != nil {
+		t.Fatalf("Marshal() got error: %v", err)
+	}
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatalf("bson.Marshal() got error: %v", err)
+	}
+	got := &pb2.Scalars{}
+	if err := (UnmarshalOptions{Strict: true}).UnmarshalBytes(b, got); err != nil {
+		t.Fatalf("UnmarshalBytes() got error: %v", err)
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("UnmarshalBytes()\n<got>\n%v\n<want>\n%v\n", got, want)
+	}
+}
+
+func TestUnmarshalStrictEnumNumbers(t *testing.T) {
+	tests := []struct {
+		desc  string
+		mo    MarshalOptions
+		input proto.Message
+	}{{
+		desc:  "enum numbers",
+		mo:    MarshalOptions{UseEnumNumbers: true},
+		input: &pb3.Enums{SEnum: pb3.Enum_TWO},
+	}, {
+		desc:  "deterministic enum numbers",
+		mo:    MarshalOptions{Deterministic: true, UseEnumNumbers: true},
+		input: &pb3.Enums{SEnum: pb3.Enum_TWO},
+	}, {
+		desc:  "unknown enum value",
+		input: &pb3.Enums{SEnum: 42},
+	}, {
+		desc:  "deterministic unknown enum value",
+		mo:    MarshalOptions{Deterministic: true},
+		input: &pb3.Enums{SEnum: 42},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			doc, err := tt.mo.Marshal(tt.input)
+			if err != nil {
+				t.Fatalf("Marshal() got error: %v", err)
+			}
+			got := tt.input.ProtoReflect().New().Interface()
+			if err := (UnmarshalOptions{Strict: true}).Unmarshal(doc, got); err != nil {
+				t.Fatalf("Unmarshal() got error: %v", err)
+			}
+			if !proto.Equal(got, tt.input) {
+				t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", got, tt.input)
+			}
+		})
+	}
+}
+
+func TestUnmarshalLimits(t *testing.T) {
+	nested := func(depth int) interface{} {
+		doc := bson.D{}
+		for i := 1; i < depth; i++ {
+			doc = bson.D{{Key: "optNested", Value: doc}}
+		}
+		return doc
+	}
+	deepStruct := func(depth int) interface{} {
+		var doc interface{} = "leaf"
+		for i := 0; i < depth; i++ {
+			doc = bson.D{{Key: "x", Value: doc}}
+		}
+		return doc
+	}
+
+	tests := []struct {
+		desc         string
+		umo          UnmarshalOptions
+		inputMessage proto.Message
+		inputBson    interface{}
+		wantErr      string
+	}{{
+		desc:         "within recursion limit",
+		umo:          UnmarshalOptions{RecursionLimit: 3},
+		inputMessage: &pb2.Nested{},
+		inputBson:    nested(3),
+	}, {
+		desc:         "recursion limit",
+		umo:          UnmarshalOptions{RecursionLimit: 3},
+		inputMessage: &pb2.Nested{},
+		inputBson:    nested(4),
+		wantErr:      "optNested.optNested.optNested: exceeded maximum recursion depth of 3",
+	}, {
+		desc:         "default recursion limit for Struct",
+		inputMessage: &structpb.Struct{},
+		inputBson:    deepStruct(defaultRecursionLimit),
+		wantErr:      "exceeded maximum recursion depth of 10000",
+	}, {
+		desc:         "recursion limit for Any",
+		umo:          UnmarshalOptions{RecursionLimit: 2},
+		inputMessage: &anypb.Any{},
+		inputBson: bson.D{
+			{Key: "@type", Value: "type.googleapis.com/google.protobuf.Any"},
+			{Key: "value", Value: bson.D{
+				{Key: "@type", Value: "type.googleapis.com/google.protobuf.Empty"},
+				{Key: "value", Value: bson.D{}},
+			}},
+		},
+		wantErr: "exceeded maximum recursion depth of 2",
+	}, {
+		desc:         "element limit",
+		umo:          UnmarshalOptions{MaxElements: 4},
+		inputMessage: &pb2.Repeats{},
+		inputBson: bson.D{
+			{Key: "rptBool", Value: bson.A{true}},
+			{Key: "rptInt32", Value: bson.A{1, 2, 3}},
+		},
+		wantErr: "rptInt32[1]: exceeded maximum of 4 elements",
+	}, {
+		desc:         "element limit for maps",
+		umo:          UnmarshalOptions{MaxElements: 2},
+		inputMessage: &pb3.Maps{},
+		inputBson: bson.D{
+			{Key: "strToNested", Value: bson.D{{Key: "a", Value: bson.D{}}, {Key: "b", Value: bson.D{}}}},
+		},
+		wantErr: `strToNested["b"]: exceeded maximum of 2 elements`,
+	}, {
+		desc:         "byte limit",
+		umo:          UnmarshalOptions{MaxBytes: 5},
+		inputMessage: &pb3.Scalars{},
+		inputBson: bson.D{
+			{Key: "sString", Value: "abc"},
+			{Key: "sBytes", Value: primitive.Binary{Data: []byte("def")}},
+		},
+		wantErr: "sBytes: exceeded maximum of 5 bytes",
+	}, {
+		desc:         "byte limit for unknown fields",
+		umo:          UnmarshalOptions{MaxBytes: 5, UnknownFieldsKey: DefaultUnknownFieldsKey},
+		inputMessage: &pb3.Scalars{},
+		inputBson: bson.D{
+			{Key: DefaultUnknownFieldsKey, Value: primitive.Binary{Data: []byte{0x92, 0x06, 0x04, 'a', 'b', 'c', 'd'}}},
+		},
+		wantErr: DefaultUnknownFieldsKey + ": exceeded maximum of 5 bytes",
+	}, {
+		desc:         "byte limit for unresolved Any",
+		umo:          UnmarshalOptions{MaxBytes: 5, AllowUnresolvedAny: true},
+		inputMessage: &anypb.Any{},
+		inputBson: bson.D{
+			{Key: "@type", Value: "example.com/example.Missing"},
+			{Key: "@value", Value: primitive.Binary{Data: []byte{0x92, 0x06, 0x04, 'a', 'b', 'c', 'd'}}},
+		},
+		wantErr: "@value: exceeded maximum of 5 bytes",
+	}, {
+		desc:         "limits abort collecting errors",
+		umo:          UnmarshalOptions{AllErrors: true, MaxElements: 2},
+		inputMessage: &pb3.Repeats{},
+		inputBson:    bson.D{{Key: "rptBool", Value: bson.A{true, "x", "y", "z"}}},
+		wantErr:      "rptBool[1]: exceeded maximum of 2 elements",
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			err := tt.umo.Unmarshal(tt.inputBson, tt.inputMessage)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Unmarshal() got unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Unmarshal() got nil error, want error %q", tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Unmarshal() error got %q, want %q", err, tt.wantErr)
+			}
+			var errs Errors
+			if errors.As(err, &errs) {
+				err = errs[0]
+			}
+			var e *Error
+			if !errors.As(err, &e) || e.Category != CategoryLimitExceeded {
+				t.Errorf("Unmarshal() got error %v, want category %v", err, CategoryLimitExceeded)
+			}
+		})
+	}
+}
+
+func TestUnmarshalBytesLimit(t *testing.T) {
+	b, err := bson.Marshal(bson.D{{Key: "sString", Value: "abcdef"}})
+	if err != nil {
+		t.Fatalf("bson.Marshal() got error: %v", err)
+	}
+	err = UnmarshalOptions{MaxBytes: len(b) - 1}.UnmarshalBytes(b, &pb3.Scalars{})
+	var e *Error
+	if !errors.As(err, &e) || e.Category != CategoryLimitExceeded {
+		t.Errorf("UnmarshalBytes() got error %v, want category %v", err, CategoryLimitExceeded)
+	}
+	if err := (UnmarshalOptions{MaxBytes: len(b)}).UnmarshalBytes(b, &pb3.Scalars{}); err != nil {
+		t.Errorf("UnmarshalBytes() got unexpected error: %v", err)
+	}
+}
+
+func TestUnmarshalMalformed(t *testing.T) {
+	tests := []struct {
+		desc         string
+		inputMessage proto.Message
+		inputBson    interface{}
+		wantMessage  proto.Message
+		wantErr      string
+	}{{
+		desc:         "map is not a document",
+		inputMessage: &pb3.Maps{},
+		inputBson:    bson.D{{Key: "int32ToStr", Value: bson.A{"a"}}},
+		wantErr:      "int32ToStr: unexpected map value: [a]",
+	}, {
+		desc:         "Any is not a document",
+		inputMessage: &pb2.KnownTypes{},
+		inputBson:    bson.D{{Key: "optAny", Value: "x"}},
+		wantErr:      "optAny: invalid google.protobuf.Any value: x",
+	}, {
+		desc:         "Struct is not a document",
+		inputMessage: &pb2.KnownTypes{},
+		inputBson:    bson.D{{Key: "optStruct", Value: int32(1)}},
+		wantErr:      "optStruct: invalid google.protobuf.Struct value: 1",
+	}, {
+		desc:         "ListValue is not an array",
+		inputMessage: &pb2.KnownTypes{},
+		inputBson:    bson.D{{Key: "optList", Value: bson.D{}}},
+		wantErr:      "optList: invalid google.protobuf.ListValue value: []",
+	}, {
+		desc:         "Value holding a binary",
+		inputMessage: &pb2.KnownTypes{},
+		inputBson:    bson.D{{Key: "optValue", Value: primitive.Binary{Data: []byte("x")}}},
+		wantErr:      "optValue: invalid google.protobuf.Struct value",
+	}, {
+		desc:         "Value holding an ObjectID",
+		inputMessage: &pb2.KnownTypes{},
+		inputBson:    bson.D{{Key: "optValue", Value: primitive.ObjectID{}}},
+		wantErr:      "optValue: invalid google.protobuf.Value",
+	}, {
+		desc:         "Value holding an unsigned integer",
+		inputMessage: &pb2.KnownTypes{},
+		inputBson:    bson.D{{Key: "optValue", Value: uint64(7)}},
+		wantMessage:  &pb2.KnownTypes{OptValue: structpb.NewNumberValue(7)},
+	}, {
+		desc:         "Value holding nil",
+		inputMessage: &pb2.KnownTypes{},
+		inputBson:    bson.D{{Key: "optValue", Value: nil}},
+		wantMessage:  &pb2.KnownTypes{OptValue: structpb.NewNullValue()},
+	}, {
+		desc:         "Timestamp holding nil",
+		inputMessage: &pb2.KnownTypes{},
+		inputBson:    bson.D{{Key: "optTimestamp", Value: nil}},
+		wantMessage:  &pb2.KnownTypes{},
+	}, {
+		desc:         "Timestamp out of range",
+		inputMessage: &pb2.KnownTypes{},
+		inputBson:    bson.D{{Key: "optTimestamp", Value: primitive.DateTime(math.MaxInt64)}},
+		wantErr:      "optTimestamp: google.protobuf.Timestamp: seconds out of range",
+	}, {
+		desc:         "Duration holding nil seconds",
+		inputMessage: &pb2.KnownTypes{},
+		inputBson:    bson.D{{Key: "optDuration", Value: bson.D{{Key: "Seconds", Value: nil}}}},
+		wantErr:      "optDuration.Seconds: invalid google.protobuf.Duration seconds",
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			if err := Unmarshal(tt.inputBson, tt.inputMessage); err != nil {
+				if tt.wantErr == "" {
+					t.Errorf("Unmarshal() got unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Unmarshal() error got %q, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if tt.wantErr != "" {
+				t.Errorf("Unmarshal() got nil error, want error %q", tt.wantErr)
+			}
+			if tt.wantMessage != nil && !proto.Equal(tt.inputMessage, tt.wantMessage) {
+				t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", tt.inputMessage, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestUnmarshalMerge(t *testing.T) {
+	tests := []struct {
+		desc        string
+		umo         UnmarshalOptions
+		base        proto.Message
+		inputBson   []interface{}
+		wantMessage proto.Message
+		wantErr     string
+	}{{
+		desc: "without merge the message is reset",
+		base: &pb2.Scalars{OptBool: proto.Bool(true)},
+		inputBson: []interface{}{
+			bson.D{{Key: "optString", Value: "override"}},
+		},
+		wantMessage: &pb2.Scalars{OptString: proto.String("override")},
+	}, {
+		desc: "singular fields are overwritten",
+		umo:  UnmarshalOptions{Merge: true},
+		base: &pb2.Scalars{OptBool: proto.Bool(true), OptString: proto.String("default")},
+		inputBson: []interface{}{
+			bson.D{{Key: "optString", Value: "tenant"}, {Key: "optInt32", Value: int32(1)}},
+			bson.D{{Key: "optInt32", Value: int32(2)}, {Key: "optBool", Value: nil}},
+		},
+		wantMessage: &pb2.Scalars{OptBool: proto.Bool(true), OptString: proto.String("tenant"), OptInt32: proto.Int32(2)},
+	}, {
+		desc: "nested messages are merged",
+		umo:  UnmarshalOptions{Merge: true},
+		base: &pb2.Nests{OptNested: &pb2.Nested{OptString: proto.String("default")}},
+		inputBson: []interface{}{
+			bson.D{{Key: "optNested", Value: bson.D{{Key: "optNested", Value: bson.D{{Key: "optString", Value: "deep"}}}}}},
+		},
+		wantMessage: &pb2.Nests{OptNested: &pb2.Nested{
+			OptString: proto.String("default"),
+			OptNested: &pb2.Nested{OptString: proto.String("deep")},
+		}},
+	}, {
+		desc: "lists are appended",
+		umo:  UnmarshalOptions{Merge: true},
+		base: &pb2.Repeats{RptString: []string{"a"}, RptInt32: []int32{1}},
+		inputBson: []interface{}{
+			bson.D{{Key: "rptString", Value: bson.A{"b"}}},
+			bson.D{{Key: "rptString", Value: bson.A{"c"}}},
+		},
+		wantMessage: &pb2.Repeats{RptString: []string{"a", "b", "c"}, RptInt32: []int32{1}},
+	}, {
+		desc: "lists are replaced",
+		umo:  UnmarshalOptions{Merge: true, ReplaceLists: true},
+		base: &pb2.Repeats{RptString: []string{"a"}, RptInt32: []int32{1}},
+		inputBson: []interface{}{
+			bson.D{{Key: "rptString", Value: bson.A{"b", "c"}}},
+		},
+		wantMessage: &pb2.Repeats{RptString: []string{"b", "c"}, RptInt32: []int32{1}},
+	}, {
+		desc: "maps are merged by key",
+		umo:  UnmarshalOptions{Merge: true},
+		base: &pb3.Maps{Int32ToStr: map[int32]string{1: "one", 2: "two"}},
+		inputBson: []interface{}{
+			bson.D{{Key: "int32ToStr", Value: bson.D{{Key: "2", Value: "zwei"}, {Key: "3", Value: "drei"}}}},
+		},
+		wantMessage: &pb3.Maps{Int32ToStr: map[int32]string{1: "one", 2: "zwei", 3: "drei"}},
+	}, {
+		desc: "duplicate map keys within a document",
+		umo:  UnmarshalOptions{Merge: true},
+		base: &pb3.Maps{Int32ToStr: map[int32]string{1: "one"}},
+		inputBson: []interface{}{
+			bson.D{{Key: "int32ToStr", Value: bson.D{{Key: "2", Value: "a"}, {Key: "2", Value: "b"}}}},
+		},
+		wantErr: "int32ToStr[2]: duplicate map key 2",
+	}, {
+		desc: "duplicate fields within a document",
+		umo:  UnmarshalOptions{Merge: true},
+		base: &pb3.Scalars{SString: "default"},
+		inputBson: []interface{}{
+			bson.D{{Key: "sString", Value: "a"}, {Key: "s_string", Value: "b"}},
+		},
+		wantErr: `duplicate field "s_string"`,
+	}, {
+		desc: "oneof is switched by a later document",
+		umo:  UnmarshalOptions{Merge: true},
+		base: &pb3.Oneofs{Union: &pb3.Oneofs_OneofString{OneofString: "default"}},
+		inputBson: []interface{}{
+			bson.D{{Key: "oneofEnum", Value: "TEN"}},
+		},
+		wantMessage: &pb3.Oneofs{Union: &pb3.Oneofs_OneofEnum{OneofEnum: pb3.Enum_TEN}},
+	}, {
+		desc: "oneof conflict within a document",
+		umo:  UnmarshalOptions{Merge: true},
+		base: &pb3.Oneofs{},
+		inputBson: []interface{}{
+			bson.D{{Key: "oneofEnum", Value: "TEN"}, {Key: "oneofString", Value: "x"}},
+		},
+		wantErr: "oneof textpb3_proto.Oneofs.union is already set",
+	}, {
+		desc: "well-known types are replaced",
+		umo:  UnmarshalOptions{Merge: true},
+		base: &pb2.KnownTypes{OptStruct: &structpb.Struct{Fields: map[string]*structpb.Value{
+			"a": structpb.NewBoolValue(true),
+		}}},
+		inputBson: []interface{}{
+			bson.D{{Key: "optStruct", Value: bson.D{{Key: "b", Value: false}}}},
+		},
+		wantMessage: &pb2.KnownTypes{OptStruct: &structpb.Struct{Fields: map[string]*structpb.Value{
+			"b": structpb.NewBoolValue(false),
+		}}},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			m := tt.base
+			for _, doc := range tt.inputBson {
+				if err := tt.umo.Unmarshal(doc, m); err != nil {
+					if tt.wantErr == "" {
+						t.Errorf("Unmarshal() got unexpected error: %v", err)
+					} else if !strings.Contains(err.Error(), tt.wantErr) {
+						t.Errorf("Unmarshal() error got %q, want %q", err, tt.wantErr)
+					}
+					return
+				}
+			}
+			if tt.wantErr != "" {
+				t.Errorf("Unmarshal() got nil error, want error %q", tt.wantErr)
+			}
+			if !proto.Equal(m, tt.wantMessage) {
+				t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", m, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestUnresolvedAny(t *testing.T) {
+	nested, err := anypb.New(&pb2.Nested{OptString: proto.String("x")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := &anypb.Any{TypeUrl: "example.com/example.Missing", Value: []byte{0x0a, 0x01, 0xff}}
+	empty := new(preg.Types)
+
+	tests := []struct {
+		desc     string
+		input    *pb2.KnownTypes
+		resolver Resolver
+		want     bson.D
+	}{{
+		desc:     "unresolvable type",
+		input:    &pb2.KnownTypes{OptAny: nested},
+		resolver: empty,
+		want: bson.D{{Key: "optAny", Value: bson.D{
+			{Key: "@type", Value: "type.googleapis.com/textpb2_proto.Nested"},
+			{Key: "@value", Value: primitive.Binary{Data: nested.Value}},
+		}}},
+	}, {
+		desc:  "unknown type",
+		input: &pb2.KnownTypes{OptAny: unknown},
+		want: bson.D{{Key: "optAny", Value: bson.D{
+			{Key: "@type", Value: "example.com/example.Missing"},
+			{Key: "@value", Value: primitive.Binary{Data: []byte{0x0a, 0x01, 0xff}}},
+		}}},
+	}, {
+		desc:  "resolvable type",
+		input: &pb2.KnownTypes{OptAny: nested},
+		want: bson.D{{Key: "optAny", Value: bson.D{
+			{Key: "@type", Value: "type.googleapis.com/textpb2_proto.Nested"},
+			{Key: "optString", Value: "x"},
+		}}},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := MarshalOptions{AllowUnresolvedAny: true, Resolver: tt.resolver}.Marshal(tt.input)
+			if err != nil {
+				t.Fatalf("Marshal() got error: %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Marshal() diff -want +got\n%v\n", diff)
+			}
+
+			decoded := &pb2.KnownTypes{}
+			if err := (UnmarshalOptions{AllowUnresolvedAny: true, Resolver: tt.resolver}).Unmarshal(got, decoded); err != nil {
+				t.Fatalf("Unmarshal() got error: %v", err)
+			}
+			if !proto.Equal(decoded, tt.input) {
+				t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", decoded, tt.input)
+			}
+		})
+	}
+
+	// Once the type resolves, the payload is expanded on the next write.
+	doc := tests[0].want
+	decoded := &pb2.KnownTypes{}
+	if err := (UnmarshalOptions{AllowUnresolvedAny: true}).Unmarshal(doc, decoded); err != nil {
+		t.Fatalf("Unmarshal() got error: %v", err)
+	}
+	got, err := Marshal(decoded)
+	if err != nil {
+		t.Fatalf("Marshal() got error: %v", err)
+	}
+	if diff := cmp.Diff(tests[2].want, got); diff != "" {
+		t.Errorf("Marshal() diff -want +got\n%v\n", diff)
+	}
+
+	if _, err := (MarshalOptions{Resolver: empty}).Marshal(tests[0].input); err == nil || !strings.Contains(err.Error(), "unable to resolve") {
+		t.Errorf("Marshal() got error %v, want unable to resolve", err)
+	}
+}
+
+func TestUnresolvedAnyErrors(t *testing.T) {
+	tests := []struct {
+		desc      string
+		umo       UnmarshalOptions
+		inputBson bson.D
+		wantErr   string
+	}{{
+		desc: "not allowed",
+		inputBson: bson.D{
+			{Key: "@type", Value: "type.googleapis.com/textpb2_proto.Nested"},
+			{Key: "@value", Value: primitive.Binary{}},
+		},
+		wantErr: `optAny.@value: unknown field "@value"`,
+	}, {
+		desc: "missing type",
+		umo:  UnmarshalOptions{AllowUnresolvedAny: true},
+		inputBson: bson.D{
+			{Key: "@value", Value: primitive.Binary{}},
+		},
+		wantErr: "missing @type field",
+	}, {
+		desc: "invalid value",
+		umo:  UnmarshalOptions{AllowUnresolvedAny: true},
+		inputBson: bson.D{
+			{Key: "@type", Value: "example.com/example.Missing"},
+			{Key: "@value", Value: "x"},
+		},
+		wantErr: "optAny.@value: invalid @value value: x",
+	}, {
+		desc: "other fields",
+		umo:  UnmarshalOptions{AllowUnresolvedAny: true},
+		inputBson: bson.D{
+			{Key: "@type", Value: "example.com/example.Missing"},
+			{Key: "@value", Value: primitive.Binary{}},
+			{Key: "optString", Value: "x"},
+		},
+		wantErr: `optAny.optString: unknown field "optString" next to @value`,
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			err := tt.umo.Unmarshal(bson.D{{Key: "optAny", Value: tt.inputBson}}, &pb2.KnownTypes{})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Unmarshal() got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
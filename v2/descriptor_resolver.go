@@ -0,0 +1,234 @@
+package bsonpb
+
+import (
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Keys of the documents of a DescriptorStore.
+const (
+	descriptorNameKey = "_id"
+	descriptorFileKey = "file"
+)
+
+// DescriptorStore returns documents holding serialized
+// google.protobuf.FileDescriptorProto messages, e.g. the documents of a
+// collection. See DescriptorDocument for their format.
+type DescriptorStore interface {
+	Documents() ([]bson.D, error)
+}
+
+// DescriptorDocument returns the document of the file fd in a
+// DescriptorStore: {"_id": <file name>, "file": <serialized fd>}.
+func DescriptorDocument(fd *descriptorpb.FileDescriptorProto) (bson.D, error) {
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(fd)
+	if err != nil {
+		return nil, err
+	}
+	return bson.D{
+		{Key: descriptorNameKey, Value: fd.GetName()},
+		{Key: descriptorFileKey, Value: primitive.Binary{Data: b}},
+	}, nil
+}
+
+// parseDescriptorDocument returns the file stored in the document doc.
+func parseDescriptorDocument(doc bson.D) (*descriptorpb.FileDescriptorProto, error) {
+	var data []byte
+	for _, elem := range doc {
+		if elem.Key != descriptorFileKey {
+			continue
+		}
+		switch v := elem.Value.(type) {
+		case primitive.Binary:
+			data = v.Data
+		case []byte:
+			data = v
+		default:
+			return nil, withField(newValueError(CategoryTypeMismatch, pref.BytesKind, elem.Value, "invalid descriptor %v", elem.Value), elem.Key)
+		}
+	}
+	if data == nil {
+		return nil, newError(CategoryMissingRequired, "missing %q field", descriptorFileKey)
+	}
+	fd := &descriptorpb.FileDescriptorProto{}
+	if err := proto.Unmarshal(data, fd); err != nil {
+		return nil, withField(newError(CategoryInvalidValue, "invalid descriptor: %v", err), descriptorFileKey)
+	}
+	return fd, nil
+}
+
+// MemoryDescriptorStore is a DescriptorStore kept in memory, e.g. in place
+// of a collection in tests. It is safe for concurrent use.
+type MemoryDescriptorStore struct {
+	mu   sync.Mutex
+	docs []bson.D
+}
+
+// NewMemoryDescriptorStore returns an empty MemoryDescriptorStore.
+func NewMemoryDescriptorStore() *MemoryDescriptorStore {
+	return &MemoryDescriptorStore{}
+}
+
+// Add stores the given files, replacing stored files of the same name.
+func (s *MemoryDescriptorStore) Add(fds ...*descriptorpb.FileDescriptorProto) error {
+	docs := make([]bson.D, len(fds))
+	for i, fd := range fds {
+		doc, err := DescriptorDocument(fd)
+		if err != nil {
+			return err
+		}
+		docs[i] = doc
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, fd := range fds {
+		replaced := false
+		for j, doc := range s.docs {
+			if doc[0].Value == fd.GetName() {
+				s.docs[j], replaced = docs[i], true
+				break
+			}
+		}
+		if !replaced {
+			s.docs = append(s.docs, docs[i])
+		}
+	}
+	return nil
+}
+
+// Documents returns the stored documents.
+func (s *MemoryDescriptorStore) Documents() ([]bson.D, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]bson.D(nil), s.docs...), nil
+}
+
+// DescriptorResolver is a Resolver of dynamicpb types loaded from descriptor
+// set files or a DescriptorStore, for types that are not linked into the
+// binary. All dependencies, including well-known types, must be loaded as
+// well. It is safe for concurrent use, also while reloading.
+type DescriptorResolver struct {
+	load   func() (*descriptorpb.FileDescriptorSet, error)
+	reload sync.Mutex
+
+	mu    sync.RWMutex
+	files *protoregistry.Files
+	types *protoregistry.Types
+}
+
+// NewFileResolver returns a DescriptorResolver loading the descriptor set
+// files at the given paths. Files contained in several sets are taken from
+// the first one.
+func NewFileResolver(paths ...string) (*DescriptorResolver, error) {
+	return newDescriptorResolver(func() (*descriptorpb.FileDescriptorSet, error) {
+		merged := &descriptorpb.FileDescriptorSet{}
+		for _, path := range paths {
+			set, err := readDescriptorSet(path)
+			if err != nil {
+				return nil, err
+			}
+			merged.File = append(merged.File, set.File...)
+		}
+		return merged, nil
+	})
+}
+
+// NewStoreResolver returns a DescriptorResolver loading the files of store.
+func NewStoreResolver(store DescriptorStore) (*DescriptorResolver, error) {
+	return newDescriptorResolver(func() (*descriptorpb.FileDescriptorSet, error) {
+		docs, err := store.Documents()
+		if err != nil {
+			return nil, err
+		}
+		set := &descriptorpb.FileDescriptorSet{}
+		for _, doc := range docs {
+			fd, err := parseDescriptorDocument(doc)
+			if err != nil {
+				return nil, err
+			}
+			set.File = append(set.File, fd)
+		}
+		return set, nil
+	})
+}
+
+func newDescriptorResolver(load func() (*descriptorpb.FileDescriptorSet, error)) (*DescriptorResolver, error) {
+	r := &DescriptorResolver{load: load}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the descriptors again, e.g. after new schemas were added. If
+// loading fails, the previously loaded types are kept.
+func (r *DescriptorResolver) Reload() error {
+	r.reload.Lock()
+	defer r.reload.Unlock()
+	set, err := r.load()
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(set.File))
+	unique := set.File[:0]
+	for _, fd := range set.File {
+		if !seen[fd.GetName()] {
+			seen[fd.GetName()] = true
+			unique = append(unique, fd)
+		}
+	}
+	set.File = unique
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return newError(CategoryInvalidValue, "invalid descriptors: %v", err)
+	}
+	types, err := NewDynamicTypes(files)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.files, r.types = files, types
+	r.mu.Unlock()
+	return nil
+}
+
+// Files returns the currently loaded files.
+func (r *DescriptorResolver) Files() *protoregistry.Files {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.files
+}
+
+func (r *DescriptorResolver) current() *protoregistry.Types {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.types
+}
+
+// FindMessageByName looks up a message by its full name.
+func (r *DescriptorResolver) FindMessageByName(name pref.FullName) (pref.MessageType, error) {
+	return r.current().FindMessageByName(name)
+}
+
+// FindMessageByURL looks up a message by a URL identifier.
+func (r *DescriptorResolver) FindMessageByURL(url string) (pref.MessageType, error) {
+	return r.current().FindMessageByURL(url)
+}
+
+// FindExtensionByName looks up an extension field by its full name.
+func (r *DescriptorResolver) FindExtensionByName(name pref.FullName) (pref.ExtensionType, error) {
+	return r.current().FindExtensionByName(name)
+}
+
+// FindExtensionByNumber looks up an extension field by the full name of the
+// extended message and its field number.
+func (r *DescriptorResolver) FindExtensionByNumber(message pref.FullName, field pref.FieldNumber) (pref.ExtensionType, error) {
+	return r.current().FindExtensionByNumber(message, field)
+}
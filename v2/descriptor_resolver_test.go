@@ -0,0 +1,188 @@
+package bsonpb
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	pb2 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb2_proto"
+	pb3 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb3_proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// anyDocument returns the document of a KnownTypes message holding m in an
+// Any field.
+func anyDocument(t *testing.T, m proto.Message) (bson.D, *pb2.KnownTypes) {
+	anyMsg, err := anypb.New(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &pb2.KnownTypes{OptAny: anyMsg}
+	doc, err := Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc, want
+}
+
+func TestFileResolver(t *testing.T) {
+	path, cleanup := writeDescriptorSet(t, &pb2.KnownTypes{})
+	defer cleanup()
+	r, err := NewFileResolver(path)
+	if err != nil {
+		t.Fatalf("NewFileResolver() got error: %v", err)
+	}
+	umo := UnmarshalOptions{Resolver: r}
+
+	doc, want := anyDocument(t, &pb2.Nested{OptString: proto.String("x")})
+	got := &pb2.KnownTypes{}
+	if err := umo.Unmarshal(doc, got); err != nil {
+		t.Fatalf("Unmarshal() got error: %v", err)
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", got, want)
+	}
+
+	doc, want = anyDocument(t, &pb3.Scalars{SString: "y"})
+	if err := umo.Unmarshal(doc, &pb2.KnownTypes{}); err == nil || !strings.Contains(err.Error(), "unable to resolve") {
+		t.Fatalf("Unmarshal() got error %v, want unable to resolve", err)
+	}
+
+	// Add the schema of the embedded type and reload.
+	set := descriptorSet(&pb2.KnownTypes{})
+	set.File = append(set.File, descriptorSet(&pb3.Scalars{}).File...)
+	b, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload() got error: %v", err)
+	}
+	got = &pb2.KnownTypes{}
+	if err := umo.Unmarshal(doc, got); err != nil {
+		t.Fatalf("Unmarshal() got error: %v", err)
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", got, want)
+	}
+
+	if _, err := NewFileResolver(path + ".missing"); err == nil {
+		t.Error("NewFileResolver() got nil error for a missing file")
+	}
+}
+
+func TestStoreResolver(t *testing.T) {
+	store := NewMemoryDescriptorStore()
+	if err := store.Add(descriptorSet(&pb2.KnownTypes{}).File...); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewStoreResolver(store)
+	if err != nil {
+		t.Fatalf("NewStoreResolver() got error: %v", err)
+	}
+	umo := UnmarshalOptions{Resolver: r}
+
+	doc, want := anyDocument(t, &pb3.Scalars{SString: "y"})
+	if err := umo.Unmarshal(doc, &pb2.KnownTypes{}); err == nil || !strings.Contains(err.Error(), "unable to resolve") {
+		t.Fatalf("Unmarshal() got error %v, want unable to resolve", err)
+	}
+
+	// New schemas are only used after a reload.
+	if err := store.Add(descriptorSet(&pb3.Scalars{}).File...); err != nil {
+		t.Fatal(err)
+	}
+	if err := umo.Unmarshal(doc, &pb2.KnownTypes{}); err == nil {
+		t.Fatal("Unmarshal() got nil error before reload")
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload() got error: %v", err)
+	}
+	got := &pb2.KnownTypes{}
+	if err := umo.Unmarshal(doc, got); err != nil {
+		t.Fatalf("Unmarshal() got error: %v", err)
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", got, want)
+	}
+	if _, err := r.Files().FindFileByPath("v2/options/options.proto"); err != nil {
+		t.Errorf("Files() got error: %v", err)
+	}
+
+	m, err := umo.UnmarshalDynamic(bson.D{{Key: "sString", Value: "z"}}, "textpb3_proto.Scalars")
+	if err != nil {
+		t.Fatalf("UnmarshalDynamic() got error: %v", err)
+	}
+	if got := m.Get(m.Descriptor().Fields().ByName("s_string")).String(); got != "z" {
+		t.Errorf("UnmarshalDynamic() got sString %q, want %q", got, "z")
+	}
+}
+
+func TestStoreResolverErrors(t *testing.T) {
+	set := descriptorSet(&pb2.KnownTypes{})
+	valid := NewMemoryDescriptorStore()
+	if err := valid.Add(set.File...); err != nil {
+		t.Fatal(err)
+	}
+	validDocs, err := valid.Documents()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc    string
+		docs    []bson.D
+		wantErr string
+	}{{
+		desc:    "missing descriptor",
+		docs:    []bson.D{{{Key: "_id", Value: "a.proto"}}},
+		wantErr: `missing "file" field`,
+	}, {
+		desc:    "invalid descriptor type",
+		docs:    []bson.D{{{Key: "file", Value: "a.proto"}}},
+		wantErr: "file: invalid descriptor a.proto",
+	}, {
+		desc:    "invalid descriptor",
+		docs:    []bson.D{{{Key: "file", Value: []byte("invalid")}}},
+		wantErr: "file: invalid descriptor:",
+	}, {
+		desc:    "missing dependency",
+		docs:    validDocs[len(validDocs)-1:],
+		wantErr: "invalid descriptors",
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			_, err := NewStoreResolver(testDescriptorStore(tt.docs))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("NewStoreResolver() got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// A failed reload keeps the loaded types.
+	store := testDescriptorStore(validDocs)
+	r, err := NewStoreResolver(&store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = store[len(store)-1:]
+	if err := r.Reload(); err == nil || !strings.Contains(err.Error(), "invalid descriptors") {
+		t.Errorf("Reload() got error %v, want invalid descriptors", err)
+	}
+	if _, err := r.FindMessageByName("textpb2_proto.KnownTypes"); err != nil {
+		t.Errorf("FindMessageByName() got error: %v", err)
+	}
+}
+
+type testDescriptorStore []bson.D
+
+func (s testDescriptorStore) Documents() ([]bson.D, error) {
+	return s, nil
+}
@@ -0,0 +1,35 @@
+package bsonpb
+
+import (
+	"crypto/sha256"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Digest returns the SHA-256 hash of the deterministic BSON encoding of m
+// with fields ordered by number. See MarshalOptions.Digest.
+func Digest(m proto.Message) ([]byte, error) {
+	return MarshalOptions{}.Digest(m)
+}
+
+// Digest returns the SHA-256 hash of the BSON encoding of m. Deterministic is
+// always set, so equal messages have equal digests across versions of this
+// package as long as the options stay the same.
+func (o MarshalOptions) Digest(m proto.Message) ([]byte, error) {
+	o.Deterministic = true
+	result, err := o.marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := result.(bson.D)
+	if !ok {
+		return nil, newError(CategoryUnsupported, "%v is not encoded as a document", m.ProtoReflect().Descriptor().FullName())
+	}
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
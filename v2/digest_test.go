@@ -0,0 +1,177 @@
+package bsonpb
+
+import (
+	"encoding/hex"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	pb2 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb2_proto"
+	pb3 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb3_proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMarshalDeterministic(t *testing.T) {
+	extensions := func() proto.Message {
+		m := &pb2.Extensions{
+			OptString: proto.String("string"),
+			OptBool:   proto.Bool(true),
+			OptInt32:  proto.Int32(42),
+		}
+		proto.SetExtension(m, pb2.E_OptExtString, "extension")
+		proto.SetExtension(m, pb2.E_OptExtBool, true)
+		return m
+	}
+
+	tests := []struct {
+		desc    string
+		mo      MarshalOptions
+		input   proto.Message
+		want    bson.D
+		wantErr string
+	}{{
+		desc: "fixed numeric types",
+		mo:   MarshalOptions{Deterministic: true},
+		input: &pb3.Scalars{
+			SInt32:    1,
+			SInt64:    2,
+			SUint32:   3,
+			SUint64:   4,
+			SSint32:   5,
+			SFixed32:  6,
+			SSfixed64: 7,
+			SFloat:    1.5,
+			SDouble:   2.5,
+		},
+		want: bson.D{
+			{Key: "sInt32", Value: int32(1)},
+			{Key: "sInt64", Value: int64(2)},
+			{Key: "sUint32", Value: int64(3)},
+			{Key: "sUint64", Value: int64(4)},
+			{Key: "sSint32", Value: int32(5)},
+			{Key: "sFixed32", Value: int64(6)},
+			{Key: "sSfixed64", Value: int64(7)},
+			{Key: "sFloat", Value: float64(1.5)},
+			{Key: "sDouble", Value: float64(2.5)},
+		},
+	}, {
+		desc:    "uint64 out of range",
+		mo:      MarshalOptions{Deterministic: true},
+		input:   &pb3.Scalars{SUint64: math.MaxUint64},
+		wantErr: "sUint64: 18446744073709551615 does not fit into a BSON int64",
+	}, {
+		desc:  "enum numbers",
+		mo:    MarshalOptions{Deterministic: true, UseEnumNumbers: true},
+		input: &pb3.Enums{SEnum: pb3.Enum_TWO},
+		want:  bson.D{{Key: "sEnum", Value: int32(2)}},
+	}, {
+		desc:  "fields by number",
+		mo:    MarshalOptions{Deterministic: true},
+		input: extensions(),
+		want: bson.D{
+			{Key: "optString", Value: "string"},
+			{Key: "optInt32", Value: int32(42)},
+			{Key: "[textpb2_proto.opt_ext_bool]", Value: true},
+			{Key: "[textpb2_proto.opt_ext_string]", Value: "extension"},
+			{Key: "optBool", Value: true},
+		},
+	}, {
+		desc:  "fields by name",
+		mo:    MarshalOptions{Deterministic: true, FieldOrder: OrderByName},
+		input: extensions(),
+		want: bson.D{
+			{Key: "[textpb2_proto.opt_ext_bool]", Value: true},
+			{Key: "[textpb2_proto.opt_ext_string]", Value: "extension"},
+			{Key: "optBool", Value: true},
+			{Key: "optInt32", Value: int32(42)},
+			{Key: "optString", Value: "string"},
+		},
+	}, {
+		desc: "map entries and nested messages",
+		mo:   MarshalOptions{Deterministic: true, FieldOrder: OrderByName, UseProtoNames: true},
+		input: &pb3.Maps{
+			Int32ToStr: map[int32]string{10: "ten", -1: "minus one", 2: "two"},
+			StrToNested: map[string]*pb3.Nested{
+				"b": {SString: "x", SNested: &pb3.Nested{}},
+				"a": {},
+			},
+		},
+		want: bson.D{
+			{Key: "int32_to_str", Value: bson.D{
+				{Key: "-1", Value: "minus one"},
+				{Key: "2", Value: "two"},
+				{Key: "10", Value: "ten"},
+			}},
+			{Key: "str_to_nested", Value: bson.D{
+				{Key: "a", Value: bson.D{}},
+				{Key: "b", Value: bson.D{
+					{Key: "s_nested", Value: bson.D{}},
+					{Key: "s_string", Value: "x"},
+				}},
+			}},
+		},
+	}, {
+		desc:  "bytes",
+		mo:    MarshalOptions{Deterministic: true},
+		input: &pb3.Scalars{SBytes: []byte("b")},
+		want:  bson.D{{Key: "sBytes", Value: primitive.Binary{Data: []byte("b")}}},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := tt.mo.Marshal(tt.input)
+			if err != nil {
+				if tt.wantErr == "" {
+					t.Errorf("Marshal() got unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Marshal() error got %q, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if tt.wantErr != "" {
+				t.Errorf("Marshal() got nil error, want error %q", tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Marshal() diff -want +got\n%v\n", diff)
+			}
+		})
+	}
+}
+
+func TestDigest(t *testing.T) {
+	input := &pb2.Extensions{
+		OptString: proto.String("string"),
+		OptBool:   proto.Bool(true),
+		OptInt32:  proto.Int32(42),
+	}
+	got, err := Digest(input)
+	if err != nil {
+		t.Fatalf("Digest() got error: %v", err)
+	}
+	// The digest must never change, it is persisted by users.
+	const want = "d39597a529294ebd80670e26811e864e43709968489b8fdfaaf5291ca4ca3b22"
+	if hex.EncodeToString(got) != want {
+		t.Errorf("Digest() got %x, want %s", got, want)
+	}
+
+	other, err := Digest(proto.Clone(input))
+	if err != nil {
+		t.Fatalf("Digest() got error: %v", err)
+	}
+	if !cmp.Equal(got, other) {
+		t.Errorf("Digest() of equal messages got %x and %x", got, other)
+	}
+
+	byName, err := MarshalOptions{FieldOrder: OrderByName}.Digest(input)
+	if err != nil {
+		t.Fatalf("Digest() got error: %v", err)
+	}
+	if cmp.Equal(got, byName) {
+		t.Errorf("Digest() ordered by name got the same digest as ordered by number")
+	}
+}
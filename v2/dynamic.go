@@ -0,0 +1,102 @@
+package bsonpb
+
+import (
+	"io/ioutil"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// LoadDescriptorSet reads a serialized google.protobuf.FileDescriptorSet, as
+// written by protoc with --descriptor_set_out and --include_imports.
+func LoadDescriptorSet(path string) (*protoregistry.Files, error) {
+	set, err := readDescriptorSet(path)
+	if err != nil {
+		return nil, err
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, newError(CategoryInvalidValue, "invalid descriptor set %s: %v", path, err)
+	}
+	return files, nil
+}
+
+// readDescriptorSet reads a serialized google.protobuf.FileDescriptorSet.
+func readDescriptorSet(path string) (*descriptorpb.FileDescriptorSet, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(b, set); err != nil {
+		return nil, newError(CategoryInvalidValue, "invalid descriptor set %s: %v", path, err)
+	}
+	return set, nil
+}
+
+// NewDynamicTypes returns a Resolver of dynamicpb types for all messages,
+// enums and extensions declared in files. Using it as the Resolver of
+// MarshalOptions or UnmarshalOptions resolves extensions and the contents of
+// google.protobuf.Any from files instead of protoregistry.GlobalTypes.
+func NewDynamicTypes(files *protoregistry.Files) (*protoregistry.Types, error) {
+	types := new(protoregistry.Types)
+	var err error
+	files.RangeFiles(func(fd pref.FileDescriptor) bool {
+		err = registerDynamicTypes(types, fd.Messages(), fd.Enums(), fd.Extensions())
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return types, nil
+}
+
+// registerDynamicTypes registers the given declarations and those nested in
+// the messages.
+func registerDynamicTypes(types *protoregistry.Types, mds pref.MessageDescriptors, eds pref.EnumDescriptors, xds pref.ExtensionDescriptors) error {
+	for i := 0; i < eds.Len(); i++ {
+		if err := types.RegisterEnum(dynamicpb.NewEnumType(eds.Get(i))); err != nil {
+			return newError(CategoryInvalidValue, "unable to register %v: %v", eds.Get(i).FullName(), err)
+		}
+	}
+	for i := 0; i < xds.Len(); i++ {
+		if err := types.RegisterExtension(dynamicpb.NewExtensionType(xds.Get(i))); err != nil {
+			return newError(CategoryInvalidValue, "unable to register %v: %v", xds.Get(i).FullName(), err)
+		}
+	}
+	for i := 0; i < mds.Len(); i++ {
+		md := mds.Get(i)
+		if md.IsMapEntry() {
+			continue
+		}
+		if err := types.RegisterMessage(dynamicpb.NewMessageType(md)); err != nil {
+			return newError(CategoryInvalidValue, "unable to register %v: %v", md.FullName(), err)
+		}
+		if err := registerDynamicTypes(types, md.Messages(), md.Enums(), md.Extensions()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnmarshalDynamic decodes doc into a new dynamicpb message of the type with
+// the given full name, which is looked up with Resolver. Together with
+// NewDynamicTypes, this reads documents given only their schema.
+func (o UnmarshalOptions) UnmarshalDynamic(doc interface{}, name pref.FullName) (*dynamicpb.Message, error) {
+	if o.Resolver == nil {
+		o.Resolver = protoregistry.GlobalTypes
+	}
+	mt, err := o.Resolver.FindMessageByName(name)
+	if err != nil {
+		return nil, newError(CategoryUnresolvable, "unable to resolve %q: %v", name, err)
+	}
+	m := dynamicpb.NewMessage(mt.Descriptor())
+	if err := o.unmarshal(doc, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
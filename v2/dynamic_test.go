@@ -0,0 +1,194 @@
+package bsonpb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	pb2 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb2_proto"
+	pb3 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb3_proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// descriptorSet returns the file of m and its imports, like protoc
+// --include_imports.
+func descriptorSet(m proto.Message) *descriptorpb.FileDescriptorSet {
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := map[string]bool{}
+	var add func(fd pref.FileDescriptor)
+	add = func(fd pref.FileDescriptor) {
+		if seen[fd.Path()] {
+			return
+		}
+		seen[fd.Path()] = true
+		imports := fd.Imports()
+		for i := 0; i < imports.Len(); i++ {
+			add(imports.Get(i).FileDescriptor)
+		}
+		set.File = append(set.File, protodesc.ToFileDescriptorProto(fd))
+	}
+	add(m.ProtoReflect().Descriptor().ParentFile())
+	return set
+}
+
+// writeDescriptorSet writes the descriptor set of m to a file and returns
+// its path and a function removing it.
+func writeDescriptorSet(t *testing.T, m proto.Message) (string, func()) {
+	b, err := proto.Marshal(descriptorSet(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "bsonpb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "set.pb")
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestUnmarshalDynamic(t *testing.T) {
+	path, cleanup := writeDescriptorSet(t, &pb2.KnownTypes{})
+	defer cleanup()
+	files, err := LoadDescriptorSet(path)
+	if err != nil {
+		t.Fatalf("LoadDescriptorSet() got error: %v", err)
+	}
+	types, err := NewDynamicTypes(files)
+	if err != nil {
+		t.Fatalf("NewDynamicTypes() got error: %v", err)
+	}
+
+	anyNested, err := anypb.New(&pb2.Nested{OptString: proto.String("embedded"), OptNested: &pb2.Nested{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	extensions := &pb2.Extensions{OptString: proto.String("x")}
+	proto.SetExtension(extensions, pb2.E_OptExtEnum, pb2.Enum_TEN)
+	proto.SetExtension(extensions, pb2.E_RptExtNested, []*pb2.Nested{{OptString: proto.String("y")}})
+
+	tests := []struct {
+		desc  string
+		input proto.Message
+	}{{
+		desc: "scalars and enums",
+		input: &pb2.Enums{
+			OptEnum:       pb2.Enum_TEN.Enum(),
+			RptEnum:       []pb2.Enum{pb2.Enum_ONE, pb2.Enum_TWO},
+			OptNestedEnum: pb2.Enums_UNO.Enum(),
+		},
+	}, {
+		desc: "nested messages and maps",
+		input: &pb2.Maps{
+			Int32ToStr:  map[int32]string{1: "one"},
+			StrToNested: map[string]*pb2.Nested{"n": {OptString: proto.String("z")}},
+		},
+	}, {
+		desc:  "extensions",
+		input: extensions,
+	}, {
+		desc: "well-known types and any",
+		input: &pb2.KnownTypes{
+			OptTimestamp: timestamppb.New(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)),
+			OptStruct:    &structpb.Struct{Fields: map[string]*structpb.Value{"a": structpb.NewNumberValue(1)}},
+			OptAny:       anyNested,
+		},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			doc, err := MarshalOptions{Deterministic: true}.Marshal(tt.input)
+			if err != nil {
+				t.Fatalf("Marshal() got error: %v", err)
+			}
+			name := tt.input.ProtoReflect().Descriptor().FullName()
+			got, err := UnmarshalOptions{Resolver: types}.UnmarshalDynamic(doc, name)
+			if err != nil {
+				t.Fatalf("UnmarshalDynamic() got error: %v", err)
+			}
+			if got.Descriptor() == tt.input.ProtoReflect().Descriptor() {
+				t.Errorf("UnmarshalDynamic() used the generated descriptor of %v", name)
+			}
+
+			// Compare through the wire format, as dynamic and generated
+			// messages are never equal.
+			b, err := proto.Marshal(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded := tt.input.ProtoReflect().New().Interface()
+			if err := proto.Unmarshal(b, decoded); err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(decoded, tt.input) {
+				t.Errorf("UnmarshalDynamic()\n<got>\n%v\n<want>\n%v\n", decoded, tt.input)
+			}
+
+			again, err := MarshalOptions{Deterministic: true, Resolver: types}.Marshal(got)
+			if err != nil {
+				t.Fatalf("Marshal() got error: %v", err)
+			}
+			if diff := cmp.Diff(doc, again); diff != "" {
+				t.Errorf("Marshal() diff -want +got\n%v\n", diff)
+			}
+		})
+	}
+}
+
+func TestUnmarshalDynamicErrors(t *testing.T) {
+	path, cleanup := writeDescriptorSet(t, &pb2.KnownTypes{})
+	defer cleanup()
+	files, err := LoadDescriptorSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types, err := NewDynamicTypes(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	umo := UnmarshalOptions{Resolver: types}
+
+	if _, err := umo.UnmarshalDynamic(bson.D{}, "textpb3_proto.Nested"); err == nil || !strings.Contains(err.Error(), `unable to resolve "textpb3_proto.Nested"`) {
+		t.Errorf("UnmarshalDynamic() got error %v, want unable to resolve", err)
+	}
+
+	// Types are resolved from the descriptor set only, even if they are
+	// linked into the binary.
+	anyScalars, err := anypb.New(&pb3.Scalars{SString: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := Marshal(&pb2.KnownTypes{OptAny: anyScalars})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := umo.UnmarshalDynamic(doc, "textpb2_proto.KnownTypes"); err == nil || !strings.Contains(err.Error(), `optAny.@type: unable to resolve "type.googleapis.com/textpb3_proto.Scalars"`) {
+		t.Errorf("UnmarshalDynamic() got error %v, want unable to resolve", err)
+	}
+
+	if _, err := LoadDescriptorSet(path + ".missing"); err == nil {
+		t.Error("LoadDescriptorSet() got nil error for a missing file")
+	}
+	if err := ioutil.WriteFile(path, []byte("invalid"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadDescriptorSet(path); err == nil || !strings.Contains(err.Error(), "invalid descriptor set") {
+		t.Errorf("LoadDescriptorSet() got error %v, want invalid descriptor set", err)
+	}
+}
@@ -1,8 +1,8 @@
 package bsonpb
 
 import (
-	"errors"
 	"fmt"
+	"math"
 	"sort"
 	"unicode/utf8"
 
@@ -12,6 +12,7 @@ import (
 	"google.golang.org/protobuf/proto"
 	pref "google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
 const (
@@ -42,7 +43,14 @@ func IsMessageSetExtension(fd pref.FieldDescriptor) bool {
 // different versions of the program.
 func Marshal(m proto.Message) (bson.D, error) {
 	result, err := MarshalOptions{}.Marshal(m)
-	return result.(bson.D), err
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := result.(bson.D)
+	if !ok {
+		return nil, newError(CategoryUnsupported, "%v is not encoded as a document, use MarshalOptions.Marshal instead", m.ProtoReflect().Descriptor().FullName())
+	}
+	return doc, nil
 }
 
 // NoUnkeyedLiterals can be embedded in a struct to prevent unkeyed literals.
@@ -91,17 +99,102 @@ type MarshalOptions struct {
 	//  ╚═══════╧════════════════════════════╝
 	EmitUnpopulated bool
 
+	// Deterministic produces canonical output whose encoded bytes are stable
+	// across versions of this package, e.g. for content hashes:
+	//  - fields and extensions are ordered as selected by FieldOrder,
+	//  - map entries are ordered by key, numerically for integer keys,
+	//  - 32-bit signed integers and enum numbers are encoded as BSON int32,
+	//  - 64-bit integers and unsigned 32-bit integers are encoded as BSON
+	//    int64, unsigned 64-bit integers above math.MaxInt64 are an error,
+	//  - floats and doubles are encoded as BSON double.
+	Deterministic bool
+
+	// FieldOrder selects the order of fields when Deterministic is set.
+	FieldOrder FieldOrder
+
+	// MaxDocumentSize limits the size in bytes of the encoded document. If it
+	// is exceeded, Marshal returns a DocumentSizeError listing the largest
+	// fields. Use MaxBSONDocumentSize for the limit of MongoDB. If zero, there
+	// is no limit.
+	MaxDocumentSize int
+
+	// Mask restricts the output to the fields selected by its paths. Paths
+	// use proto field names and may descend into submessages, the elements
+	// of repeated messages and the values of maps. For maps, the segment
+	// after the field name selects an entry by key, or every entry if it is
+	// "*", e.g. "str_to_nested.*.s_string". Extensions and the contents of
+	// well-known and custom types can not be selected. If nil or empty, all
+	// fields are marshaled.
+	Mask *fieldmaskpb.FieldMask
+
+	// Redaction redacts the values of fields that are marked as sensitive,
+	// e.g. before writing to audit or analytics collections. If nil, no
+	// fields are redacted.
+	Redaction *RedactionPolicy
+
+	// Encryptor encrypts the values of fields that are marked with the
+	// (bsonpb.encrypted) field option. They are stored as BSON binary values
+	// of subtype EncryptedSubtype. Marshaling such a field fails if it is
+	// nil.
+	Encryptor Encryptor
+
+	// Types selects custom marshal functions for message types.
+	Types *TypeRegistry
+
+	// OneofEncoding selects how the set field of a oneof is encoded. Oneofs
+	// of proto3 optional fields are always flattened.
+	OneofEncoding OneofEncoding
+
+	// TypeKey is the key under which the type of the top-level message is
+	// written, e.g. DefaultTypeKey, so that documents of several types can
+	// be stored in one collection and decoded with UnmarshalAny. If empty,
+	// no type is written.
+	TypeKey string
+
+	// TypeURLPrefix writes the type under TypeKey as a type URL with this
+	// prefix, e.g. "type.googleapis.com/", instead of the full name.
+	TypeURLPrefix string
+
+	// BinarySubtype is the BSON binary subtype of bytes fields without the
+	// (bsonpb.binary_subtype) field option: generic, UUID, MD5 or
+	// user-defined. The values of UUID and MD5 fields must be 16 bytes long.
+	BinarySubtype byte
+
+	// UnknownFieldsKey is the key under which the unknown fields of messages,
+	// e.g. fields added by a newer producer, are written as binary in wire
+	// format, e.g. DefaultUnknownFieldsKey, so that services passing messages
+	// through do not lose them. The unknown fields of inlined messages are
+	// written under the key followed by the path of inline field names, e.g.
+	// "_unknown.audit". Unknown fields are not written if Mask is set.
+	// If empty, unknown fields are dropped.
+	UnknownFieldsKey string
+
+	// AllowUnresolvedAny marshals google.protobuf.Any messages whose type can
+	// not be resolved as {"@type": url, "@value": Binary} holding the
+	// serialized message, instead of failing. Types that resolve are always
+	// expanded, so stored payloads are expanded on their next write once
+	// their type is known.
+	AllowUnresolvedAny bool
+
 	// Resolver is used for looking up types when expanding google.protobuf.Any
 	// messages. If nil, this defaults to using protoregistry.GlobalTypes.
-	Resolver interface {
-		protoregistry.ExtensionTypeResolver
-		protoregistry.MessageTypeResolver
-	}
+	Resolver Resolver
 }
 
+// FieldOrder selects the order of fields in deterministic output.
+type FieldOrder int
+
+const (
+	// OrderByNumber orders fields and extensions by field number.
+	OrderByNumber FieldOrder = iota
+	// OrderByName orders fields and extensions by the bytes of their key.
+	OrderByName
+)
+
 // Marshal marshals the given proto.Message in the JSON format using options in
-// MarshalOptions. Do not depend on the output being stable. It may change over
-// time across different versions of the program.
+// MarshalOptions. Do not depend on the output being stable unless
+// Deterministic is set. It may change over time across different versions of
+// the program.
 func (o MarshalOptions) Marshal(m proto.Message) (interface{}, error) {
 	return o.marshal(m)
 }
@@ -123,24 +216,63 @@ func (o MarshalOptions) marshal(m proto.Message) (interface{}, error) {
 		return bson.D{}, nil
 	}
 
-	enc := encoder{o}
+	enc, err := o.newEncoder(m.ProtoReflect().Descriptor())
+	if err != nil {
+		return bson.D{}, err
+	}
 	result, err := enc.marshalMessage(m.ProtoReflect())
+	if err == nil && o.TypeKey != "" {
+		result, err = enc.withTypeKey(result, m.ProtoReflect())
+	}
 	if err != nil {
 		return bson.D{}, err
 	}
+	if doc, ok := result.(bson.D); ok && o.MaxDocumentSize > 0 {
+		if err := checkDocumentSize(doc, m.ProtoReflect().Descriptor(), o.MaxDocumentSize); err != nil {
+			return bson.D{}, err
+		}
+	}
 	if o.AllowPartial {
 		return result, nil
 	}
-	return result, proto.CheckInitialized(m)
+	return result, o.requiredPaths().checkInitialized(m, nil)
 }
 
 type encoder struct {
 	opts MarshalOptions
+
+	// mask selects the fields of the message being marshaled.
+	mask fieldMask
+}
+
+// requiredPaths returns how missing required fields of marshaled messages are
+// reported.
+func (o MarshalOptions) requiredPaths() requiredPaths {
+	return requiredPaths{useProtoNames: o.UseProtoNames, oneofEncoding: o.OneofEncoding}
+}
+
+// newEncoder returns an encoder for messages of type md after checking the
+// options.
+func (o MarshalOptions) newEncoder(md pref.MessageDescriptor) (encoder, error) {
+	mask, err := newFieldMask(md, o.Mask)
+	if err != nil {
+		return encoder{}, err
+	}
+	if err := checkBinarySubtype(uint32(o.BinarySubtype)); err != nil {
+		return encoder{}, err
+	}
+	if o.Redaction != nil {
+		if err := o.Redaction.check(); err != nil {
+			return encoder{}, err
+		}
+	}
+	return encoder{opts: o, mask: mask}, nil
 }
 
 // marshalMessage marshals the given protoreflect.Message.
 func (e encoder) marshalMessage(m pref.Message) (interface{}, error) {
-	if marshal := wellKnownTypeMarshaler(m.Descriptor().FullName()); marshal != nil {
+	if marshal := e.typeMarshaler(m.Descriptor().FullName()); marshal != nil {
+		e.mask = nil
 		return marshal(e, m)
 	}
 
@@ -158,10 +290,21 @@ func (e encoder) marshalFields(m pref.Message) (bson.D, error) {
 	result := bson.D{}
 	messageDesc := m.Descriptor()
 	if !protoLegacy && IsMessageSet(messageDesc) {
-		return result, errors.New("no support for proto1 MessageSets")
+		return result, newError(CategoryUnsupported, "no support for proto1 MessageSets")
 	}
 
+	catchAll, err := catchAllField(messageDesc)
+	if err != nil {
+		return result, err
+	}
+	inline, err := analyzeInline(messageDesc)
+	if err != nil {
+		return result, err
+	}
+	var captured bson.D
+
 	// Marshal out known fields.
+	var numbers []pref.FieldNumber
 	fieldDescs := messageDesc.Fields()
 	for i := 0; i < fieldDescs.Len(); {
 		fd := fieldDescs.Get(i)
@@ -175,9 +318,33 @@ func (e encoder) marshalFields(m pref.Message) (bson.D, error) {
 			i++
 		}
 
+		mask, ok := e.mask.field(fd)
+		if !ok {
+			continue
+		}
+		fe := e
+		fe.mask = mask
+
+		if inline.isInline(fd) {
+			// The fields of inlined messages are written inline.
+			if !m.Has(fd) {
+				continue
+			}
+			fe.opts.UnknownFieldsKey = inlineUnknownFieldsKey(e.opts.UnknownFieldsKey, fd)
+			entries, err := fe.marshalFields(m.Get(fd).Message())
+			if err != nil {
+				return bson.D{}, err
+			}
+			for _, entry := range entries {
+				result = append(result, entry)
+				numbers = append(numbers, fd.Number())
+			}
+			continue
+		}
+
 		val := m.Get(fd)
 		if !m.Has(fd) {
-			if !e.opts.EmitUnpopulated {
+			if !e.opts.EmitUnpopulated || fd == catchAll {
 				continue
 			}
 			isProto2Scalar := fd.Syntax() == pref.Proto2 && fd.Default().IsValid()
@@ -188,29 +355,99 @@ func (e encoder) marshalFields(m pref.Message) (bson.D, error) {
 			}
 		}
 
-		name := fd.JSONName()
-		if e.opts.UseProtoNames {
-			name = string(fd.Name())
-			// Use type name for group field name.
-			if fd.Kind() == pref.GroupKind {
-				name = string(fd.Message().Name())
+		name := fieldKey(fd, e.opts.UseProtoNames)
+
+		var marshaled interface{}
+		if p := e.opts.Redaction; p != nil && isSensitive(fd) {
+			if p.Mode == RedactDrop {
+				continue
+			}
+			marshaled = p.redact(val, fd)
+		} else {
+			var err error
+			marshaled, err = fe.marshalValue(val, fd)
+			if err == nil && m.Has(fd) && isEncrypted(fd) {
+				marshaled, err = e.encrypt(marshaled, fd)
+			}
+			if err != nil {
+				return bson.D{}, withField(err, name)
 			}
 		}
+		if fd == catchAll {
+			// Captured keys are written inline.
+			entries, err := catchAllEntries(fd, marshaled)
+			if err != nil {
+				return bson.D{}, err
+			}
+			for _, entry := range entries {
+				result = append(result, entry)
+				numbers = append(numbers, fd.Number())
+			}
+			captured = entries
+			continue
+		}
+		for _, entry := range e.oneofEntries(fd, name, marshaled) {
+			result = append(result, entry)
+			numbers = append(numbers, fd.Number())
+		}
+	}
 
-		marshaled, err := e.marshalValue(val, fd)
+	// Marshal out extensions. They can not be selected by a mask.
+	if e.mask == nil {
+		extensions, extNumbers, err := e.marshalExtensions(m)
 		if err != nil {
 			return bson.D{}, err
 		}
-		result = append(result, bson.E{Key: name, Value: marshaled})
+		result = append(result, extensions...)
+		numbers = append(numbers, extNumbers...)
 	}
 
-	// Marshal out extensions.
-	extensions, err := e.marshalExtensions(m)
-	if err != nil {
-		return bson.D{}, err
+	if captured != nil {
+		if err := checkCatchAllKeys(catchAll, captured, result, e.opts.UnknownFieldsKey); err != nil {
+			return bson.D{}, err
+		}
 	}
-	result = append(result, extensions...)
-	return result, nil
+	if e.opts.Deterministic {
+		sortFields(e.opts.FieldOrder, result, numbers)
+	}
+	return e.withUnknownFields(result, m)
+}
+
+// fieldKey returns the document key of the field fd.
+func fieldKey(fd pref.FieldDescriptor, useProtoNames bool) string {
+	if !useProtoNames {
+		return fd.JSONName()
+	}
+	// Use type name for group field name.
+	if fd.Kind() == pref.GroupKind {
+		return string(fd.Message().Name())
+	}
+	return string(fd.Name())
+}
+
+// sortFields orders the fields of a document with the given field numbers.
+func sortFields(order FieldOrder, doc bson.D, numbers []pref.FieldNumber) {
+	sort.Stable(fieldSorter{order: order, doc: doc, numbers: numbers})
+}
+
+type fieldSorter struct {
+	order   FieldOrder
+	doc     bson.D
+	numbers []pref.FieldNumber
+}
+
+func (s fieldSorter) Len() int { return len(s.doc) }
+
+func (s fieldSorter) Less(i, j int) bool {
+	if s.order == OrderByName {
+		return s.doc[i].Key < s.doc[j].Key
+	}
+	return s.numbers[i] < s.numbers[j]
+}
+
+func (s fieldSorter) Swap(i, j int) {
+	s.doc[i], s.doc[j] = s.doc[j], s.doc[i]
+	s.numbers[i], s.numbers[j] = s.numbers[j], s.numbers[i]
 }
 
 func (e encoder) marshalValue(val pref.Value, fd pref.FieldDescriptor) (interface{}, error) {
@@ -235,31 +472,50 @@ func (e encoder) marshalSingular(val pref.Value, fd pref.FieldDescriptor) (inter
 		return val.Bool(), nil
 
 	case pref.StringKind:
+		format, err := fieldBinaryFormat(fd)
+		if err != nil {
+			return nil, err
+		}
+		if format.uuid {
+			return marshalUUID(val.String())
+		}
 		if valid := utf8.Valid([]byte(val.String())); valid {
 			return val.String(), nil
 		}
-		return "", fmt.Errorf("InvalidUTF8: %s", val.String())
+		return "", &Error{Kind: kind, Category: CategoryInvalidUTF8, Err: fmt.Errorf("InvalidUTF8: %s", val.String())}
 
 	case pref.Int32Kind, pref.Sint32Kind, pref.Sfixed32Kind:
 		return int32(val.Int()), nil
 
 	case pref.Uint32Kind, pref.Fixed32Kind:
+		if e.opts.Deterministic {
+			return int64(val.Uint()), nil
+		}
 		return uint32(val.Uint()), nil
 
 	case pref.Int64Kind, pref.Sint64Kind, pref.Sfixed64Kind:
 		return val.Int(), nil
 
 	case pref.Uint64Kind, pref.Fixed64Kind:
+		if e.opts.Deterministic {
+			if val.Uint() > math.MaxInt64 {
+				return nil, &Error{Kind: kind, Category: CategoryInvalidValue, Err: fmt.Errorf("%v does not fit into a BSON int64", val.Uint())}
+			}
+			return int64(val.Uint()), nil
+		}
 		return val.Uint(), nil
 
 	case pref.FloatKind:
+		if e.opts.Deterministic {
+			return val.Float(), nil
+		}
 		return float32(val.Float()), nil
 
 	case pref.DoubleKind:
 		return val.Float(), nil
 
 	case pref.BytesKind:
-		return primitive.Binary{Data: val.Bytes()}, nil
+		return e.marshalBytes(val.Bytes(), fd)
 
 	case pref.EnumKind:
 		if fd.Enum().FullName() == genid.NullValue_enum_fullname {
@@ -267,6 +523,9 @@ func (e encoder) marshalSingular(val pref.Value, fd pref.FieldDescriptor) (inter
 		}
 		desc := fd.Enum().Values().ByNumber(val.Enum())
 		if e.opts.UseEnumNumbers || desc == nil {
+			if e.opts.Deterministic {
+				return int32(val.Enum()), nil
+			}
 			return int64(val.Enum()), nil
 		}
 		return string(desc.Name()), nil
@@ -279,18 +538,25 @@ func (e encoder) marshalSingular(val pref.Value, fd pref.FieldDescriptor) (inter
 		return marshaled, nil
 
 	default:
-		return bson.D{}, fmt.Errorf("%v has unknown kind: %v", fd.FullName(), kind)
+		return bson.D{}, &Error{Kind: kind, Category: CategoryUnsupported, Err: fmt.Errorf("%v has unknown kind: %v", fd.FullName(), kind)}
 	}
 }
 
 // marshalList marshals the given protoreflect.List.
 func (e encoder) marshalList(list pref.List, fd pref.FieldDescriptor) (interface{}, error) {
+	key, err := keyField(fd)
+	if err != nil {
+		return bson.A{}, err
+	}
+	if key != nil {
+		return e.marshalKeyedList(list, fd, key)
+	}
 	result := bson.A{}
 	for i := 0; i < list.Len(); i++ {
 		item := list.Get(i)
 		val, err := e.marshalSingular(item, fd)
 		if err != nil {
-			return bson.A{}, err
+			return bson.A{}, withIndex(err, i)
 		}
 		result = append(result, val)
 	}
@@ -315,9 +581,15 @@ func (e encoder) marshalMap(mmap pref.Map, fd pref.FieldDescriptor) (interface{}
 
 	// Write out sorted list.
 	for _, entry := range entries {
-		val, err := e.marshalSingular(entry.value, fd.MapValue())
+		mask, ok := e.mask.entry(entry.key.String())
+		if !ok {
+			continue
+		}
+		ve := e
+		ve.mask = mask
+		val, err := ve.marshalSingular(entry.value, fd.MapValue())
 		if err != nil {
-			return nil, err
+			return nil, withMapKey(err, entry.key.String(), fd.MapKey().Kind())
 		}
 		result = append(result, bson.E{Key: entry.key.String(), Value: val})
 	}
@@ -341,8 +613,9 @@ func sortMap(keyKind pref.Kind, values []mapEntry) {
 }
 
 // marshalExtensions marshals extension fields.
-func (e encoder) marshalExtensions(m pref.Message) ([]bson.E, error) {
+func (e encoder) marshalExtensions(m pref.Message) ([]bson.E, []pref.FieldNumber, error) {
 	result := []bson.E{}
+	var numbers []pref.FieldNumber
 	type entry struct {
 		key   string
 		value pref.Value
@@ -381,11 +654,22 @@ func (e encoder) marshalExtensions(m pref.Message) ([]bson.E, error) {
 		// JSON field name is the proto field name enclosed in [], similar to
 		// textproto. This is consistent with Go v1 lib. C++ lib v3.7.0 does not
 		// marshal out extension fields.
+		if p := e.opts.Redaction; p != nil && isSensitive(entry.desc) {
+			if p.Mode != RedactDrop {
+				result = append(result, bson.E{Key: "[" + entry.key + "]", Value: p.redact(entry.value, entry.desc)})
+				numbers = append(numbers, entry.desc.Number())
+			}
+			continue
+		}
 		marshaled, err := e.marshalValue(entry.value, entry.desc)
+		if err == nil && isEncrypted(entry.desc) {
+			marshaled, err = e.encrypt(marshaled, entry.desc)
+		}
 		if err != nil {
-			return result, err
+			return result, numbers, withField(err, "["+entry.key+"]")
 		}
 		result = append(result, bson.E{Key: "[" + entry.key + "]", Value: marshaled})
+		numbers = append(numbers, entry.desc.Number())
 	}
-	return result, nil
+	return result, numbers, nil
 }
@@ -0,0 +1,114 @@
+package bsonpb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// EncryptedSubtype is the BSON binary subtype of encrypted fields, which
+// MongoDB uses for client-side field level encryption. It is not defined by
+// the bsontype package of the supported driver versions.
+const EncryptedSubtype byte = 0x06
+
+// Encryptor encrypts the values of fields that are marked with the
+// (bsonpb.encrypted) field option.
+type Encryptor interface {
+	// Encrypt returns the ciphertext of the plaintext value of fd.
+	Encrypt(fd pref.FieldDescriptor, plaintext []byte) ([]byte, error)
+}
+
+// Decryptor decrypts values encrypted by an Encryptor.
+type Decryptor interface {
+	// Decrypt returns the plaintext of the ciphertext value of fd.
+	Decrypt(fd pref.FieldDescriptor, ciphertext []byte) ([]byte, error)
+}
+
+// encryptedValueKey is the key of the value in the plaintext document.
+const encryptedValueKey = "v"
+
+// encrypt encrypts the marshaled value of fd. The plaintext is the encoding
+// of a document holding the value, so that any field can be encrypted.
+func (e encoder) encrypt(val interface{}, fd pref.FieldDescriptor) (interface{}, error) {
+	if e.opts.Encryptor == nil {
+		return nil, newError(CategoryUnsupported, "field %v is encrypted but no Encryptor is set", fd.FullName())
+	}
+	plaintext, err := bson.Marshal(bson.D{{Key: encryptedValueKey, Value: val}})
+	if err != nil {
+		return nil, newError(CategoryInvalidValue, "unable to encode %v for encryption: %v", fd.FullName(), err)
+	}
+	ciphertext, err := e.opts.Encryptor.Encrypt(fd, plaintext)
+	if err != nil {
+		return nil, newError(CategoryOther, "unable to encrypt %v: %v", fd.FullName(), err)
+	}
+	return primitive.Binary{Subtype: EncryptedSubtype, Data: ciphertext}, nil
+}
+
+// decrypt returns the value of fd that was encrypted by encoder.encrypt.
+func (d decoder) decrypt(b primitive.Binary, fd pref.FieldDescriptor) (interface{}, error) {
+	if d.opts.Decryptor == nil {
+		return nil, newError(CategoryUnsupported, "field %v is encrypted but no Decryptor is set", fd.FullName())
+	}
+	plaintext, err := d.opts.Decryptor.Decrypt(fd, b.Data)
+	if err != nil {
+		return nil, newError(CategoryInvalidValue, "unable to decrypt %v: %v", fd.FullName(), err)
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(plaintext, &doc); err != nil || len(doc) != 1 || doc[0].Key != encryptedValueKey {
+		return nil, newError(CategoryInvalidValue, "unable to decode decrypted value of %v", fd.FullName())
+	}
+	return doc[0].Value, nil
+}
+
+// isEncryptedValue reports whether val is the encrypted value of a field.
+func isEncryptedValue(val interface{}) (primitive.Binary, bool) {
+	b, ok := val.(primitive.Binary)
+	return b, ok && b.Subtype == EncryptedSubtype
+}
+
+// LocalKeyProvider encrypts and decrypts fields with AES-GCM using a local
+// key, e.g. in tests and development setups without a key management
+// service. The full name of the field is authenticated as additional data,
+// so ciphertexts can not be moved between fields.
+type LocalKeyProvider struct {
+	aead cipher.AEAD
+}
+
+// NewLocalKeyProvider returns a LocalKeyProvider for an AES key of 16, 24 or
+// 32 bytes.
+func NewLocalKeyProvider(key []byte) (*LocalKeyProvider, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalKeyProvider{aead: aead}, nil
+}
+
+// Encrypt seals the plaintext with a random nonce, which is prepended to the
+// returned ciphertext.
+func (p *LocalKeyProvider) Encrypt(fd pref.FieldDescriptor, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, p.aead.NonceSize(), p.aead.NonceSize()+len(plaintext)+p.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return p.aead.Seal(nonce, nonce, plaintext, []byte(fd.FullName())), nil
+}
+
+// Decrypt opens a ciphertext returned by Encrypt.
+func (p *LocalKeyProvider) Decrypt(fd pref.FieldDescriptor, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < p.aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext of %d bytes is too short", len(ciphertext))
+	}
+	nonce, sealed := ciphertext[:p.aead.NonceSize()], ciphertext[p.aead.NonceSize():]
+	return p.aead.Open(nil, nonce, sealed, []byte(fd.FullName()))
+}
@@ -0,0 +1,145 @@
+package bsonpb
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	pb2 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb2_proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	kp, err := NewLocalKeyProvider(bytes.Repeat([]byte("k"), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := &pb2.Encrypted{
+		Name:     proto.String("name"),
+		Ssn:      proto.String("123-45-6789"),
+		Pin:      proto.Uint32(1234),
+		Key:      []byte("key"),
+		Notes:    []string{"first", "second"},
+		Balances: map[string]int64{"eur": 10, "usd": -5},
+		Address:  &pb2.Nested{OptString: proto.String("street")},
+	}
+	proto.SetExtension(input, pb2.E_ExtEncrypted, "extension")
+
+	got, err := MarshalOptions{Encryptor: kp}.Marshal(input)
+	if err != nil {
+		t.Fatalf("Marshal() got error: %v", err)
+	}
+	doc := got.(bson.D)
+	for _, elem := range doc {
+		if elem.Key == "name" {
+			if elem.Value != "name" {
+				t.Errorf("Marshal() got %v for name, want plaintext", elem.Value)
+			}
+			continue
+		}
+		b, ok := elem.Value.(primitive.Binary)
+		if !ok || b.Subtype != EncryptedSubtype {
+			t.Errorf("Marshal() got %v for %s, want binary subtype %d", elem.Value, elem.Key, EncryptedSubtype)
+			continue
+		}
+		if bytes.Contains(b.Data, []byte("123-45-6789")) || bytes.Contains(b.Data, []byte("street")) {
+			t.Errorf("Marshal() got plaintext in ciphertext of %s", elem.Key)
+		}
+	}
+	if len(doc) != 8 {
+		t.Errorf("Marshal() got %d fields, want 8", len(doc))
+	}
+
+	// Round trip through the binary encoding.
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatalf("bson.Marshal() got error: %v", err)
+	}
+	decoded := &pb2.Encrypted{}
+	if err := (UnmarshalOptions{Decryptor: kp}).UnmarshalBytes(b, decoded); err != nil {
+		t.Fatalf("Unmarshal() got error: %v", err)
+	}
+	if !proto.Equal(decoded, input) {
+		t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", decoded, input)
+	}
+}
+
+func TestEncryptionErrors(t *testing.T) {
+	kp, err := NewLocalKeyProvider(bytes.Repeat([]byte("k"), 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewLocalKeyProvider(bytes.Repeat([]byte("o"), 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := MarshalOptions{Encryptor: kp}.Marshal(&pb2.Encrypted{Ssn: proto.String("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssn := encrypted.(bson.D)[0].Value
+
+	tests := []struct {
+		desc        string
+		umo         UnmarshalOptions
+		inputBson   bson.D
+		wantMessage proto.Message
+		wantErr     string
+	}{{
+		desc:        "plaintext values",
+		umo:         UnmarshalOptions{Decryptor: kp},
+		inputBson:   bson.D{{Key: "ssn", Value: "plain"}, {Key: "pin", Value: int64(1)}},
+		wantMessage: &pb2.Encrypted{Ssn: proto.String("plain"), Pin: proto.Uint32(1)},
+	}, {
+		desc:      "missing decryptor",
+		inputBson: bson.D{{Key: "ssn", Value: ssn}},
+		wantErr:   "ssn: field textpb2_proto.Encrypted.ssn is encrypted but no Decryptor is set",
+	}, {
+		desc:      "wrong key",
+		umo:       UnmarshalOptions{Decryptor: other},
+		inputBson: bson.D{{Key: "ssn", Value: ssn}},
+		wantErr:   "ssn: unable to decrypt textpb2_proto.Encrypted.ssn",
+	}, {
+		desc:      "ciphertext of another field",
+		umo:       UnmarshalOptions{Decryptor: kp},
+		inputBson: bson.D{{Key: "alias", Value: ssn}},
+		wantErr:   "alias: unable to decrypt textpb2_proto.Encrypted.alias",
+	}, {
+		desc:      "truncated ciphertext",
+		umo:       UnmarshalOptions{Decryptor: kp},
+		inputBson: bson.D{{Key: "ssn", Value: primitive.Binary{Subtype: EncryptedSubtype, Data: []byte("x")}}},
+		wantErr:   "ciphertext of 1 bytes is too short",
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			got := &pb2.Encrypted{}
+			err := tt.umo.Unmarshal(tt.inputBson, got)
+			if err != nil {
+				if tt.wantErr == "" {
+					t.Errorf("Unmarshal() got unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Unmarshal() error got %q, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if tt.wantErr != "" {
+				t.Errorf("Unmarshal() got nil error, want error %q", tt.wantErr)
+			}
+			if !proto.Equal(got, tt.wantMessage) {
+				t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", got, tt.wantMessage)
+			}
+		})
+	}
+
+	if _, err := Marshal(&pb2.Encrypted{Ssn: proto.String("secret")}); err == nil || !strings.Contains(err.Error(), "no Encryptor is set") {
+		t.Errorf("Marshal() got error %v, want missing Encryptor", err)
+	}
+	if _, err := NewLocalKeyProvider([]byte("short")); err == nil {
+		t.Errorf("NewLocalKeyProvider() got nil error for invalid key size")
+	}
+}
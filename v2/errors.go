@@ -0,0 +1,233 @@
+package bsonpb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"google.golang.org/protobuf/proto"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// ErrorCategory classifies the cause of an Error.
+type ErrorCategory int
+
+const (
+	// CategoryOther is used for errors that do not fit any other category.
+	CategoryOther ErrorCategory = iota
+	// CategoryTypeMismatch means the BSON type of a value is not accepted for
+	// the proto kind of the field.
+	CategoryTypeMismatch
+	// CategoryInvalidValue means the BSON type is accepted but the value is
+	// not, e.g. because it is out of range.
+	CategoryInvalidValue
+	// CategoryInvalidUTF8 means a string contains invalid UTF-8.
+	CategoryInvalidUTF8
+	// CategoryUnknownField means a document key does not match any field.
+	CategoryUnknownField
+	// CategoryDuplicateField means a field or map key is set more than once.
+	CategoryDuplicateField
+	// CategoryOneofConflict means more than one field of a oneof is set.
+	CategoryOneofConflict
+	// CategoryMissingRequired means a required field is not set.
+	CategoryMissingRequired
+	// CategoryUnresolvable means a message or extension type can not be found.
+	CategoryUnresolvable
+	// CategoryUnsupported means the message uses an unsupported feature.
+	CategoryUnsupported
+	// CategoryLimitExceeded means a configured decoding limit was exceeded.
+	CategoryLimitExceeded
+)
+
+func (c ErrorCategory) String() string {
+	switch c {
+	case CategoryTypeMismatch:
+		return "type mismatch"
+	case CategoryInvalidValue:
+		return "invalid value"
+	case CategoryInvalidUTF8:
+		return "invalid UTF-8"
+	case CategoryUnknownField:
+		return "unknown field"
+	case CategoryDuplicateField:
+		return "duplicate field"
+	case CategoryOneofConflict:
+		return "oneof conflict"
+	case CategoryMissingRequired:
+		return "missing required field"
+	case CategoryUnresolvable:
+		return "unresolvable type"
+	case CategoryUnsupported:
+		return "unsupported"
+	case CategoryLimitExceeded:
+		return "limit exceeded"
+	}
+	return "other"
+}
+
+// Error is returned by the encoder and decoder. It describes where in the
+// document an error occurred and what caused it. Use errors.As to obtain it.
+type Error struct {
+	// Path is the location of the offending value, e.g.
+	// children[3].terrain["x"].bunny. It is empty for the top-level message.
+	Path string
+
+	// Kind is the expected proto kind of the offending value, if known.
+	Kind pref.Kind
+
+	// BSONType is the actual BSON type of the offending value. It is only
+	// set for decode errors.
+	BSONType bsontype.Type
+
+	// Category classifies the cause of the error.
+	Category ErrorCategory
+
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Path == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Errors lists every problem found when decoding with
+// UnmarshalOptions.AllErrors set.
+type Errors []*Error
+
+func (e Errors) Error() string {
+	switch len(e) {
+	case 0:
+		return "no errors"
+	case 1:
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%v (and %d more errors)", e[0], len(e)-1)
+}
+
+// err returns e as an error, or nil if it is empty.
+func (e Errors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// add appends err to e. Errors are flattened and other errors are wrapped.
+func (e *Errors) add(err error) {
+	switch err := err.(type) {
+	case nil:
+	case *Error:
+		*e = append(*e, err)
+	case Errors:
+		*e = append(*e, err...)
+	default:
+		*e = append(*e, &Error{Category: CategoryOther, Err: err})
+	}
+}
+
+// isPartial reports whether err was collected while decoding a value that
+// has still been populated as far as possible.
+func isPartial(err error) bool {
+	_, ok := err.(Errors)
+	return ok
+}
+
+// isLimitExceeded reports whether err is caused by an exceeded limit.
+func isLimitExceeded(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Category == CategoryLimitExceeded
+}
+
+// newError returns an Error of the given category without a path.
+func newError(c ErrorCategory, format string, a ...interface{}) *Error {
+	return &Error{Category: c, Err: fmt.Errorf(format, a...)}
+}
+
+// newValueError returns an Error of the given category for a decoded value
+// that does not fit into a field of the given kind.
+func newValueError(c ErrorCategory, kind pref.Kind, val interface{}, format string, a ...interface{}) *Error {
+	return &Error{Category: c, Kind: kind, BSONType: bsonTypeOf(val), Err: fmt.Errorf(format, a...)}
+}
+
+// checkInitialized reports the first missing required field as an Error. doc
+// is the document m was decoded from or nil.
+func (p requiredPaths) checkInitialized(m proto.Message, doc interface{}) error {
+	if err := proto.CheckInitialized(m); err != nil {
+		if missing := p.missingRequired(m.ProtoReflect(), doc); len(missing) > 0 {
+			return missing[0]
+		}
+		return &Error{Category: CategoryMissingRequired, Err: err}
+	}
+	return nil
+}
+
+// withField prefixes the path of err with the given document key.
+func withField(err error, name string) error {
+	return withPath(err, name)
+}
+
+// withIndex prefixes the path of err with the given list index.
+func withIndex(err error, i int) error {
+	return withPath(err, indexSegment(i))
+}
+
+// withMapKey prefixes the path of err with the given map key. Keys of string
+// maps are quoted.
+func withMapKey(err error, key string, kind pref.Kind) error {
+	return withPath(err, mapKeySegment(key, kind))
+}
+
+// indexSegment returns the path segment of a list index.
+func indexSegment(i int) string {
+	return "[" + strconv.Itoa(i) + "]"
+}
+
+// mapKeySegment returns the path segment of a map key.
+func mapKeySegment(key string, kind pref.Kind) string {
+	if kind == pref.StringKind {
+		key = strconv.Quote(key)
+	}
+	return "[" + key + "]"
+}
+
+// joinPath appends a document key, index or map key segment to path.
+func joinPath(path, segment string) string {
+	switch {
+	case path == "":
+		return segment
+	case segment == "":
+		return path
+	case strings.HasPrefix(segment, "["):
+		return path + segment
+	}
+	return path + "." + segment
+}
+
+func withPath(err error, segment string) error {
+	if err == nil {
+		return nil
+	}
+	if errs, ok := err.(Errors); ok {
+		prefixed := make(Errors, len(errs))
+		for i, e := range errs {
+			prefixed[i] = withPath(e, segment).(*Error)
+		}
+		return prefixed
+	}
+	e, ok := err.(*Error)
+	if !ok {
+		return &Error{Path: segment, Category: CategoryOther, Err: err}
+	}
+	prefixed := *e
+	prefixed.Path = joinPath(segment, e.Path)
+	return &prefixed
+}
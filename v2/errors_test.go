@@ -0,0 +1,208 @@
+package bsonpb
+
+import (
+	"errors"
+	"testing"
+
+	pb2 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb2_proto"
+	pb3 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb3_proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"google.golang.org/protobuf/proto"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestUnmarshalError(t *testing.T) {
+	tests := []struct {
+		desc         string
+		inputMessage proto.Message
+		inputBson    interface{}
+		wantPath     string
+		wantCategory ErrorCategory
+		wantKind     pref.Kind
+		wantBSONType bsontype.Type
+	}{{
+		desc:         "type mismatch in repeated nested message",
+		inputMessage: &pb2.Nests{},
+		inputBson: bson.D{
+			{Key: "rptNested", Value: bson.A{
+				bson.D{},
+				bson.D{{Key: "optNested", Value: bson.D{{Key: "optString", Value: 5}}}},
+			}},
+		},
+		wantPath:     "rptNested[1].optNested.optString",
+		wantCategory: CategoryTypeMismatch,
+		wantKind:     pref.StringKind,
+		wantBSONType: bsontype.Int32,
+	}, {
+		desc:         "type mismatch in map value",
+		inputMessage: &pb3.Maps{},
+		inputBson: bson.D{
+			{Key: "strToNested", Value: bson.D{
+				{Key: "x", Value: bson.D{{Key: "sNested", Value: bson.D{{Key: "sString", Value: true}}}}},
+			}},
+		},
+		wantPath:     `strToNested["x"].sNested.sString`,
+		wantCategory: CategoryTypeMismatch,
+		wantKind:     pref.StringKind,
+		wantBSONType: bsontype.Boolean,
+	}, {
+		desc:         "invalid map key",
+		inputMessage: &pb3.Maps{},
+		inputBson: bson.D{
+			{Key: "int32ToStr", Value: bson.D{{Key: "x", Value: "y"}}},
+		},
+		wantPath:     "int32ToStr[x]",
+		wantCategory: CategoryInvalidValue,
+		wantKind:     pref.Int32Kind,
+		wantBSONType: bsontype.String,
+	}, {
+		desc:         "value out of range",
+		inputMessage: &pb3.Scalars{},
+		inputBson:    bson.D{{Key: "sInt32", Value: int64(5000000000)}},
+		wantPath:     "sInt32",
+		wantCategory: CategoryInvalidValue,
+		wantKind:     pref.Int32Kind,
+		wantBSONType: bsontype.Int64,
+	}, {
+		desc:         "repeated scalar",
+		inputMessage: &pb3.Repeats{},
+		inputBson:    bson.D{{Key: "rptBool", Value: bson.A{true, "false"}}},
+		wantPath:     "rptBool[1]",
+		wantCategory: CategoryTypeMismatch,
+		wantKind:     pref.BoolKind,
+		wantBSONType: bsontype.String,
+	}, {
+		desc:         "unknown nested field",
+		inputMessage: &pb2.Nests{},
+		inputBson: bson.D{
+			{Key: "optNested", Value: bson.D{{Key: "foo", Value: 1}}},
+		},
+		wantPath:     "optNested.foo",
+		wantCategory: CategoryUnknownField,
+	}, {
+		desc:         "oneof conflict",
+		inputMessage: &pb3.Oneofs{},
+		inputBson: bson.D{
+			{Key: "oneofEnum", Value: "ONE"},
+			{Key: "oneofString", Value: "two"},
+		},
+		wantPath:     "oneofString",
+		wantCategory: CategoryOneofConflict,
+	}, {
+		desc:         "message is not a document",
+		inputMessage: &pb2.Nests{},
+		inputBson:    bson.D{{Key: "optNested", Value: "nested"}},
+		wantPath:     "optNested",
+		wantCategory: CategoryTypeMismatch,
+		wantKind:     pref.MessageKind,
+		wantBSONType: bsontype.String,
+	}, {
+		desc:         "missing required field",
+		inputMessage: &pb2.PartialRequired{},
+		inputBson:    bson.D{},
+		wantPath:     "reqString",
+		wantCategory: CategoryMissingRequired,
+	}, {
+		desc:         "missing required field in map value",
+		inputMessage: &pb2.IndirectRequired{},
+		inputBson: bson.D{
+			{Key: "strToNested", Value: bson.D{{Key: "fail", Value: bson.D{}}}},
+		},
+		wantPath:     `strToNested["fail"].reqString`,
+		wantCategory: CategoryMissingRequired,
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			err := Unmarshal(tt.inputBson, tt.inputMessage)
+			var e *Error
+			if !errors.As(err, &e) {
+				t.Fatalf("Unmarshal() got error %v (%T), want *Error", err, err)
+			}
+			if e.Path != tt.wantPath {
+				t.Errorf("Unmarshal() error path got %q, want %q", e.Path, tt.wantPath)
+			}
+			if e.Category != tt.wantCategory {
+				t.Errorf("Unmarshal() error category got %v, want %v", e.Category, tt.wantCategory)
+			}
+			if e.Kind != tt.wantKind {
+				t.Errorf("Unmarshal() error kind got %v, want %v", e.Kind, tt.wantKind)
+			}
+			if e.BSONType != tt.wantBSONType {
+				t.Errorf("Unmarshal() error BSON type got %v, want %v", e.BSONType, tt.wantBSONType)
+			}
+		})
+	}
+}
+
+func TestMarshalError(t *testing.T) {
+	tests := []struct {
+		desc         string
+		input        proto.Message
+		wantPath     string
+		wantCategory ErrorCategory
+		wantKind     pref.Kind
+	}{{
+		desc: "invalid UTF-8 in nested message",
+		input: &pb3.Nests{
+			SNested: &pb3.Nested{SNested: &pb3.Nested{SString: "abc\xff"}},
+		},
+		wantPath:     "sNested.sNested.sString",
+		wantCategory: CategoryInvalidUTF8,
+		wantKind:     pref.StringKind,
+	}, {
+		desc: "invalid UTF-8 in map value",
+		input: &pb3.Maps{
+			Int32ToStr: map[int32]string{1: "abc\xff"},
+		},
+		wantPath:     "int32ToStr[1]",
+		wantCategory: CategoryInvalidUTF8,
+		wantKind:     pref.StringKind,
+	}, {
+		desc: "invalid UTF-8 in list",
+		input: &pb3.Repeats{
+			RptString: []string{"ok", "abc\xff"},
+		},
+		wantPath:     "rptString[1]",
+		wantCategory: CategoryInvalidUTF8,
+		wantKind:     pref.StringKind,
+	}, {
+		desc:         "missing required field",
+		input:        &pb2.PartialRequired{},
+		wantPath:     "reqString",
+		wantCategory: CategoryMissingRequired,
+	}, {
+		desc: "missing required field in repeated message",
+		input: &pb2.IndirectRequired{
+			RptNested: []*pb2.NestedWithRequired{
+				{ReqString: proto.String("one")},
+				{},
+			},
+		},
+		wantPath:     "rptNested[1].reqString",
+		wantCategory: CategoryMissingRequired,
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			_, err := MarshalOptions{}.Marshal(tt.input)
+			var e *Error
+			if !errors.As(err, &e) {
+				t.Fatalf("Marshal() got error %v (%T), want *Error", err, err)
+			}
+			if e.Path != tt.wantPath {
+				t.Errorf("Marshal() error path got %q, want %q", e.Path, tt.wantPath)
+			}
+			if e.Category != tt.wantCategory {
+				t.Errorf("Marshal() error category got %v, want %v", e.Category, tt.wantCategory)
+			}
+			if e.Kind != tt.wantKind {
+				t.Errorf("Marshal() error kind got %v, want %v", e.Kind, tt.wantKind)
+			}
+		})
+	}
+}
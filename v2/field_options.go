@@ -0,0 +1,94 @@
+package bsonpb
+
+import (
+	"github.com/romnn/bsonpb/v2/options"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// debugRedactFieldNumber is the number of the debug_redact field option,
+// which is newer than the descriptorpb package this module depends on, so it
+// may be an unknown field.
+const debugRedactFieldNumber protowire.Number = 16
+
+// fieldOptions returns the options of fd or nil if it has none.
+func fieldOptions(fd pref.FieldDescriptor) *descriptorpb.FieldOptions {
+	opts, _ := fd.Options().(*descriptorpb.FieldOptions)
+	return opts
+}
+
+// boolFieldOption reports whether the bool extension xt is set to true in
+// the options of fd.
+func boolFieldOption(fd pref.FieldDescriptor, xt pref.ExtensionType) bool {
+	opts := fieldOptions(fd)
+	if opts == nil {
+		return false
+	}
+	v, ok := proto.GetExtension(opts, xt).(bool)
+	return ok && v
+}
+
+// stringFieldOption returns the value of the string extension xt in the
+// options of fd.
+func stringFieldOption(fd pref.FieldDescriptor, xt pref.ExtensionType) string {
+	opts := fieldOptions(fd)
+	if opts == nil {
+		return ""
+	}
+	v, _ := proto.GetExtension(opts, xt).(string)
+	return v
+}
+
+// uint32FieldOption returns the value of the uint32 extension xt in the
+// options of fd and whether it is set.
+func uint32FieldOption(fd pref.FieldDescriptor, xt pref.ExtensionType) (uint32, bool) {
+	opts := fieldOptions(fd)
+	if opts == nil || !proto.HasExtension(opts, xt) {
+		return 0, false
+	}
+	v, ok := proto.GetExtension(opts, xt).(uint32)
+	return v, ok
+}
+
+// isSensitive reports whether the field is marked for redaction.
+func isSensitive(fd pref.FieldDescriptor) bool {
+	if boolFieldOption(fd, options.E_Sensitive) {
+		return true
+	}
+	opts := fieldOptions(fd)
+	return opts != nil && debugRedact(opts.ProtoReflect())
+}
+
+// debugRedact reports whether the debug_redact option is set in the field
+// options opts. It is a known field if the options message declares it and
+// an unknown field otherwise.
+func debugRedact(opts pref.Message) bool {
+	if fd := opts.Descriptor().Fields().ByNumber(debugRedactFieldNumber); fd != nil {
+		return fd.Kind() == pref.BoolKind && opts.Get(fd).Bool()
+	}
+	b := opts.GetUnknown()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return false
+		}
+		b = b[n:]
+		if num == debugRedactFieldNumber && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(b)
+			return n > 0 && v != 0
+		}
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return false
+		}
+		b = b[n:]
+	}
+	return false
+}
+
+// isEncrypted reports whether the field is marked for encryption.
+func isEncrypted(fd pref.FieldDescriptor) bool {
+	return boolFieldOption(fd, options.E_Encrypted)
+}
@@ -0,0 +1,187 @@
+package bsonpb
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/proto"
+)
+
+// Format returns a multiline rendering of m in the style of the mongo shell.
+// It is intended for humans, e.g. in logs and test failures, and its output
+// is not stable.
+func Format(m proto.Message) string {
+	return MarshalOptions{Multiline: true}.Format(m)
+}
+
+// Format returns a rendering of m in the style of the mongo shell that honors
+// Multiline and Indent. BSON types that JSON can not express are shown
+// explicitly, e.g. ISODate(...), BinData(...) and NumberLong(...). Missing
+// required fields are ignored and the error is shown as "<error: ...>" if m
+// can not be marshaled. The output is not stable.
+func (o MarshalOptions) Format(m proto.Message) string {
+	if m == nil || !m.ProtoReflect().IsValid() {
+		return "<nil>"
+	}
+	o.AllowPartial = true
+	o.MaxDocumentSize = 0
+	if o.Indent != "" {
+		o.Multiline = true
+	}
+	if o.Multiline && o.Indent == "" {
+		o.Indent = defaultIndent
+	}
+	result, err := o.marshal(m)
+	if err != nil {
+		return "<error: " + err.Error() + ">"
+	}
+	f := formatter{indent: o.Indent}
+	f.value(result, 0)
+	return f.b.String()
+}
+
+type formatter struct {
+	b strings.Builder
+
+	// indent is the indentation per level. It is empty for single line output.
+	indent string
+}
+
+func (f *formatter) newline(depth int) {
+	if f.indent == "" {
+		f.b.WriteString(" ")
+		return
+	}
+	f.b.WriteString("\n")
+	f.b.WriteString(strings.Repeat(f.indent, depth))
+}
+
+func (f *formatter) document(doc bson.D, depth int) {
+	if len(doc) == 0 {
+		f.b.WriteString("{}")
+		return
+	}
+	f.b.WriteString("{")
+	for i, elem := range doc {
+		if i > 0 {
+			f.b.WriteString(",")
+		}
+		f.newline(depth + 1)
+		f.b.WriteString(strconv.Quote(elem.Key))
+		f.b.WriteString(": ")
+		f.value(elem.Value, depth+1)
+	}
+	f.newline(depth)
+	f.b.WriteString("}")
+}
+
+func (f *formatter) array(arr bson.A, depth int) {
+	if len(arr) == 0 {
+		f.b.WriteString("[]")
+		return
+	}
+	f.b.WriteString("[")
+	for i, v := range arr {
+		if i > 0 {
+			f.b.WriteString(",")
+		}
+		f.newline(depth + 1)
+		f.value(v, depth+1)
+	}
+	f.newline(depth)
+	f.b.WriteString("]")
+}
+
+func (f *formatter) value(v interface{}, depth int) {
+	switch v := v.(type) {
+	case bson.D:
+		f.document(v, depth)
+		return
+	case bson.A:
+		f.array(v, depth)
+		return
+	case primitive.Binary:
+		if v.Subtype == bsontype.BinaryUUID && len(v.Data) == uuidLen {
+			fmt.Fprintf(&f.b, "UUID(%q)", formatUUID(v.Data))
+			return
+		}
+		fmt.Fprintf(&f.b, "BinData(%d, %q)", v.Subtype, base64.StdEncoding.EncodeToString(v.Data))
+		return
+	case primitive.DateTime:
+		fmt.Fprintf(&f.b, "ISODate(%q)", v.Time().UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+		return
+	case time.Time:
+		fmt.Fprintf(&f.b, "ISODate(%q)", v.UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+		return
+	case primitive.ObjectID:
+		fmt.Fprintf(&f.b, "ObjectId(%q)", v.Hex())
+		return
+	case primitive.Timestamp:
+		fmt.Fprintf(&f.b, "Timestamp(%d, %d)", v.T, v.I)
+		return
+	case primitive.Decimal128:
+		fmt.Fprintf(&f.b, "NumberDecimal(%q)", v.String())
+		return
+	case primitive.Regex:
+		fmt.Fprintf(&f.b, "/%s/%s", v.Pattern, v.Options)
+		return
+	}
+
+	rv := reflect.ValueOf(v)
+	switch bsonTypeOf(v) {
+	case bsontype.Null:
+		f.b.WriteString("null")
+	case bsontype.Undefined:
+		f.b.WriteString("undefined")
+	case bsontype.MinKey:
+		f.b.WriteString("MinKey")
+	case bsontype.MaxKey:
+		f.b.WriteString("MaxKey")
+	case bsontype.String:
+		f.b.WriteString(strconv.Quote(rv.String()))
+	case bsontype.Boolean:
+		f.b.WriteString(strconv.FormatBool(rv.Bool()))
+	case bsontype.Int32:
+		f.b.WriteString(formatInt(rv))
+	case bsontype.Int64:
+		fmt.Fprintf(&f.b, "NumberLong(%s)", formatInt(rv))
+	case bsontype.Double:
+		f.b.WriteString(formatDouble(rv.Float(), rv.Type().Bits()))
+	default:
+		fmt.Fprintf(&f.b, "%v", v)
+	}
+}
+
+func formatInt(rv reflect.Value) string {
+	switch rv.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(rv.Uint(), 10)
+	}
+	return strconv.FormatInt(rv.Int(), 10)
+}
+
+// formatDouble always renders a decimal point or exponent so that doubles
+// can be told apart from integers.
+func formatDouble(v float64, bitSize int) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "Infinity"
+	case math.IsInf(v, -1):
+		return "-Infinity"
+	}
+	s := strconv.FormatFloat(v, 'g', -1, bitSize)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
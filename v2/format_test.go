@@ -0,0 +1,112 @@
+package bsonpb
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	pb2 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb2_proto"
+	pb3 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb3_proto"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		desc  string
+		mo    MarshalOptions
+		input proto.Message
+		want  string
+	}{{
+		desc:  "nil message",
+		input: nil,
+		want:  "<nil>",
+	}, {
+		desc:  "empty message",
+		input: &pb3.Scalars{},
+		want:  "{}",
+	}, {
+		desc: "single line",
+		input: &pb3.Scalars{
+			SBool:   true,
+			SInt32:  -1,
+			SInt64:  2,
+			SUint32: 3,
+			SFloat:  1.1,
+			SDouble: 2,
+			SBytes:  []byte("bytes"),
+			SString: "a \"quoted\" string",
+		},
+		want: `{ "sBool": true, "sInt32": -1, "sInt64": NumberLong(2), "sUint32": NumberLong(3), "sFloat": 1.1, "sDouble": 2.0, "sBytes": BinData(0, "Ynl0ZXM="), "sString": "a \"quoted\" string" }`,
+	}, {
+		desc:  "special doubles",
+		input: &pb2.Repeats{RptDouble: []float64{math.NaN(), math.Inf(1), math.Inf(-1), 1e300}},
+		want:  `{ "rptDouble": [ NaN, Infinity, -Infinity, 1e+300 ] }`,
+	}, {
+		desc:  "uuid",
+		input: &pb2.BinaryFields{Id: proto.String("123e4567-e89b-12d3-a456-426614174000"), Blob: []byte("b")},
+		want:  `{ "blob": BinData(128, "Yg=="), "id": UUID("123e4567-e89b-12d3-a456-426614174000") }`,
+	}, {
+		desc: "multiline",
+		mo:   MarshalOptions{Multiline: true},
+		input: &pb2.Nests{
+			OptNested: &pb2.Nested{OptString: proto.String("nested")},
+			RptNested: []*pb2.Nested{{}, {OptString: proto.String("second")}},
+		},
+		want: `{
+  "optNested": {
+    "optString": "nested"
+  },
+  "rptNested": [
+    {},
+    {
+      "optString": "second"
+    }
+  ]
+}`,
+	}, {
+		desc: "indent implies multiline",
+		mo:   MarshalOptions{Indent: "\t"},
+		input: &pb2.KnownTypes{
+			OptTimestamp: timestamppb.New(time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC)),
+			OptInt64:     wrapperspb.Int64(7),
+		},
+		want: `{
+	"optInt64": NumberLong(7),
+	"optTimestamp": ISODate("2020-01-02T03:04:05.006Z")
+}`,
+	}, {
+		desc:  "missing required fields are ignored",
+		input: &pb2.PartialRequired{OptString: proto.String("x")},
+		want:  `{ "optString": "x" }`,
+	}, {
+		desc:  "well-known type at the top level",
+		input: timestamppb.New(time.Unix(0, 0)),
+		want:  `ISODate("1970-01-01T00:00:00.000Z")`,
+	}, {
+		desc:  "invalid message",
+		input: &pb3.Scalars{SString: "abc\xff"},
+		want:  "<error: sString: InvalidUTF8: abc\xff>",
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			got := tt.mo.Format(tt.input)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Format() diff -want +got\n%v\n", diff)
+			}
+		})
+	}
+}
+
+func TestFormatDefaultsToMultiline(t *testing.T) {
+	got := Format(&pb3.Nested{SString: "x"})
+	want := "{\n  \"sString\": \"x\"\n}"
+	if got != want {
+		t.Errorf("Format() got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,107 @@
+//go:build go1.18
+// +build go1.18
+
+package bsonpb
+
+import (
+	"testing"
+	"time"
+
+	pb2 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb2_proto"
+	pb3 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb3_proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// fuzzMessages lists the message types every fuzz input is decoded into.
+var fuzzMessages = []proto.Message{
+	&pb2.Scalars{},
+	&pb2.Enums{},
+	&pb2.Repeats{},
+	&pb2.Maps{},
+	&pb2.Nests{},
+	&pb2.Requireds{},
+	&pb2.IndirectRequired{},
+	&pb2.Extensions{},
+	&pb2.KnownTypes{},
+	&pb3.Scalars{},
+	&pb3.Repeats{},
+	&pb3.Enums{},
+	&pb3.Nests{},
+	&pb3.Oneofs{},
+	&pb3.Maps{},
+	&pb3.JSONNames{},
+}
+
+// fuzzOptions lists the decoder configurations every fuzz input is decoded with.
+var fuzzOptions = []UnmarshalOptions{
+	{},
+	{AllErrors: true},
+	{AllowPartial: true, DiscardUnknown: true},
+	{Strict: true},
+	{Coerce: CoercionPolicy{IntegralDoubles: true, NumericStrings: true, NumbersToStrings: true, IntsToBools: true}},
+	{RecursionLimit: 5, MaxElements: 100, MaxBytes: 100},
+}
+
+func fuzzSeeds(t testing.TB) [][]byte {
+	anyNested, err := anypb.New(&pb2.Nested{OptString: proto.String("embedded")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeds := []proto.Message{
+		&pb2.Scalars{OptBool: proto.Bool(true), OptInt32: proto.Int32(-1), OptUint64: proto.Uint64(1), OptFloat: proto.Float32(1.5), OptBytes: []byte("b"), OptString: proto.String("s")},
+		&pb2.Enums{OptEnum: pb2.Enum_TEN.Enum(), RptEnum: []pb2.Enum{pb2.Enum_ONE}},
+		&pb2.Repeats{RptBool: []bool{true}, RptInt64: []int64{1, 2}, RptString: []string{"a"}},
+		&pb2.Nests{OptNested: &pb2.Nested{OptNested: &pb2.Nested{OptString: proto.String("x")}}, RptNested: []*pb2.Nested{{}}},
+		&pb2.IndirectRequired{StrToNested: map[string]*pb2.NestedWithRequired{"a": {}}},
+		&pb2.KnownTypes{
+			OptBool:      wrapperspb.Bool(true),
+			OptTimestamp: timestamppb.New(time.Unix(1, 0)),
+			OptDuration:  durationpb.New(time.Second),
+			OptStruct:    &structpb.Struct{Fields: map[string]*structpb.Value{"n": structpb.NewNullValue(), "l": structpb.NewListValue(&structpb.ListValue{})}},
+			OptAny:       anyNested,
+		},
+		&pb3.Maps{Int32ToStr: map[int32]string{1: "a"}, BoolToUint32: map[bool]uint32{true: 1}, StrToNested: map[string]*pb3.Nested{"x": {}}},
+		&pb3.Oneofs{Union: &pb3.Oneofs_OneofNested{OneofNested: &pb3.Nested{SString: "x"}}},
+	}
+	var out [][]byte
+	for _, m := range seeds {
+		doc, err := MarshalOptions{AllowPartial: true}.Marshal(m)
+		if err != nil {
+			t.Fatalf("Marshal(%T) got error: %v", m, err)
+		}
+		b, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatalf("bson.Marshal(%T) got error: %v", m, err)
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// FuzzUnmarshalBytes checks that decoding arbitrary documents never panics
+// and that whatever is decoded can be encoded again.
+func FuzzUnmarshalBytes(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		for _, opts := range fuzzOptions {
+			for _, m := range fuzzMessages {
+				m := m.ProtoReflect().New().Interface()
+				if err := opts.UnmarshalBytes(b, m); err != nil {
+					continue
+				}
+				if _, err := (MarshalOptions{AllowPartial: true}).Marshal(m); err != nil {
+					t.Errorf("Marshal(%T) after successful Unmarshal got error: %v", m, err)
+				}
+			}
+		}
+	})
+}
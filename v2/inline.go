@@ -0,0 +1,226 @@
+package bsonpb
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/romnn/bsonpb/v2/options"
+	"go.mongodb.org/mongo-driver/bson"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// inlineAnalysis describes the inline fields of a message.
+type inlineAnalysis struct {
+	// fields are the inline fields of the message.
+	fields map[pref.FieldDescriptor]bool
+	// keys maps the document keys of inlined messages, including those of
+	// nested inlined messages, to the inline field of the message.
+	keys map[string]pref.FieldDescriptor
+}
+
+// isInline reports whether fd is an inline field of the analyzed message.
+func (a *inlineAnalysis) isInline(fd pref.FieldDescriptor) bool {
+	return a != nil && a.fields[fd]
+}
+
+// field returns the inline field whose message has the document key or nil.
+func (a *inlineAnalysis) field(key string) pref.FieldDescriptor {
+	if a == nil {
+		return nil
+	}
+	return a.keys[key]
+}
+
+// unknownFieldsField returns the inline field whose message, or a message
+// inlined by it, has its unknown fields stored under the document key or nil.
+func (a *inlineAnalysis) unknownFieldsField(unknownKey, key string) pref.FieldDescriptor {
+	if a == nil || unknownKey == "" {
+		return nil
+	}
+	for fd := range a.fields {
+		prefix := inlineUnknownFieldsKey(unknownKey, fd)
+		if key == prefix || strings.HasPrefix(key, prefix+".") {
+			return fd
+		}
+	}
+	return nil
+}
+
+// inlineUnknownFieldsKey returns the key under which the unknown fields of
+// the message inlined by fd are stored, e.g. "_unknown.audit", given the key
+// of the containing message.
+func inlineUnknownFieldsKey(key string, fd pref.FieldDescriptor) string {
+	if key == "" {
+		return ""
+	}
+	return key + "." + string(fd.Name())
+}
+
+// analyzeInline returns the inline fields of md or nil if it has none.
+// Conflicting keys are reported once per message descriptor.
+func analyzeInline(md pref.MessageDescriptor) (*inlineAnalysis, error) {
+	v, err := analyses.load(analysisInline, md, func() (interface{}, error) {
+		keys, err := messageKeySet(md)
+		if err != nil || len(keys.inline) == 0 {
+			return nil, err
+		}
+		a := &inlineAnalysis{fields: keys.inline, keys: make(map[string]pref.FieldDescriptor)}
+		for key, src := range keys.sources {
+			if fd, ok := src.(pref.FieldDescriptor); ok && keys.inline[fd] {
+				a.keys[key] = fd
+			}
+		}
+		return a, nil
+	})
+	a, _ := v.(*inlineAnalysis)
+	return a, err
+}
+
+// messageKeySet returns the keys of md as computed by messageKeys.
+func messageKeySet(md pref.MessageDescriptor) (documentKeys, error) {
+	v, err := analyses.load(analysisKeys, md, func() (interface{}, error) {
+		return messageKeys(md, map[pref.FullName]bool{})
+	})
+	keys, _ := v.(documentKeys)
+	return keys, err
+}
+
+// documentKeys are the keys a message may be encoded with.
+type documentKeys struct {
+	// sources maps every key to the field or oneof of the message it
+	// belongs to. Keys of inlined messages belong to the inline field.
+	sources map[string]pref.Descriptor
+	inline  map[pref.FieldDescriptor]bool
+}
+
+// add records the key of src and reports a conflict with the key of another
+// field or oneof if either of them is inlined.
+func (k documentKeys) add(key string, src pref.Descriptor) error {
+	prev, ok := k.sources[key]
+	if !ok || prev == src {
+		k.sources[key] = src
+		return nil
+	}
+	prevFd, _ := prev.(pref.FieldDescriptor)
+	srcFd, _ := src.(pref.FieldDescriptor)
+	if k.inline[prevFd] || k.inline[srcFd] {
+		return newError(CategoryUnsupported, "key %q of %v conflicts with %v", key, src.FullName(), prev.FullName())
+	}
+	return nil
+}
+
+// messageKeys returns the keys of md with either JSON or proto names,
+// including the keys of inlined messages. The names of inline fields are not
+// keys themselves.
+func messageKeys(md pref.MessageDescriptor, visiting map[pref.FullName]bool) (documentKeys, error) {
+	keys := documentKeys{sources: make(map[string]pref.Descriptor), inline: make(map[pref.FieldDescriptor]bool)}
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if boolFieldOption(fd, options.E_Inline) {
+			if err := checkInlineField(fd, visiting); err != nil {
+				return keys, err
+			}
+			keys.inline[fd] = true
+		}
+	}
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if keys.inline[fd] {
+			continue
+		}
+		if err := keys.add(fd.JSONName(), fd); err != nil {
+			return keys, err
+		}
+		name := string(fd.Name())
+		if fd.Kind() == pref.GroupKind {
+			name = string(fd.Message().Name())
+		}
+		if err := keys.add(name, fd); err != nil {
+			return keys, err
+		}
+	}
+	oneofs := md.Oneofs()
+	for i := 0; i < oneofs.Len(); i++ {
+		od := oneofs.Get(i)
+		if od.IsSynthetic() {
+			continue
+		}
+		for _, key := range []string{
+			oneofKey(od, false), oneofKey(od, true),
+			oneofDiscriminatorKey(od, false), oneofDiscriminatorKey(od, true),
+		} {
+			if err := keys.add(key, od); err != nil {
+				return keys, err
+			}
+		}
+	}
+
+	visiting[md.FullName()] = true
+	defer delete(visiting, md.FullName())
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if !keys.inline[fd] {
+			continue
+		}
+		sub, err := messageKeys(fd.Message(), visiting)
+		if err != nil {
+			return keys, err
+		}
+		subKeys := make([]string, 0, len(sub.sources))
+		for key := range sub.sources {
+			subKeys = append(subKeys, key)
+		}
+		sort.Strings(subKeys)
+		for _, key := range subKeys {
+			if err := keys.add(key, fd); err != nil {
+				return keys, err
+			}
+		}
+	}
+	return keys, nil
+}
+
+// checkInlineField reports whether the message of fd can be inlined.
+func checkInlineField(fd pref.FieldDescriptor, visiting map[pref.FullName]bool) error {
+	if fd.Kind() != pref.MessageKind || fd.IsList() || fd.IsMap() {
+		return newError(CategoryUnsupported, "inline field %v must be a singular message", fd.FullName())
+	}
+	if od := fd.ContainingOneof(); od != nil && !od.IsSynthetic() {
+		return newError(CategoryUnsupported, "inline field %v can not be part of a oneof", fd.FullName())
+	}
+	if isSensitive(fd) || isEncrypted(fd) || boolFieldOption(fd, options.E_CatchAll) {
+		return newError(CategoryUnsupported, "inline field %v can not be sensitive, encrypted or catch-all", fd.FullName())
+	}
+	md := fd.Message()
+	if wellKnownTypeMarshaler(md.FullName()) != nil {
+		return newError(CategoryUnsupported, "inline field %v can not be a well-known type", fd.FullName())
+	}
+	if md.ExtensionRanges().Len() > 0 {
+		return newError(CategoryUnsupported, "inline field %v can not be an extendable message", fd.FullName())
+	}
+	if visiting[md.FullName()] || md.FullName() == fd.ContainingMessage().FullName() {
+		return newError(CategoryUnsupported, "inline field %v inlines its own message", fd.FullName())
+	}
+	if catchAll, err := catchAllField(md); err != nil || catchAll != nil {
+		return newError(CategoryUnsupported, "inline field %v can not have a catch-all field", fd.FullName())
+	}
+	return nil
+}
+
+// inlinedFields are the document keys of an inlined message.
+type inlinedFields struct {
+	fd  pref.FieldDescriptor
+	doc bson.D
+}
+
+// addInlined adds the element of the inlined message of fd.
+func addInlined(inlined []inlinedFields, fd pref.FieldDescriptor, elem bson.E) []inlinedFields {
+	for i := range inlined {
+		if inlined[i].fd == fd {
+			inlined[i].doc = append(inlined[i].doc, elem)
+			return inlined
+		}
+	}
+	return append(inlined, inlinedFields{fd: fd, doc: bson.D{elem}})
+}
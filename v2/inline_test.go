@@ -0,0 +1,241 @@
+package bsonpb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	pb2 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb2_proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/testing/protopack"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestInline(t *testing.T) {
+	tests := []struct {
+		desc  string
+		mo    MarshalOptions
+		input proto.Message
+		want  bson.D
+		// wantDecoded is the decoded message if it differs from input.
+		wantDecoded proto.Message
+	}{{
+		desc: "inlined fields",
+		input: &pb2.Inlined{
+			Name: proto.String("x"),
+			Audit: &pb2.Audit{
+				CreatedBy: proto.String("me"),
+				CreatedAt: proto.Int64(10),
+				Source:    &pb2.AuditSource{Host: proto.String("h")},
+			},
+		},
+		want: bson.D{
+			{Key: "name", Value: "x"},
+			{Key: "createdBy", Value: "me"},
+			{Key: "createdAt", Value: int64(10)},
+			{Key: "host", Value: "h"},
+		},
+	}, {
+		desc: "proto names and catch-all",
+		mo:   MarshalOptions{UseProtoNames: true, Deterministic: true, FieldOrder: OrderByName},
+		input: &pb2.Inlined{
+			Audit: &pb2.Audit{CreatedBy: proto.String("me")},
+			Extra: &structpb.Struct{Fields: map[string]*structpb.Value{"other": structpb.NewBoolValue(true)}},
+		},
+		want: bson.D{
+			{Key: "created_by", Value: "me"},
+			{Key: "other", Value: true},
+		},
+	}, {
+		desc:  "empty inlined message",
+		mo:    MarshalOptions{EmitUnpopulated: true},
+		input: &pb2.Inlined{Name: proto.String("x")},
+		want: bson.D{
+			{Key: "name", Value: "x"},
+		},
+	}, {
+		desc:        "empty inlined messages are not written",
+		input:       &pb2.Inlined{Name: proto.String("x"), Audit: &pb2.Audit{Source: &pb2.AuditSource{}}},
+		want:        bson.D{{Key: "name", Value: "x"}},
+		wantDecoded: &pb2.Inlined{Name: proto.String("x")},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := tt.mo.Marshal(tt.input)
+			if err != nil {
+				t.Fatalf("Marshal() got error: %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Marshal() diff -want +got\n%v\n", diff)
+			}
+			want := tt.wantDecoded
+			if want == nil {
+				want = tt.input
+			}
+			decoded := tt.input.ProtoReflect().New().Interface()
+			if err := Unmarshal(got, decoded); err != nil {
+				t.Fatalf("Unmarshal() got error: %v", err)
+			}
+			if !proto.Equal(decoded, want) {
+				t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", decoded, want)
+			}
+		})
+	}
+}
+
+func TestInlineUnknownFields(t *testing.T) {
+	raw := protopack.Message{
+		protopack.Tag{Number: 101, Type: protopack.VarintType}, protopack.Varint(7),
+	}.Marshal()
+	source := &pb2.AuditSource{Host: proto.String("h")}
+	source.ProtoReflect().SetUnknown(raw)
+	audit := &pb2.Audit{CreatedBy: proto.String("me"), Source: source}
+	audit.ProtoReflect().SetUnknown(raw)
+	input := &pb2.Inlined{Name: proto.String("x"), Audit: audit}
+	input.ProtoReflect().SetUnknown(raw)
+
+	got, err := MarshalOptions{UnknownFieldsKey: DefaultUnknownFieldsKey}.Marshal(input)
+	if err != nil {
+		t.Fatalf("Marshal() got error: %v", err)
+	}
+	want := bson.D{
+		{Key: "name", Value: "x"},
+		{Key: "createdBy", Value: "me"},
+		{Key: "host", Value: "h"},
+		{Key: "_unknown.audit.source", Value: primitive.Binary{Data: raw}},
+		{Key: "_unknown.audit", Value: primitive.Binary{Data: raw}},
+		{Key: "_unknown", Value: primitive.Binary{Data: raw}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Marshal() diff -want +got\n%v\n", diff)
+	}
+
+	decoded := &pb2.Inlined{}
+	if err := (UnmarshalOptions{UnknownFieldsKey: DefaultUnknownFieldsKey}).Unmarshal(got, decoded); err != nil {
+		t.Fatalf("Unmarshal() got error: %v", err)
+	}
+	if !proto.Equal(decoded, input) {
+		t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", decoded, input)
+	}
+}
+
+func TestUnmarshalInline(t *testing.T) {
+	tests := []struct {
+		desc        string
+		umo         UnmarshalOptions
+		inputBson   bson.D
+		wantMessage proto.Message
+		wantErr     string
+	}{{
+		desc: "mixed order",
+		inputBson: bson.D{
+			{Key: "host", Value: "h"},
+			{Key: "name", Value: "x"},
+			{Key: "created_by", Value: "me"},
+		},
+		wantMessage: &pb2.Inlined{
+			Name:  proto.String("x"),
+			Audit: &pb2.Audit{CreatedBy: proto.String("me"), Source: &pb2.AuditSource{Host: proto.String("h")}},
+		},
+	}, {
+		desc: "name of the inline field is captured",
+		inputBson: bson.D{
+			{Key: "audit", Value: bson.D{{Key: "createdBy", Value: "me"}}},
+		},
+		wantMessage: &pb2.Inlined{Extra: &structpb.Struct{Fields: map[string]*structpb.Value{
+			"audit": structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{"createdBy": structpb.NewStringValue("me")}}),
+		}}},
+	}, {
+		desc:        "masked out",
+		umo:         UnmarshalOptions{Mask: &fieldmaskpb.FieldMask{Paths: []string{"name", "audit.created_at"}}},
+		inputBson:   bson.D{{Key: "name", Value: "x"}, {Key: "createdBy", Value: "me"}, {Key: "createdAt", Value: int64(1)}},
+		wantMessage: &pb2.Inlined{Name: proto.String("x"), Audit: &pb2.Audit{CreatedAt: proto.Int64(1)}},
+	}, {
+		desc:      "elements are counted once",
+		umo:       UnmarshalOptions{MaxElements: 2},
+		inputBson: bson.D{{Key: "createdBy", Value: "me"}, {Key: "host", Value: "h"}},
+		wantMessage: &pb2.Inlined{
+			Audit: &pb2.Audit{CreatedBy: proto.String("me"), Source: &pb2.AuditSource{Host: proto.String("h")}},
+		},
+	}, {
+		desc:      "duplicate inlined field",
+		inputBson: bson.D{{Key: "createdBy", Value: "a"}, {Key: "created_by", Value: "b"}},
+		wantErr:   `created_by: duplicate field "created_by"`,
+	}, {
+		desc:      "invalid inlined value",
+		inputBson: bson.D{{Key: "createdAt", Value: "now"}},
+		wantErr:   "createdAt: invalid value for int64 type",
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			got := &pb2.Inlined{}
+			err := tt.umo.Unmarshal(tt.inputBson, got)
+			if err != nil {
+				if tt.wantErr == "" {
+					t.Errorf("Unmarshal() got unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Unmarshal() error got %q, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if tt.wantErr != "" {
+				t.Errorf("Unmarshal() got nil error, want error %q", tt.wantErr)
+			}
+			if !proto.Equal(got, tt.wantMessage) {
+				t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", got, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestInlineErrors(t *testing.T) {
+	tests := []struct {
+		desc    string
+		input   proto.Message
+		wantErr string
+	}{{
+		desc:    "conflicting key",
+		input:   &pb2.InlineConflict{},
+		wantErr: `key "createdBy" of textpb2_proto.InlineConflict.audit conflicts with textpb2_proto.InlineConflict.created_by`,
+	}, {
+		desc:    "repeated field",
+		input:   &pb2.InlineRepeated{},
+		wantErr: "inline field textpb2_proto.InlineRepeated.audits must be a singular message",
+	}, {
+		desc:    "cycle",
+		input:   &pb2.InlineCycle{},
+		wantErr: "inline field textpb2_proto.InlineCycle.self inlines its own message",
+	}, {
+		desc: "catch-all conflict",
+		input: &pb2.Inlined{
+			Audit: &pb2.Audit{CreatedBy: proto.String("me")},
+			Extra: &structpb.Struct{Fields: map[string]*structpb.Value{"createdBy": structpb.NewNullValue()}},
+		},
+		wantErr: `key "createdBy" of catch-all field textpb2_proto.Inlined.extra conflicts with a field`,
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			_, err := Marshal(tt.input)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Marshal() got error %v, want %q", err, tt.wantErr)
+			}
+			if _, ok := tt.input.(*pb2.Inlined); ok {
+				return
+			}
+			err = Unmarshal(bson.D{}, tt.input.ProtoReflect().New().Interface())
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Unmarshal() got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package bsonpb
+
+import (
+	"github.com/romnn/bsonpb/v2/options"
+	"go.mongodb.org/mongo-driver/bson"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// keyField returns the field of the elements of the repeated field fd named
+// by its (bsonpb.key_field) field option or nil if it has none.
+func keyField(fd pref.FieldDescriptor) (pref.FieldDescriptor, error) {
+	v, err := analyses.load(analysisKeyField, fd, func() (interface{}, error) {
+		return findKeyField(fd)
+	})
+	key, _ := v.(pref.FieldDescriptor)
+	return key, err
+}
+
+func findKeyField(fd pref.FieldDescriptor) (pref.FieldDescriptor, error) {
+	name := stringFieldOption(fd, options.E_KeyField)
+	if name == "" {
+		return nil, nil
+	}
+	if !fd.IsList() || fd.Message() == nil {
+		return nil, newError(CategoryUnsupported, "keyed field %v must be a repeated message", fd.FullName())
+	}
+	key := fd.Message().Fields().ByName(pref.Name(name))
+	switch {
+	case key == nil:
+		return nil, newError(CategoryUnsupported, "key field %q of %v does not exist", name, fd.FullName())
+	case key.Cardinality() == pref.Repeated || !isMapKeyKind(key.Kind()):
+		return nil, newError(CategoryUnsupported, "key field %v of %v must be a singular string, integer or bool field", key.FullName(), fd.FullName())
+	}
+	return key, nil
+}
+
+// isMapKeyKind reports whether fields of the kind can be map keys.
+func isMapKeyKind(kind pref.Kind) bool {
+	switch kind {
+	case pref.BoolKind, pref.StringKind,
+		pref.Int32Kind, pref.Sint32Kind, pref.Sfixed32Kind,
+		pref.Int64Kind, pref.Sint64Kind, pref.Sfixed64Kind,
+		pref.Uint32Kind, pref.Fixed32Kind,
+		pref.Uint64Kind, pref.Fixed64Kind:
+		return true
+	}
+	return false
+}
+
+// marshalKeyedList marshals the elements of the repeated message field fd as
+// a document keyed by the value of their key field, in list order.
+func (e encoder) marshalKeyedList(list pref.List, fd, key pref.FieldDescriptor) (interface{}, error) {
+	keys, err := elementKeys(list, key)
+	if err != nil {
+		return bson.D{}, err
+	}
+	result := bson.D{}
+	for i, k := range keys {
+		val, err := e.marshalSingular(list.Get(i), fd)
+		if err != nil {
+			return bson.D{}, withMapKey(err, k, key.Kind())
+		}
+		result = append(result, bson.E{Key: k, Value: val})
+	}
+	return result, nil
+}
+
+// elementKeys returns the keys of the elements of a keyed list, which must be
+// set and unique.
+func elementKeys(list pref.List, key pref.FieldDescriptor) ([]string, error) {
+	keys := make([]string, list.Len())
+	seen := make(map[interface{}]bool, list.Len())
+	for i := 0; i < list.Len(); i++ {
+		m := list.Get(i).Message()
+		if key.HasPresence() && !m.Has(key) {
+			return nil, withIndex(newError(CategoryMissingRequired, "key field %v is not set", key.FullName()), i)
+		}
+		k := m.Get(key).MapKey()
+		if seen[k.Interface()] {
+			return nil, withIndex(newError(CategoryDuplicateField, "duplicate key %v", k.String()), i)
+		}
+		seen[k.Interface()] = true
+		keys[i] = k.String()
+	}
+	return keys, nil
+}
+
+// unmarshalKeyedList unmarshals a document keyed by the key field of the
+// elements of the repeated message field fd. The key field of an element is
+// set from its key and must match it if present.
+func (d decoder) unmarshalKeyedList(doc bson.D, list pref.List, fd, key pref.FieldDescriptor) error {
+	var errs Errors
+	seen := make(map[interface{}]bool, len(doc))
+	for _, item := range doc {
+		name := item.Key
+		if err := d.countElement(); err != nil {
+			return withMapKey(err, name, key.Kind())
+		}
+		k, err := d.unmarshalMapKey(name, key)
+		if err != nil {
+			if err := d.collect(&errs, withMapKey(err, name, key.Kind())); err != nil {
+				return err
+			}
+			continue
+		}
+		if seen[k.Interface()] {
+			if err := d.collect(&errs, withMapKey(newError(CategoryDuplicateField, "duplicate key %v", name), name, key.Kind())); err != nil {
+				return err
+			}
+			continue
+		}
+		seen[k.Interface()] = true
+
+		val := list.NewElement()
+		m := val.Message()
+		if err := d.unmarshalMessage(item.Value, m, false); err != nil {
+			if err := d.collect(&errs, withMapKey(err, name, key.Kind())); err != nil {
+				return err
+			}
+			if !isPartial(err) {
+				continue
+			}
+		}
+		if m.Has(key) && m.Get(key).MapKey().Interface() != k.Interface() {
+			err := newError(CategoryInvalidValue, "key field %v is %v, want %v", key.FullName(), m.Get(key).MapKey().String(), name)
+			if err := d.collect(&errs, withMapKey(err, name, key.Kind())); err != nil {
+				return err
+			}
+			continue
+		}
+		m.Set(key, k.Value())
+		list.Append(val)
+	}
+	return errs.err()
+}
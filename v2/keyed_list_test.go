@@ -0,0 +1,204 @@
+package bsonpb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	pb2 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb2_proto"
+	pb3 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb3_proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestKeyedList(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input proto.Message
+		want  bson.D
+	}{{
+		desc: "string keys",
+		input: &pb2.Cart{Items: []*pb2.Item{
+			{Sku: proto.String("b"), Qty: proto.Int32(2)},
+			{Sku: proto.String("a")},
+		}},
+		want: bson.D{{Key: "items", Value: bson.D{
+			{Key: "b", Value: bson.D{{Key: "sku", Value: "b"}, {Key: "qty", Value: int32(2)}}},
+			{Key: "a", Value: bson.D{{Key: "sku", Value: "a"}}},
+		}}},
+	}, {
+		desc: "integer keys",
+		input: &pb2.Cart{Slots: []*pb2.Slot{
+			{Position: proto.Int64(-1), Label: proto.String("x")},
+			{Position: proto.Int64(0)},
+		}},
+		want: bson.D{{Key: "slots", Value: bson.D{
+			{Key: "-1", Value: bson.D{{Key: "position", Value: int64(-1)}, {Key: "label", Value: "x"}}},
+			{Key: "0", Value: bson.D{{Key: "position", Value: int64(0)}}},
+		}}},
+	}, {
+		desc: "zero keys with implicit presence",
+		input: &pb3.Inventory{
+			Items: []*pb3.KeyedItem{{Qty: 1}, {Sku: "a"}},
+			Slots: []*pb3.KeyedSlot{{Label: "first"}},
+		},
+		want: bson.D{
+			{Key: "items", Value: bson.D{
+				{Key: "", Value: bson.D{{Key: "qty", Value: int32(1)}}},
+				{Key: "a", Value: bson.D{{Key: "sku", Value: "a"}}},
+			}},
+			{Key: "slots", Value: bson.D{
+				{Key: "0", Value: bson.D{{Key: "label", Value: "first"}}},
+			}},
+		},
+	}, {
+		desc:  "empty list",
+		input: &pb2.Cart{},
+		want:  bson.D{},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := Marshal(tt.input)
+			if err != nil {
+				t.Fatalf("Marshal() got error: %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Marshal() diff -want +got\n%v\n", diff)
+			}
+
+			decoded := tt.input.ProtoReflect().New().Interface()
+			if err := Unmarshal(got, decoded); err != nil {
+				t.Fatalf("Unmarshal() got error: %v", err)
+			}
+			if !proto.Equal(decoded, tt.input) {
+				t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", decoded, tt.input)
+			}
+		})
+	}
+}
+
+func TestUnmarshalKeyedList(t *testing.T) {
+	tests := []struct {
+		desc        string
+		umo         UnmarshalOptions
+		inputBson   bson.D
+		wantMessage proto.Message
+		wantErr     string
+	}{{
+		desc: "key field is set from the key",
+		inputBson: bson.D{{Key: "items", Value: bson.D{
+			{Key: "a", Value: bson.D{{Key: "qty", Value: int32(1)}}},
+		}}},
+		wantMessage: &pb2.Cart{Items: []*pb2.Item{{Sku: proto.String("a"), Qty: proto.Int32(1)}}},
+	}, {
+		desc: "arrays are accepted",
+		inputBson: bson.D{{Key: "items", Value: bson.A{
+			bson.D{{Key: "sku", Value: "a"}},
+		}}},
+		wantMessage: &pb2.Cart{Items: []*pb2.Item{{Sku: proto.String("a")}}},
+	}, {
+		desc: "replace lists",
+		umo:  UnmarshalOptions{Merge: true, ReplaceLists: true},
+		inputBson: bson.D{{Key: "items", Value: bson.D{
+			{Key: "b", Value: bson.D{}},
+		}}},
+		wantMessage: &pb2.Cart{Items: []*pb2.Item{{Sku: proto.String("b")}}},
+	}, {
+		desc: "mismatched key field",
+		inputBson: bson.D{{Key: "items", Value: bson.D{
+			{Key: "a", Value: bson.D{{Key: "sku", Value: "b"}}},
+		}}},
+		wantErr: `items["a"]: key field textpb2_proto.Item.sku is b, want a`,
+	}, {
+		desc: "duplicate key",
+		inputBson: bson.D{{Key: "slots", Value: bson.D{
+			{Key: "1", Value: bson.D{}},
+			{Key: "1", Value: bson.D{}},
+		}}},
+		wantErr: "slots[1]: duplicate key 1",
+	}, {
+		desc: "invalid key",
+		inputBson: bson.D{{Key: "slots", Value: bson.D{
+			{Key: "first", Value: bson.D{}},
+		}}},
+		wantErr: `slots[first]: invalid value for int64 key: "first"`,
+	}, {
+		desc: "invalid element",
+		inputBson: bson.D{{Key: "items", Value: bson.D{
+			{Key: "a", Value: "x"},
+		}}},
+		wantErr: `items["a"]:`,
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			got := &pb2.Cart{Items: []*pb2.Item{{Sku: proto.String("old")}}}
+			if !tt.umo.Merge {
+				got = &pb2.Cart{}
+			}
+			err := tt.umo.Unmarshal(tt.inputBson, got)
+			if err != nil {
+				if tt.wantErr == "" {
+					t.Errorf("Unmarshal() got unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Unmarshal() error got %q, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if tt.wantErr != "" {
+				t.Errorf("Unmarshal() got nil error, want error %q", tt.wantErr)
+			}
+			if !proto.Equal(got, tt.wantMessage) {
+				t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", got, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestKeyedListErrors(t *testing.T) {
+	tests := []struct {
+		desc    string
+		input   proto.Message
+		wantErr string
+	}{{
+		desc:    "missing key value",
+		input:   &pb2.Cart{Items: []*pb2.Item{{Sku: proto.String("a")}, {Qty: proto.Int32(1)}}},
+		wantErr: "items[1]: key field textpb2_proto.Item.sku is not set",
+	}, {
+		desc:    "duplicate key value",
+		input:   &pb2.Cart{Slots: []*pb2.Slot{{Position: proto.Int64(1)}, {Position: proto.Int64(1)}}},
+		wantErr: "slots[1]: duplicate key 1",
+	}, {
+		desc:    "duplicate zero key",
+		input:   &pb3.Inventory{Slots: []*pb3.KeyedSlot{{}, {Position: 0, Label: "x"}}},
+		wantErr: "slots[1]: duplicate key 0",
+	}, {
+		desc:    "unknown key field",
+		input:   &pb2.InvalidKeyField{Items: []*pb2.Item{{}}},
+		wantErr: `key field "id" of textpb2_proto.InvalidKeyField.items does not exist`,
+	}, {
+		desc:    "invalid key field kind",
+		input:   &pb2.InvalidKeyFieldKind{Carts: []*pb2.Cart{{}}},
+		wantErr: "key field textpb2_proto.Cart.items of textpb2_proto.InvalidKeyFieldKind.carts must be a singular string, integer or bool field",
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			_, err := Marshal(tt.input)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Marshal() got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	want := `key field "id" of textpb2_proto.InvalidKeyField.items does not exist`
+	err := Unmarshal(bson.D{{Key: "items", Value: bson.D{}}}, &pb2.InvalidKeyField{})
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Unmarshal() got error %v, want %q", err, want)
+	}
+}
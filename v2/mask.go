@@ -0,0 +1,119 @@
+package bsonpb
+
+import (
+	"strings"
+
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// maskWildcard selects every entry of a map field in a field mask path.
+const maskWildcard = "*"
+
+// fieldMask is the tree of paths of a google.protobuf.FieldMask. Fields are
+// keyed by their proto name and map entries by their key. A nil fieldMask
+// selects everything, so does a nil entry for the field or map key it is
+// stored under.
+type fieldMask map[string]fieldMask
+
+// newFieldMask builds the tree of the paths in mask for messages of type md.
+// A nil mask or a mask without paths selects everything.
+func newFieldMask(md pref.MessageDescriptor, mask *fieldmaskpb.FieldMask) (fieldMask, error) {
+	if len(mask.GetPaths()) == 0 {
+		return nil, nil
+	}
+	fm := fieldMask{}
+	for _, path := range mask.GetPaths() {
+		if err := fm.add(md, strings.Split(path, "."), path); err != nil {
+			return nil, err
+		}
+	}
+	return fm, nil
+}
+
+// add adds the path parts to the mask of a message of type md. For map
+// fields, the part following the field name is the map key or "*".
+func (fm fieldMask) add(md pref.MessageDescriptor, parts []string, path string) error {
+	name := parts[0]
+	fd := md.Fields().ByName(pref.Name(name))
+	if fd == nil {
+		return newError(CategoryInvalidValue, "invalid field mask path %q: %v has no field %q", path, md.FullName(), name)
+	}
+	if fd.IsMap() && len(parts) > 1 {
+		entries, ok := fm[name]
+		if ok && entries == nil {
+			return nil // the whole map is selected already
+		}
+		if entries == nil {
+			entries = fieldMask{}
+			fm[name] = entries
+		}
+		return entries.set(parts[1], fd.MapValue().Message(), parts[2:], path)
+	}
+	return fm.set(name, fd.Message(), parts[1:], path)
+}
+
+// set selects the remaining path parts below key, which holds messages of
+// type md or scalars if md is nil.
+func (fm fieldMask) set(key string, md pref.MessageDescriptor, rest []string, path string) error {
+	sub, ok := fm[key]
+	if len(rest) == 0 {
+		fm[key] = nil
+		return nil
+	}
+	if ok && sub == nil {
+		return nil // selected as a whole already
+	}
+	if md == nil {
+		return newError(CategoryInvalidValue, "invalid field mask path %q: %q is not a message", path, key)
+	}
+	if sub == nil {
+		sub = fieldMask{}
+		fm[key] = sub
+	}
+	return sub.add(md, rest, path)
+}
+
+// field reports whether fd is selected and returns the mask for its value.
+func (fm fieldMask) field(fd pref.FieldDescriptor) (fieldMask, bool) {
+	if fm == nil {
+		return nil, true
+	}
+	sub, ok := fm[string(fd.Name())]
+	return sub, ok
+}
+
+// entry reports whether the map entry with the given key is selected and
+// returns the mask for its value. Paths of the key and of "*" are combined.
+func (fm fieldMask) entry(key string) (fieldMask, bool) {
+	if fm == nil {
+		return nil, true
+	}
+	sub, ok := fm[key]
+	all, hasAll := fm[maskWildcard]
+	switch {
+	case !hasAll:
+		return sub, ok
+	case !ok:
+		return all, true
+	}
+	return unionMasks(sub, all), true
+}
+
+// unionMasks returns the mask selecting everything a or b selects.
+func unionMasks(a, b fieldMask) fieldMask {
+	if a == nil || b == nil {
+		return nil
+	}
+	union := make(fieldMask, len(a)+len(b))
+	for key, sub := range a {
+		union[key] = sub
+	}
+	for key, sub := range b {
+		if prev, ok := union[key]; ok {
+			sub = unionMasks(prev, sub)
+		}
+		union[key] = sub
+	}
+	return union
+}
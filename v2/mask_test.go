@@ -0,0 +1,283 @@
+package bsonpb
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	pb2 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb2_proto"
+	pb3 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb3_proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func mask(paths ...string) *fieldmaskpb.FieldMask {
+	return &fieldmaskpb.FieldMask{Paths: paths}
+}
+
+func TestMarshalMask(t *testing.T) {
+	maps := &pb3.Maps{
+		Int32ToStr: map[int32]string{1: "one", 2: "two"},
+		StrToNested: map[string]*pb3.Nested{
+			"a": {SString: "a", SNested: &pb3.Nested{SString: "deep"}},
+			"b": {SString: "b"},
+		},
+	}
+	extensions := &pb2.Extensions{OptString: proto.String("string"), OptBool: proto.Bool(true)}
+	proto.SetExtension(extensions, pb2.E_OptExtString, "extension")
+
+	tests := []struct {
+		desc    string
+		mo      MarshalOptions
+		input   proto.Message
+		want    bson.D
+		wantErr string
+	}{{
+		desc:  "empty mask selects everything",
+		mo:    MarshalOptions{Mask: mask()},
+		input: &pb3.Scalars{SBool: true, SString: "s"},
+		want:  bson.D{{Key: "sBool", Value: true}, {Key: "sString", Value: "s"}},
+	}, {
+		desc:  "top level fields",
+		mo:    MarshalOptions{Mask: mask("s_string", "s_int32")},
+		input: &pb3.Scalars{SBool: true, SInt32: 1, SString: "s"},
+		want:  bson.D{{Key: "sInt32", Value: int32(1)}, {Key: "sString", Value: "s"}},
+	}, {
+		desc:  "unpopulated selected fields",
+		mo:    MarshalOptions{Mask: mask("s_string"), EmitUnpopulated: true},
+		input: &pb3.Scalars{SBool: true},
+		want:  bson.D{{Key: "sString", Value: ""}},
+	}, {
+		desc: "nested paths",
+		mo:   MarshalOptions{Mask: mask("opt_nested.opt_nested.opt_string", "rpt_nested.opt_string")},
+		input: &pb2.Nests{
+			OptNested: &pb2.Nested{
+				OptString: proto.String("skipped"),
+				OptNested: &pb2.Nested{OptString: proto.String("deep")},
+			},
+			RptNested: []*pb2.Nested{
+				{OptString: proto.String("first"), OptNested: &pb2.Nested{}},
+				{OptNested: &pb2.Nested{}},
+			},
+		},
+		want: bson.D{
+			{Key: "optNested", Value: bson.D{
+				{Key: "optNested", Value: bson.D{{Key: "optString", Value: "deep"}}},
+			}},
+			{Key: "rptNested", Value: bson.A{
+				bson.D{{Key: "optString", Value: "first"}},
+				bson.D{},
+			}},
+		},
+	}, {
+		desc: "whole field wins over nested path",
+		mo:   MarshalOptions{Mask: mask("opt_nested.opt_string", "opt_nested")},
+		input: &pb2.Nests{OptNested: &pb2.Nested{
+			OptString: proto.String("x"),
+			OptNested: &pb2.Nested{},
+		}},
+		want: bson.D{{Key: "optNested", Value: bson.D{
+			{Key: "optString", Value: "x"},
+			{Key: "optNested", Value: bson.D{}},
+		}}},
+	}, {
+		desc:  "map entries by key",
+		mo:    MarshalOptions{Mask: mask("int32_to_str.2", "str_to_nested.a.s_nested")},
+		input: maps,
+		want: bson.D{
+			{Key: "int32ToStr", Value: bson.D{{Key: "2", Value: "two"}}},
+			{Key: "strToNested", Value: bson.D{
+				{Key: "a", Value: bson.D{{Key: "sNested", Value: bson.D{{Key: "sString", Value: "deep"}}}}},
+			}},
+		},
+	}, {
+		desc:  "map entries by wildcard",
+		mo:    MarshalOptions{Mask: mask("str_to_nested.*.s_string")},
+		input: maps,
+		want: bson.D{
+			{Key: "strToNested", Value: bson.D{
+				{Key: "a", Value: bson.D{{Key: "sString", Value: "a"}}},
+				{Key: "b", Value: bson.D{{Key: "sString", Value: "b"}}},
+			}},
+		},
+	}, {
+		desc:  "wildcard combined with key",
+		mo:    MarshalOptions{Mask: mask("str_to_nested.*.s_string", "str_to_nested.a.s_nested")},
+		input: maps,
+		want: bson.D{
+			{Key: "strToNested", Value: bson.D{
+				{Key: "a", Value: bson.D{
+					{Key: "sString", Value: "a"},
+					{Key: "sNested", Value: bson.D{{Key: "sString", Value: "deep"}}},
+				}},
+				{Key: "b", Value: bson.D{{Key: "sString", Value: "b"}}},
+			}},
+		},
+	}, {
+		desc:  "whole wildcard wins over key",
+		mo:    MarshalOptions{Mask: mask("str_to_nested.a.s_string", "str_to_nested.*")},
+		input: maps,
+		want: bson.D{
+			{Key: "strToNested", Value: bson.D{
+				{Key: "a", Value: bson.D{
+					{Key: "sString", Value: "a"},
+					{Key: "sNested", Value: bson.D{{Key: "sString", Value: "deep"}}},
+				}},
+				{Key: "b", Value: bson.D{{Key: "sString", Value: "b"}}},
+			}},
+		},
+	}, {
+		desc:  "extensions are not selected",
+		mo:    MarshalOptions{Mask: mask("opt_string")},
+		input: extensions,
+		want:  bson.D{{Key: "optString", Value: "string"}},
+	}, {
+		desc:  "well-known types are selected as a whole",
+		mo:    MarshalOptions{Mask: mask("opt_timestamp.seconds")},
+		input: &pb2.KnownTypes{OptTimestamp: timestamppb.New(time.Unix(1, 0).UTC())},
+		want:  bson.D{{Key: "optTimestamp", Value: primitive.NewDateTimeFromTime(time.Unix(1, 0).UTC())}},
+	}, {
+		desc:    "unknown field",
+		mo:      MarshalOptions{Mask: mask("s_nested.s_missing")},
+		input:   &pb3.Nests{},
+		wantErr: `invalid field mask path "s_nested.s_missing": textpb3_proto.Nested has no field "s_missing"`,
+	}, {
+		desc:    "path into scalar",
+		mo:      MarshalOptions{Mask: mask("s_string.x")},
+		input:   &pb3.Nested{},
+		wantErr: `invalid field mask path "s_string.x": "s_string" is not a message`,
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := tt.mo.Marshal(tt.input)
+			if err != nil {
+				if tt.wantErr == "" {
+					t.Errorf("Marshal() got unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Marshal() error got %q, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if tt.wantErr != "" {
+				t.Errorf("Marshal() got nil error, want error %q", tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Marshal() diff -want +got\n%v\n", diff)
+			}
+		})
+	}
+}
+
+func TestUnmarshalMask(t *testing.T) {
+	tests := []struct {
+		desc        string
+		umo         UnmarshalOptions
+		inputBson   bson.D
+		wantMessage proto.Message
+		wantErr     string
+	}{{
+		desc: "top level fields",
+		umo:  UnmarshalOptions{Mask: mask("s_string")},
+		inputBson: bson.D{
+			{Key: "sBool", Value: true},
+			{Key: "sString", Value: "s"},
+			{Key: "sInt32", Value: "not validated"},
+		},
+		wantMessage: &pb3.Scalars{SString: "s"},
+	}, {
+		desc: "nested paths",
+		umo:  UnmarshalOptions{Mask: mask("opt_nested.opt_string", "rpt_nested.opt_nested")},
+		inputBson: bson.D{
+			{Key: "optNested", Value: bson.D{
+				{Key: "optString", Value: "kept"},
+				{Key: "optNested", Value: bson.D{}},
+			}},
+			{Key: "rptNested", Value: bson.A{
+				bson.D{{Key: "optString", Value: "skipped"}, {Key: "optNested", Value: bson.D{}}},
+			}},
+			{Key: "OptGroup", Value: bson.D{}},
+		},
+		wantMessage: &pb2.Nests{
+			OptNested: &pb2.Nested{OptString: proto.String("kept")},
+			RptNested: []*pb2.Nested{{OptNested: &pb2.Nested{}}},
+		},
+	}, {
+		desc: "map entries",
+		umo:  UnmarshalOptions{Mask: mask("int32_to_str.1", "str_to_nested.*.s_string")},
+		inputBson: bson.D{
+			{Key: "int32ToStr", Value: bson.D{{Key: "1", Value: "one"}, {Key: "2", Value: "two"}}},
+			{Key: "strToNested", Value: bson.D{
+				{Key: "a", Value: bson.D{{Key: "sString", Value: "a"}, {Key: "sNested", Value: bson.D{}}}},
+			}},
+		},
+		wantMessage: &pb3.Maps{
+			Int32ToStr:  map[int32]string{1: "one"},
+			StrToNested: map[string]*pb3.Nested{"a": {SString: "a"}},
+		},
+	}, {
+		desc: "extensions are ignored",
+		umo:  UnmarshalOptions{Mask: mask("opt_string")},
+		inputBson: bson.D{
+			{Key: "optString", Value: "string"},
+			{Key: "[textpb2_proto.opt_ext_string]", Value: "extension"},
+		},
+		wantMessage: &pb2.Extensions{OptString: proto.String("string")},
+	}, {
+		desc:      "unknown fields are still reported",
+		umo:       UnmarshalOptions{Mask: mask("s_string")},
+		inputBson: bson.D{{Key: "sMissing", Value: true}},
+		wantErr:   `unknown field "sMissing"`,
+	}, {
+		desc:      "invalid mask",
+		umo:       UnmarshalOptions{Mask: mask("s_missing")},
+		inputBson: bson.D{},
+		wantErr:   `invalid field mask path "s_missing"`,
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			got := tt.wantMessage
+			if got == nil {
+				got = &pb3.Scalars{}
+			} else {
+				got = got.ProtoReflect().New().Interface()
+			}
+			err := tt.umo.Unmarshal(tt.inputBson, got)
+			if err != nil {
+				if tt.wantErr == "" {
+					t.Errorf("Unmarshal() got unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Unmarshal() error got %q, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if tt.wantErr != "" {
+				t.Errorf("Unmarshal() got nil error, want error %q", tt.wantErr)
+			}
+			if !proto.Equal(got, tt.wantMessage) {
+				t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", got, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestUnmarshalMaskMerge(t *testing.T) {
+	m := &pb3.Scalars{SBool: true, SString: "old"}
+	umo := UnmarshalOptions{Merge: true, Mask: mask("s_string")}
+	doc := bson.D{{Key: "sBool", Value: false}, {Key: "sString", Value: "new"}}
+	if err := umo.Unmarshal(doc, m); err != nil {
+		t.Fatalf("Unmarshal() got error: %v", err)
+	}
+	want := &pb3.Scalars{SBool: true, SString: "new"}
+	if !proto.Equal(m, want) {
+		t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", m, want)
+	}
+}
@@ -0,0 +1,577 @@
+package bsonpb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/proto"
+)
+
+// Match reports whether the BSON form of the given proto.Message matches the
+// given MongoDB query filter. The message is marshaled using opts, so field
+// names in the filter must follow the same naming options as the encoder.
+//
+// The supported query operators are $eq, $ne, $gt, $gte, $lt, $lte, $in,
+// $nin, $exists, $and, $or, $nor, $not, $elemMatch, $size and $regex.
+// Matching follows the MongoDB semantics for dotted paths, array traversal
+// and missing fields.
+func Match(filter bson.D, m proto.Message, opts MarshalOptions) (bool, error) {
+	doc, err := opts.Marshal(m)
+	if err != nil {
+		return false, err
+	}
+	docD, ok := doc.(bson.D)
+	if !ok {
+		return false, fmt.Errorf("cannot match %v: not a document", m.ProtoReflect().Descriptor().FullName())
+	}
+	return matchDocument(docD, filter)
+}
+
+// matchDocument evaluates a top-level query filter against doc.
+func matchDocument(doc bson.D, filter bson.D) (bool, error) {
+	for _, item := range filter {
+		var ok bool
+		var err error
+		switch {
+		case isLogicalOperator(item.Key):
+			ok, err = matchLogical(doc, item.Key, item.Value)
+		case strings.HasPrefix(item.Key, "$"):
+			return false, fmt.Errorf("unknown top level operator %q", item.Key)
+		default:
+			ok, err = matchField(doc, item.Key, item.Value)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchLogical(doc bson.D, op string, arg interface{}) (bool, error) {
+	clauses, ok := asArray(arg)
+	if !ok || len(clauses) == 0 {
+		return false, fmt.Errorf("%s argument must be a non-empty array", op)
+	}
+	for _, clause := range clauses {
+		clauseD, ok := asDocument(clause)
+		if !ok {
+			return false, fmt.Errorf("%s entries must be documents, got %T", op, clause)
+		}
+		matched, err := matchDocument(doc, clauseD)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case op == "$and" && !matched:
+			return false, nil
+		case op == "$or" && matched:
+			return true, nil
+		case op == "$nor" && matched:
+			return false, nil
+		}
+	}
+	return op != "$or", nil
+}
+
+// matchField evaluates the condition for a single (possibly dotted) path.
+func matchField(doc bson.D, path string, cond interface{}) (bool, error) {
+	values := lookupPath(doc, strings.Split(path, "."))
+	if ops, ok := asOperators(cond); ok {
+		for _, op := range ops {
+			matched, err := matchOperator(values, op.Key, op.Value, ops)
+			if err != nil || !matched {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	if re, ok := cond.(primitive.Regex); ok {
+		return matchRegex(values, re.Pattern, re.Options)
+	}
+	return matchEq(values, cond), nil
+}
+
+// matchOperator evaluates a single query operator against the values found at
+// a path. The full operator document is passed for operators such as $regex
+// which read sibling options.
+func matchOperator(values []interface{}, op string, arg interface{}, ops bson.D) (bool, error) {
+	switch op {
+	case "$eq":
+		return matchEq(values, arg), nil
+	case "$ne":
+		return !matchEq(values, arg), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		return matchCompare(values, op, arg), nil
+	case "$in", "$nin":
+		candidates, ok := asArray(arg)
+		if !ok {
+			return false, fmt.Errorf("%s needs an array", op)
+		}
+		matched, err := matchIn(values, candidates)
+		if op == "$nin" {
+			matched = !matched
+		}
+		return matched, err
+	case "$exists":
+		return (len(values) > 0) == truthy(arg), nil
+	case "$size":
+		size, ok := asInt64(arg)
+		if !ok {
+			return false, fmt.Errorf("$size needs a number, got %T", arg)
+		}
+		for _, v := range values {
+			if arr, ok := v.(bson.A); ok && int64(len(arr)) == size {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$elemMatch":
+		return matchElem(values, arg)
+	case "$regex":
+		var options string
+		for _, o := range ops {
+			if o.Key == "$options" {
+				s, ok := o.Value.(string)
+				if !ok {
+					return false, fmt.Errorf("$options has to be a string, got %T", o.Value)
+				}
+				options = s
+			}
+		}
+		switch re := arg.(type) {
+		case string:
+			return matchRegex(values, re, options)
+		case primitive.Regex:
+			if options == "" {
+				options = re.Options
+			}
+			return matchRegex(values, re.Pattern, options)
+		}
+		return false, fmt.Errorf("$regex has to be a string, got %T", arg)
+	case "$options":
+		// Consumed by $regex.
+		return true, nil
+	case "$not":
+		if re, ok := arg.(primitive.Regex); ok {
+			matched, err := matchRegex(values, re.Pattern, re.Options)
+			return !matched, err
+		}
+		notOps, ok := asOperators(arg)
+		if !ok {
+			return false, errors.New("$not needs a regex or an operator document")
+		}
+		for _, notOp := range notOps {
+			matched, err := matchOperator(values, notOp.Key, notOp.Value, notOps)
+			if err != nil {
+				return false, err
+			}
+			if !matched {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown operator %q", op)
+}
+
+func matchEq(values []interface{}, arg interface{}) bool {
+	arg = normalizeFilterValue(arg)
+	if isNull(arg) && len(values) == 0 {
+		return true
+	}
+	for _, v := range expandArrays(values) {
+		if valuesEqual(v, arg) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchIn(values []interface{}, candidates bson.A) (bool, error) {
+	for _, c := range candidates {
+		if re, ok := c.(primitive.Regex); ok {
+			matched, err := matchRegex(values, re.Pattern, re.Options)
+			if err != nil || matched {
+				return matched, err
+			}
+			continue
+		}
+		if matchEq(values, c) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func matchCompare(values []interface{}, op string, arg interface{}) bool {
+	arg = normalizeFilterValue(arg)
+	for _, v := range expandArrays(values) {
+		cmp, ok := compareValues(v, arg)
+		if !ok {
+			continue
+		}
+		switch {
+		case op == "$gt" && cmp > 0,
+			op == "$gte" && cmp >= 0,
+			op == "$lt" && cmp < 0,
+			op == "$lte" && cmp <= 0:
+			return true
+		}
+	}
+	return false
+}
+
+func matchElem(values []interface{}, arg interface{}) (bool, error) {
+	cond, ok := asDocument(arg)
+	if !ok {
+		return false, fmt.Errorf("$elemMatch needs a document, got %T", arg)
+	}
+	_, isOperators := asOperators(cond)
+	for _, item := range cond {
+		if isLogicalOperator(item.Key) {
+			// Logical operators combine conditions on the element's fields.
+			isOperators = false
+		}
+	}
+	for _, v := range values {
+		arr, ok := v.(bson.A)
+		if !ok {
+			continue
+		}
+		for _, elem := range arr {
+			var matched bool
+			var err error
+			if isOperators {
+				// Operators apply to the array elements themselves.
+				matched, err = matchField(bson.D{{Key: "v", Value: elem}}, "v", cond)
+			} else if elemD, ok := elem.(bson.D); ok {
+				matched, err = matchDocument(elemD, cond)
+			}
+			if err != nil {
+				return false, err
+			}
+			if matched {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func matchRegex(values []interface{}, pattern, options string) (bool, error) {
+	var flags string
+	for _, o := range options {
+		switch o {
+		case 'i', 'm', 's':
+			flags += string(o)
+		default:
+			return false, fmt.Errorf("unsupported regex option %q", o)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, fmt.Errorf("invalid regex %q: %v", pattern, err)
+	}
+	for _, v := range expandArrays(values) {
+		if s, ok := v.(string); ok && re.MatchString(s) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// lookupPath returns all values reachable by the given path. Arrays on the
+// way are traversed element-wise unless the path component is an index.
+func lookupPath(v interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		return []interface{}{v}
+	}
+	switch vv := v.(type) {
+	case bson.D:
+		for _, item := range vv {
+			if item.Key == path[0] {
+				return lookupPath(item.Value, path[1:])
+			}
+		}
+	case bson.A:
+		var result []interface{}
+		if idx, err := strconv.Atoi(path[0]); err == nil && idx >= 0 {
+			if idx < len(vv) {
+				result = append(result, lookupPath(vv[idx], path[1:])...)
+			}
+		}
+		for _, elem := range vv {
+			if _, ok := elem.(bson.D); ok {
+				result = append(result, lookupPath(elem, path)...)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+// expandArrays returns the values together with the elements of all arrays
+// among them, since query conditions match either an array or any of its
+// elements.
+func expandArrays(values []interface{}) []interface{} {
+	result := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		result = append(result, v)
+		if arr, ok := v.(bson.A); ok {
+			result = append(result, arr...)
+		}
+	}
+	return result
+}
+
+// asOperators returns the given value as operator document if all its keys
+// are query operators.
+func asOperators(v interface{}) (bson.D, bool) {
+	doc, ok := asDocument(v)
+	if !ok || len(doc) == 0 {
+		return nil, false
+	}
+	for _, item := range doc {
+		if !strings.HasPrefix(item.Key, "$") {
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// isLogicalOperator reports whether op combines query clauses rather than
+// applying to the value of a field.
+func isLogicalOperator(op string) bool {
+	return op == "$and" || op == "$or" || op == "$nor"
+}
+
+func asDocument(v interface{}) (bson.D, bool) {
+	switch vv := v.(type) {
+	case bson.D:
+		return vv, true
+	case bson.M:
+		doc := bson.D{}
+		for k, val := range vv {
+			doc = append(doc, bson.E{Key: k, Value: val})
+		}
+		return doc, true
+	}
+	return nil, false
+}
+
+func asArray(v interface{}) (bson.A, bool) {
+	switch vv := v.(type) {
+	case bson.A:
+		return vv, true
+	case []interface{}:
+		return bson.A(vv), true
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice || rv.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, false
+	}
+	result := make(bson.A, rv.Len())
+	for i := range result {
+		result[i] = rv.Index(i).Interface()
+	}
+	return result, true
+}
+
+func asInt64(v interface{}) (int64, bool) {
+	n, ok := toNumber(v)
+	if !ok || n.isFloat && n.f != math.Trunc(n.f) {
+		return 0, false
+	}
+	if n.isFloat {
+		return int64(n.f), true
+	}
+	return n.i, true
+}
+
+func truthy(v interface{}) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	if n, ok := toNumber(v); ok {
+		return n.float() != 0
+	}
+	return !isNull(v)
+}
+
+func isNull(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	_, ok := v.(primitive.Null)
+	return ok
+}
+
+// normalizeFilterValue converts Go values commonly used in filters into the
+// representation produced by the encoder.
+func normalizeFilterValue(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case time.Time:
+		return primitive.NewDateTimeFromTime(vv)
+	case []byte:
+		return primitive.Binary{Data: vv}
+	case []interface{}:
+		return bson.A(vv)
+	case bson.M:
+		doc, _ := asDocument(vv)
+		return doc
+	}
+	return v
+}
+
+// number is a numeric BSON value. Integers are kept exact as long as they fit
+// into an int64.
+type number struct {
+	i       int64
+	f       float64
+	isFloat bool
+}
+
+func (n number) float() float64 {
+	if n.isFloat {
+		return n.f
+	}
+	return float64(n.i)
+}
+
+func toNumber(v interface{}) (number, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return number{i: rv.Int()}, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if u := rv.Uint(); u <= math.MaxInt64 {
+			return number{i: int64(u)}, true
+		}
+		return number{f: float64(rv.Uint()), isFloat: true}, true
+	case reflect.Float32, reflect.Float64:
+		return number{f: rv.Float(), isFloat: true}, true
+	}
+	return number{}, false
+}
+
+func compareNumbers(a, b number) int {
+	if !a.isFloat && !b.isFloat {
+		switch {
+		case a.i < b.i:
+			return -1
+		case a.i > b.i:
+			return 1
+		}
+		return 0
+	}
+	af, bf := a.float(), b.float()
+	switch {
+	case af < bf:
+		return -1
+	case af > bf:
+		return 1
+	}
+	return 0
+}
+
+// compareValues orders two values of the same BSON type bracket. It reports
+// false if the values are not comparable.
+func compareValues(a, b interface{}) (int, bool) {
+	if an, ok := toNumber(a); ok {
+		bn, ok := toNumber(b)
+		if !ok || math.IsNaN(an.float()) || math.IsNaN(bn.float()) {
+			return 0, false
+		}
+		return compareNumbers(an, bn), true
+	}
+	switch av := a.(type) {
+	case string:
+		if bv, ok := b.(string); ok {
+			return strings.Compare(av, bv), true
+		}
+	case primitive.DateTime:
+		if bv, ok := b.(primitive.DateTime); ok {
+			return compareNumbers(number{i: int64(av)}, number{i: int64(bv)}), true
+		}
+	case primitive.Binary:
+		if bv, ok := b.(primitive.Binary); ok {
+			if len(av.Data) != len(bv.Data) {
+				return compareNumbers(number{i: int64(len(av.Data))}, number{i: int64(len(bv.Data))}), true
+			}
+			if av.Subtype != bv.Subtype {
+				return compareNumbers(number{i: int64(av.Subtype)}, number{i: int64(bv.Subtype)}), true
+			}
+			return bytes.Compare(av.Data, bv.Data), true
+		}
+	case primitive.ObjectID:
+		if bv, ok := b.(primitive.ObjectID); ok {
+			return bytes.Compare(av[:], bv[:]), true
+		}
+	case bool:
+		if bv, ok := b.(bool); ok {
+			switch {
+			case av == bv:
+				return 0, true
+			case bv:
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+// valuesEqual reports whether two BSON values are equal. Numbers compare by
+// value regardless of their concrete type.
+func valuesEqual(a, b interface{}) bool {
+	if isNull(a) || isNull(b) {
+		return isNull(a) && isNull(b)
+	}
+	if an, ok := toNumber(a); ok {
+		bn, ok := toNumber(b)
+		return ok && compareNumbers(an, bn) == 0 && !math.IsNaN(an.float())
+	}
+	switch av := a.(type) {
+	case bson.D:
+		bv, ok := b.(bson.D)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if av[i].Key != bv[i].Key || !valuesEqual(av[i].Value, normalizeFilterValue(bv[i].Value)) {
+				return false
+			}
+		}
+		return true
+	case bson.A:
+		bv, ok := asArray(b)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !valuesEqual(av[i], normalizeFilterValue(bv[i])) {
+				return false
+			}
+		}
+		return true
+	case primitive.Binary:
+		bv, ok := b.(primitive.Binary)
+		return ok && av.Subtype == bv.Subtype && bytes.Equal(av.Data, bv.Data)
+	}
+	if cmp, ok := compareValues(a, b); ok {
+		return cmp == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,286 @@
+package bsonpb
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	pb2 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb2_proto"
+	pb3 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb3_proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestMatch(t *testing.T) {
+	scalars := &pb3.Scalars{
+		SBool:   true,
+		SInt32:  42,
+		SInt64:  -7,
+		SUint64: 100,
+		SDouble: 1.5,
+		SString: "hello world",
+	}
+	repeats := &pb2.Repeats{
+		RptInt32:  []int32{1, 5, 9},
+		RptString: []string{"a", "b"},
+	}
+	nests := &pb2.Nests{
+		OptNested: &pb2.Nested{
+			OptString: proto.String("outer"),
+			OptNested: &pb2.Nested{OptString: proto.String("inner")},
+		},
+		RptNested: []*pb2.Nested{
+			{OptString: proto.String("first")},
+			{OptString: proto.String("second")},
+		},
+	}
+
+	tests := []struct {
+		desc    string
+		mo      MarshalOptions
+		filter  bson.D
+		input   proto.Message
+		want    bool
+		wantErr string
+	}{{
+		desc:   "empty filter",
+		filter: bson.D{},
+		input:  scalars,
+		want:   true,
+	}, {
+		desc:   "implicit equality",
+		filter: bson.D{{Key: "sInt32", Value: 42}, {Key: "sString", Value: "hello world"}},
+		input:  scalars,
+		want:   true,
+	}, {
+		desc:   "implicit equality mismatch",
+		filter: bson.D{{Key: "sInt32", Value: 41}},
+		input:  scalars,
+		want:   false,
+	}, {
+		desc:   "numbers compare across types",
+		filter: bson.D{{Key: "sUint64", Value: 100.0}, {Key: "sInt64", Value: int32(-7)}},
+		input:  scalars,
+		want:   true,
+	}, {
+		desc:   "UseProtoNames",
+		mo:     MarshalOptions{UseProtoNames: true},
+		filter: bson.D{{Key: "s_int32", Value: bson.D{{Key: "$eq", Value: 42}}}},
+		input:  scalars,
+		want:   true,
+	}, {
+		desc:   "$ne",
+		filter: bson.D{{Key: "sInt32", Value: bson.D{{Key: "$ne", Value: 42}}}},
+		input:  scalars,
+		want:   false,
+	}, {
+		desc: "$gt and $lte",
+		filter: bson.D{
+			{Key: "sDouble", Value: bson.D{{Key: "$gt", Value: 1}, {Key: "$lte", Value: 1.5}}},
+		},
+		input: scalars,
+		want:  true,
+	}, {
+		desc:   "$lt on strings",
+		filter: bson.D{{Key: "sString", Value: bson.D{{Key: "$lt", Value: "hello"}}}},
+		input:  scalars,
+		want:   false,
+	}, {
+		desc:   "comparison across type brackets never matches",
+		filter: bson.D{{Key: "sString", Value: bson.D{{Key: "$gt", Value: 1}}}},
+		input:  scalars,
+		want:   false,
+	}, {
+		desc:   "$in",
+		filter: bson.D{{Key: "sInt32", Value: bson.D{{Key: "$in", Value: bson.A{1, 42}}}}},
+		input:  scalars,
+		want:   true,
+	}, {
+		desc:   "$nin",
+		filter: bson.D{{Key: "sInt32", Value: bson.D{{Key: "$nin", Value: bson.A{1, 42}}}}},
+		input:  scalars,
+		want:   false,
+	}, {
+		desc:   "$exists",
+		filter: bson.D{{Key: "sBool", Value: bson.D{{Key: "$exists", Value: true}}}},
+		input:  scalars,
+		want:   true,
+	}, {
+		desc:   "$exists false on unpopulated field",
+		filter: bson.D{{Key: "sFloat", Value: bson.D{{Key: "$exists", Value: false}}}},
+		input:  scalars,
+		want:   true,
+	}, {
+		desc:   "null matches missing field",
+		filter: bson.D{{Key: "sFloat", Value: nil}},
+		input:  scalars,
+		want:   true,
+	}, {
+		desc: "$and",
+		filter: bson.D{{Key: "$and", Value: bson.A{
+			bson.D{{Key: "sInt32", Value: 42}},
+			bson.D{{Key: "sBool", Value: false}},
+		}}},
+		input: scalars,
+		want:  false,
+	}, {
+		desc: "$or",
+		filter: bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "sInt32", Value: 1}},
+			bson.D{{Key: "sBool", Value: true}},
+		}}},
+		input: scalars,
+		want:  true,
+	}, {
+		desc: "$nor",
+		filter: bson.D{{Key: "$nor", Value: bson.A{
+			bson.D{{Key: "sInt32", Value: 1}},
+		}}},
+		input: scalars,
+		want:  true,
+	}, {
+		desc: "$not",
+		filter: bson.D{{Key: "sInt32", Value: bson.D{
+			{Key: "$not", Value: bson.D{{Key: "$gt", Value: 50}}},
+		}}},
+		input: scalars,
+		want:  true,
+	}, {
+		desc:   "$regex with options",
+		filter: bson.D{{Key: "sString", Value: bson.D{{Key: "$regex", Value: "^HELLO"}, {Key: "$options", Value: "i"}}}},
+		input:  scalars,
+		want:   true,
+	}, {
+		desc:   "regex value",
+		filter: bson.D{{Key: "sString", Value: primitive.Regex{Pattern: "world$"}}},
+		input:  scalars,
+		want:   true,
+	}, {
+		desc:   "array contains value",
+		filter: bson.D{{Key: "rptInt32", Value: 5}},
+		input:  repeats,
+		want:   true,
+	}, {
+		desc:   "array element comparison",
+		filter: bson.D{{Key: "rptInt32", Value: bson.D{{Key: "$gt", Value: 8}}}},
+		input:  repeats,
+		want:   true,
+	}, {
+		desc:   "array equality",
+		filter: bson.D{{Key: "rptString", Value: bson.A{"a", "b"}}},
+		input:  repeats,
+		want:   true,
+	}, {
+		desc:   "array index",
+		filter: bson.D{{Key: "rptInt32.1", Value: 5}},
+		input:  repeats,
+		want:   true,
+	}, {
+		desc:   "$size",
+		filter: bson.D{{Key: "rptInt32", Value: bson.D{{Key: "$size", Value: 3}}}},
+		input:  repeats,
+		want:   true,
+	}, {
+		desc: "$elemMatch with operators",
+		filter: bson.D{{Key: "rptInt32", Value: bson.D{
+			{Key: "$elemMatch", Value: bson.D{{Key: "$gt", Value: 2}, {Key: "$lt", Value: 6}}},
+		}}},
+		input: repeats,
+		want:  true,
+	}, {
+		desc:   "dotted path into nested message",
+		filter: bson.D{{Key: "optNested.optNested.optString", Value: "inner"}},
+		input:  nests,
+		want:   true,
+	}, {
+		desc:   "dotted path through repeated message",
+		filter: bson.D{{Key: "rptNested.optString", Value: "second"}},
+		input:  nests,
+		want:   true,
+	}, {
+		desc: "$elemMatch with field conditions",
+		filter: bson.D{{Key: "rptNested", Value: bson.D{
+			{Key: "$elemMatch", Value: bson.D{{Key: "optString", Value: bson.D{{Key: "$regex", Value: "^f"}}}}},
+		}}},
+		input: nests,
+		want:  true,
+	}, {
+		desc: "$elemMatch with $or",
+		filter: bson.D{{Key: "rptNested", Value: bson.D{
+			{Key: "$elemMatch", Value: bson.D{{Key: "$or", Value: bson.A{
+				bson.D{{Key: "optString", Value: "missing"}},
+				bson.D{{Key: "optString", Value: "second"}},
+			}}}},
+		}}},
+		input: nests,
+		want:  true,
+	}, {
+		desc: "$elemMatch with $and",
+		filter: bson.D{{Key: "rptNested", Value: bson.D{
+			{Key: "$elemMatch", Value: bson.D{{Key: "$and", Value: bson.A{
+				bson.D{{Key: "optString", Value: bson.D{{Key: "$regex", Value: "^f"}}}},
+				bson.D{{Key: "optString", Value: "second"}},
+			}}}},
+		}}},
+		input: nests,
+		want:  false,
+	}, {
+		desc: "$elemMatch with $nor and a field condition",
+		filter: bson.D{{Key: "rptNested", Value: bson.D{
+			{Key: "$elemMatch", Value: bson.D{
+				{Key: "optString", Value: bson.D{{Key: "$exists", Value: true}}},
+				{Key: "$nor", Value: bson.A{bson.D{{Key: "optString", Value: "second"}}}},
+			}},
+		}}},
+		input: nests,
+		want:  true,
+	}, {
+		desc: "timestamp compared with time.Time",
+		filter: bson.D{{Key: "optTimestamp", Value: bson.D{
+			{Key: "$gte", Value: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		}}},
+		input: &pb2.KnownTypes{
+			OptTimestamp: timestamppb.New(time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)),
+		},
+		want: true,
+	}, {
+		desc:    "unknown operator",
+		filter:  bson.D{{Key: "sInt32", Value: bson.D{{Key: "$near", Value: 1}}}},
+		input:   scalars,
+		wantErr: `unknown operator "$near"`,
+	}, {
+		desc:    "unknown top level operator",
+		filter:  bson.D{{Key: "$where", Value: "true"}},
+		input:   scalars,
+		wantErr: `unknown top level operator "$where"`,
+	}, {
+		desc:    "$in without array",
+		filter:  bson.D{{Key: "sInt32", Value: bson.D{{Key: "$in", Value: 42}}}},
+		input:   scalars,
+		wantErr: "$in needs an array",
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := Match(tt.filter, tt.input, tt.mo)
+			if err != nil {
+				if tt.wantErr == "" {
+					t.Errorf("Match() got unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Match() error got %q, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if tt.wantErr != "" {
+				t.Errorf("Match() got nil error, want error %q", tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Match() got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
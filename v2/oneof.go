@@ -0,0 +1,159 @@
+package bsonpb
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// OneofEncoding selects how the set field of a oneof is encoded.
+type OneofEncoding int
+
+const (
+	// OneofFlattened encodes the set field of a oneof like any other field.
+	OneofFlattened OneofEncoding = iota
+	// OneofTagged encodes a oneof as a subdocument under the name of the
+	// oneof, holding the name of the set field under "case" and its value
+	// under "value", e.g. {"union": {"case": "oneofString", "value": "x"}}.
+	OneofTagged
+	// OneofDiscriminator encodes the set field of a oneof like any other
+	// field, preceded by the name of the field under the name of the oneof
+	// suffixed with "Case", e.g. {"unionCase": "oneofString",
+	// "oneofString": "x"}. With UseProtoNames, the suffix is "_case".
+	OneofDiscriminator
+)
+
+// Keys of the subdocument of a tagged oneof.
+const (
+	oneofCaseKey  = "case"
+	oneofValueKey = "value"
+)
+
+// oneofKey returns the key of a tagged oneof.
+func oneofKey(od pref.OneofDescriptor, useProtoNames bool) string {
+	if useProtoNames {
+		return string(od.Name())
+	}
+	return JSONCamelCase(string(od.Name()))
+}
+
+// oneofDiscriminatorKey returns the key of the discriminator of a oneof.
+func oneofDiscriminatorKey(od pref.OneofDescriptor, useProtoNames bool) string {
+	if useProtoNames {
+		return string(od.Name()) + "_case"
+	}
+	return JSONCamelCase(string(od.Name())) + "Case"
+}
+
+// oneofEntries returns the elements that encode the marshaled value of the
+// field fd under the given name.
+func (e encoder) oneofEntries(fd pref.FieldDescriptor, name string, val interface{}) []bson.E {
+	od := fd.ContainingOneof()
+	if od == nil || od.IsSynthetic() {
+		return []bson.E{{Key: name, Value: val}}
+	}
+	switch e.opts.OneofEncoding {
+	case OneofTagged:
+		return []bson.E{{Key: oneofKey(od, e.opts.UseProtoNames), Value: bson.D{
+			{Key: oneofCaseKey, Value: name},
+			{Key: oneofValueKey, Value: val},
+		}}}
+	case OneofDiscriminator:
+		return []bson.E{
+			{Key: oneofDiscriminatorKey(od, e.opts.UseProtoNames), Value: name},
+			{Key: name, Value: val},
+		}
+	}
+	return []bson.E{{Key: name, Value: val}}
+}
+
+// oneofByKey returns the oneof of md with the given tagged or discriminator
+// key, accepting both JSON and proto names. Synthetic oneofs are ignored.
+func oneofByKey(md pref.MessageDescriptor, key string) (od pref.OneofDescriptor, discriminator bool) {
+	oneofs := md.Oneofs()
+	for i := 0; i < oneofs.Len(); i++ {
+		od := oneofs.Get(i)
+		if od.IsSynthetic() {
+			continue
+		}
+		if key == oneofKey(od, true) || key == oneofKey(od, false) {
+			return od, false
+		}
+		if key == oneofDiscriminatorKey(od, true) || key == oneofDiscriminatorKey(od, false) {
+			return od, true
+		}
+	}
+	return nil, false
+}
+
+// oneofField returns the field of od with the given JSON or proto name.
+func oneofField(od pref.OneofDescriptor, name string) pref.FieldDescriptor {
+	fields := od.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if string(fd.Name()) == name || fd.JSONName() == name {
+			return fd
+		}
+	}
+	return nil
+}
+
+// unmarshalTaggedOneof returns the set field and its value from the
+// subdocument of a tagged oneof.
+func unmarshalTaggedOneof(od pref.OneofDescriptor, val interface{}) (pref.FieldDescriptor, interface{}, error) {
+	doc, ok := val.(bson.D)
+	if !ok {
+		return nil, nil, newValueError(CategoryTypeMismatch, pref.MessageKind, val, "invalid value for oneof %v: %v", od.FullName(), val)
+	}
+	var fd pref.FieldDescriptor
+	var value interface{}
+	for _, item := range doc {
+		switch item.Key {
+		case oneofCaseKey:
+			if fd != nil {
+				return nil, nil, withField(newError(CategoryDuplicateField, "duplicate field %q", item.Key), item.Key)
+			}
+			name, ok := item.Value.(string)
+			if !ok {
+				return nil, nil, withField(newValueError(CategoryTypeMismatch, pref.StringKind, item.Value, "invalid oneof case: %v", item.Value), item.Key)
+			}
+			if fd = oneofField(od, name); fd == nil {
+				return nil, nil, withField(newError(CategoryUnknownField, "oneof %v has no field %q", od.FullName(), name), item.Key)
+			}
+		case oneofValueKey:
+			value = item.Value
+		default:
+			return nil, nil, withField(newError(CategoryUnknownField, "unknown field %q", item.Key), item.Key)
+		}
+	}
+	if fd == nil {
+		return nil, nil, newError(CategoryMissingRequired, "missing %q field of oneof %v", oneofCaseKey, od.FullName())
+	}
+	return fd, value, nil
+}
+
+// oneofDiscriminator is a discriminator key found in a document.
+type oneofDiscriminator struct {
+	key   string
+	oneof pref.OneofDescriptor
+	value interface{}
+}
+
+// checkDiscriminator reports whether the discriminator names the set field
+// of its oneof. Discriminators of fields excluded by the mask are ignored.
+func (d decoder) checkDiscriminator(disc oneofDiscriminator, m pref.Message) error {
+	name, ok := disc.value.(string)
+	if !ok {
+		return newValueError(CategoryTypeMismatch, pref.StringKind, disc.value, "invalid oneof case: %v", disc.value)
+	}
+	fd := oneofField(disc.oneof, name)
+	if fd == nil {
+		return newError(CategoryUnknownField, "oneof %v has no field %q", disc.oneof.FullName(), name)
+	}
+	if _, ok := d.mask.field(fd); !ok {
+		return nil
+	}
+	if m.WhichOneof(disc.oneof) != fd {
+		return newError(CategoryOneofConflict, "oneof %v case %q does not match the set field", disc.oneof.FullName(), name)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package bsonpb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	pb3 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb3_proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMarshalOneofEncoding(t *testing.T) {
+	tests := []struct {
+		desc  string
+		mo    MarshalOptions
+		input proto.Message
+		want  bson.D
+	}{{
+		desc:  "flattened",
+		input: &pb3.Oneofs{Union: &pb3.Oneofs_OneofString{OneofString: "x"}},
+		want:  bson.D{{Key: "oneofString", Value: "x"}},
+	}, {
+		desc:  "tagged",
+		mo:    MarshalOptions{OneofEncoding: OneofTagged},
+		input: &pb3.Oneofs{Union: &pb3.Oneofs_OneofString{OneofString: "x"}},
+		want: bson.D{{Key: "union", Value: bson.D{
+			{Key: "case", Value: "oneofString"},
+			{Key: "value", Value: "x"},
+		}}},
+	}, {
+		desc:  "tagged message with proto names",
+		mo:    MarshalOptions{OneofEncoding: OneofTagged, UseProtoNames: true},
+		input: &pb3.Oneofs{Union: &pb3.Oneofs_OneofNested{OneofNested: &pb3.Nested{SString: "n"}}},
+		want: bson.D{{Key: "union", Value: bson.D{
+			{Key: "case", Value: "oneof_nested"},
+			{Key: "value", Value: bson.D{{Key: "s_string", Value: "n"}}},
+		}}},
+	}, {
+		desc:  "tagged unset oneof",
+		mo:    MarshalOptions{OneofEncoding: OneofTagged, EmitUnpopulated: true},
+		input: &pb3.Oneofs{},
+		want:  bson.D{},
+	}, {
+		desc:  "discriminator",
+		mo:    MarshalOptions{OneofEncoding: OneofDiscriminator, Deterministic: true},
+		input: &pb3.Oneofs{Union: &pb3.Oneofs_OneofEnum{OneofEnum: pb3.Enum_TEN}},
+		want: bson.D{
+			{Key: "unionCase", Value: "oneofEnum"},
+			{Key: "oneofEnum", Value: "TEN"},
+		},
+	}, {
+		desc:  "discriminator with proto names",
+		mo:    MarshalOptions{OneofEncoding: OneofDiscriminator, UseProtoNames: true},
+		input: &pb3.Oneofs{Union: &pb3.Oneofs_OneofString{OneofString: "x"}},
+		want: bson.D{
+			{Key: "union_case", Value: "oneof_string"},
+			{Key: "oneof_string", Value: "x"},
+		},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := tt.mo.Marshal(tt.input)
+			if err != nil {
+				t.Fatalf("Marshal() got error: %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Marshal() diff -want +got\n%v\n", diff)
+			}
+		})
+	}
+}
+
+func TestUnmarshalOneofEncoding(t *testing.T) {
+	tests := []struct {
+		desc        string
+		inputBson   bson.D
+		wantMessage proto.Message
+		wantErr     string
+	}{{
+		desc:        "flattened",
+		inputBson:   bson.D{{Key: "oneofString", Value: "x"}},
+		wantMessage: &pb3.Oneofs{Union: &pb3.Oneofs_OneofString{OneofString: "x"}},
+	}, {
+		desc: "tagged",
+		inputBson: bson.D{{Key: "union", Value: bson.D{
+			{Key: "case", Value: "oneofNested"},
+			{Key: "value", Value: bson.D{{Key: "sString", Value: "n"}}},
+		}}},
+		wantMessage: &pb3.Oneofs{Union: &pb3.Oneofs_OneofNested{OneofNested: &pb3.Nested{SString: "n"}}},
+	}, {
+		desc: "tagged with proto names",
+		inputBson: bson.D{{Key: "union", Value: bson.D{
+			{Key: "value", Value: "TEN"},
+			{Key: "case", Value: "oneof_enum"},
+		}}},
+		wantMessage: &pb3.Oneofs{Union: &pb3.Oneofs_OneofEnum{OneofEnum: pb3.Enum_TEN}},
+	}, {
+		desc: "discriminator",
+		inputBson: bson.D{
+			{Key: "unionCase", Value: "oneofString"},
+			{Key: "oneofString", Value: "x"},
+		},
+		wantMessage: &pb3.Oneofs{Union: &pb3.Oneofs_OneofString{OneofString: "x"}},
+	}, {
+		desc: "discriminator with proto names",
+		inputBson: bson.D{
+			{Key: "oneof_string", Value: "x"},
+			{Key: "union_case", Value: "oneof_string"},
+		},
+		wantMessage: &pb3.Oneofs{Union: &pb3.Oneofs_OneofString{OneofString: "x"}},
+	}, {
+		desc:      "tagged with unknown case",
+		inputBson: bson.D{{Key: "union", Value: bson.D{{Key: "case", Value: "sString"}}}},
+		wantErr:   `union.case: oneof textpb3_proto.Oneofs.union has no field "sString"`,
+	}, {
+		desc:      "tagged without case",
+		inputBson: bson.D{{Key: "union", Value: bson.D{{Key: "value", Value: "x"}}}},
+		wantErr:   `union: missing "case" field of oneof textpb3_proto.Oneofs.union`,
+	}, {
+		desc:      "tagged with unknown field",
+		inputBson: bson.D{{Key: "union", Value: bson.D{{Key: "case", Value: "oneofString"}, {Key: "other", Value: 1}}}},
+		wantErr:   `union.other: unknown field "other"`,
+	}, {
+		desc:      "tagged with invalid value",
+		inputBson: bson.D{{Key: "union", Value: "oneofString"}},
+		wantErr:   "union: invalid value for oneof textpb3_proto.Oneofs.union",
+	}, {
+		desc: "tagged and flattened",
+		inputBson: bson.D{
+			{Key: "union", Value: bson.D{{Key: "case", Value: "oneofString"}, {Key: "value", Value: "x"}}},
+			{Key: "oneofEnum", Value: "TEN"},
+		},
+		wantErr: "oneof textpb3_proto.Oneofs.union is already set",
+	}, {
+		desc: "discriminator mismatch",
+		inputBson: bson.D{
+			{Key: "unionCase", Value: "oneofEnum"},
+			{Key: "oneofString", Value: "x"},
+		},
+		wantErr: `unionCase: oneof textpb3_proto.Oneofs.union case "oneofEnum" does not match the set field`,
+	}, {
+		desc:      "discriminator without field",
+		inputBson: bson.D{{Key: "unionCase", Value: "oneofEnum"}},
+		wantErr:   `unionCase: oneof textpb3_proto.Oneofs.union case "oneofEnum" does not match the set field`,
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			got := &pb3.Oneofs{}
+			err := Unmarshal(tt.inputBson, got)
+			if err != nil {
+				if tt.wantErr == "" {
+					t.Errorf("Unmarshal() got unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Unmarshal() error got %q, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if tt.wantErr != "" {
+				t.Errorf("Unmarshal() got nil error, want error %q", tt.wantErr)
+			}
+			if !proto.Equal(got, tt.wantMessage) {
+				t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", got, tt.wantMessage)
+			}
+		})
+	}
+}
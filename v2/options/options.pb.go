@@ -0,0 +1,185 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.25.0
+// 	protoc        v3.12.3
+// source: v2/options/options.proto
+
+package options
+
+import (
+	proto "github.com/golang/protobuf/proto"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	descriptorpb "google.golang.org/protobuf/types/descriptorpb"
+	reflect "reflect"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// This is a compile-time assertion that a sufficiently up-to-date version
+// of the legacy proto package is being used.
+const _ = proto.ProtoPackageIsVersion4
+
+var file_v2_options_options_proto_extTypes = []protoimpl.ExtensionInfo{
+	{
+		ExtendedType:  (*descriptorpb.FieldOptions)(nil),
+		ExtensionType: (*bool)(nil),
+		Field:         50401,
+		Name:          "bsonpb.sensitive",
+		Tag:           "varint,50401,opt,name=sensitive",
+		Filename:      "v2/options/options.proto",
+	},
+	{
+		ExtendedType:  (*descriptorpb.FieldOptions)(nil),
+		ExtensionType: (*bool)(nil),
+		Field:         50402,
+		Name:          "bsonpb.encrypted",
+		Tag:           "varint,50402,opt,name=encrypted",
+		Filename:      "v2/options/options.proto",
+	},
+	{
+		ExtendedType:  (*descriptorpb.FieldOptions)(nil),
+		ExtensionType: (*bool)(nil),
+		Field:         50403,
+		Name:          "bsonpb.catch_all",
+		Tag:           "varint,50403,opt,name=catch_all",
+		Filename:      "v2/options/options.proto",
+	},
+	{
+		ExtendedType:  (*descriptorpb.FieldOptions)(nil),
+		ExtensionType: (*bool)(nil),
+		Field:         50404,
+		Name:          "bsonpb.inline",
+		Tag:           "varint,50404,opt,name=inline",
+		Filename:      "v2/options/options.proto",
+	},
+	{
+		ExtendedType:  (*descriptorpb.FieldOptions)(nil),
+		ExtensionType: (*string)(nil),
+		Field:         50405,
+		Name:          "bsonpb.key_field",
+		Tag:           "bytes,50405,opt,name=key_field",
+		Filename:      "v2/options/options.proto",
+	},
+	{
+		ExtendedType:  (*descriptorpb.FieldOptions)(nil),
+		ExtensionType: (*uint32)(nil),
+		Field:         50406,
+		Name:          "bsonpb.binary_subtype",
+		Tag:           "varint,50406,opt,name=binary_subtype",
+		Filename:      "v2/options/options.proto",
+	},
+	{
+		ExtendedType:  (*descriptorpb.FieldOptions)(nil),
+		ExtensionType: (*bool)(nil),
+		Field:         50407,
+		Name:          "bsonpb.uuid",
+		Tag:           "varint,50407,opt,name=uuid",
+		Filename:      "v2/options/options.proto",
+	},
+}
+
+// Extension fields to descriptorpb.FieldOptions.
+var (
+	// optional bool sensitive = 50401;
+	E_Sensitive = &file_v2_options_options_proto_extTypes[0]
+	// optional bool encrypted = 50402;
+	E_Encrypted = &file_v2_options_options_proto_extTypes[1]
+	// optional bool catch_all = 50403;
+	E_CatchAll = &file_v2_options_options_proto_extTypes[2]
+	// optional bool inline = 50404;
+	E_Inline = &file_v2_options_options_proto_extTypes[3]
+	// optional string key_field = 50405;
+	E_KeyField = &file_v2_options_options_proto_extTypes[4]
+	// optional uint32 binary_subtype = 50406;
+	E_BinarySubtype = &file_v2_options_options_proto_extTypes[5]
+	// optional bool uuid = 50407;
+	E_Uuid = &file_v2_options_options_proto_extTypes[6]
+)
+
+var File_v2_options_options_proto protoreflect.FileDescriptor
+
+var file_v2_options_options_proto_rawDesc = []byte{
+	0x0a, 0x18, 0x76, 0x32, 0x2f, 0x6f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x2f, 0x6f, 0x70, 0x74,
+	0x69, 0x6f, 0x6e, 0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x06, 0x62, 0x73, 0x6f, 0x6e,
+	0x70, 0x62, 0x1a, 0x20, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x62, 0x75, 0x66, 0x2f, 0x64, 0x65, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74, 0x6f, 0x72, 0x2e, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x3a, 0x3d, 0x0a, 0x09, 0x73, 0x65, 0x6e, 0x73, 0x69, 0x74, 0x69, 0x76,
+	0x65, 0x12, 0x1d, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x62, 0x75, 0x66, 0x2e, 0x46, 0x69, 0x65, 0x6c, 0x64, 0x4f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73,
+	0x18, 0xe1, 0x89, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x09, 0x73, 0x65, 0x6e, 0x73, 0x69, 0x74,
+	0x69, 0x76, 0x65, 0x3a, 0x3d, 0x0a, 0x09, 0x65, 0x6e, 0x63, 0x72, 0x79, 0x70, 0x74, 0x65, 0x64,
+	0x12, 0x1d, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62,
+	0x75, 0x66, 0x2e, 0x46, 0x69, 0x65, 0x6c, 0x64, 0x4f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18,
+	0xe2, 0x89, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x09, 0x65, 0x6e, 0x63, 0x72, 0x79, 0x70, 0x74,
+	0x65, 0x64, 0x3a, 0x3c, 0x0a, 0x09, 0x63, 0x61, 0x74, 0x63, 0x68, 0x5f, 0x61, 0x6c, 0x6c, 0x12,
+	0x1d, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75,
+	0x66, 0x2e, 0x46, 0x69, 0x65, 0x6c, 0x64, 0x4f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0xe3,
+	0x89, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x08, 0x63, 0x61, 0x74, 0x63, 0x68, 0x41, 0x6c, 0x6c,
+	0x3a, 0x37, 0x0a, 0x06, 0x69, 0x6e, 0x6c, 0x69, 0x6e, 0x65, 0x12, 0x1d, 0x2e, 0x67, 0x6f, 0x6f,
+	0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x46, 0x69, 0x65,
+	0x6c, 0x64, 0x4f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0xe4, 0x89, 0x03, 0x20, 0x01, 0x28,
+	0x08, 0x52, 0x06, 0x69, 0x6e, 0x6c, 0x69, 0x6e, 0x65, 0x3a, 0x3c, 0x0a, 0x09, 0x6b, 0x65, 0x79,
+	0x5f, 0x66, 0x69, 0x65, 0x6c, 0x64, 0x12, 0x1d, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x46, 0x69, 0x65, 0x6c, 0x64, 0x4f, 0x70,
+	0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0xe5, 0x89, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x6b,
+	0x65, 0x79, 0x46, 0x69, 0x65, 0x6c, 0x64, 0x3a, 0x46, 0x0a, 0x0e, 0x62, 0x69, 0x6e, 0x61, 0x72,
+	0x79, 0x5f, 0x73, 0x75, 0x62, 0x74, 0x79, 0x70, 0x65, 0x12, 0x1d, 0x2e, 0x67, 0x6f, 0x6f, 0x67,
+	0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x46, 0x69, 0x65, 0x6c,
+	0x64, 0x4f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0xe6, 0x89, 0x03, 0x20, 0x01, 0x28, 0x0d,
+	0x52, 0x0d, 0x62, 0x69, 0x6e, 0x61, 0x72, 0x79, 0x53, 0x75, 0x62, 0x74, 0x79, 0x70, 0x65, 0x3a,
+	0x33, 0x0a, 0x04, 0x75, 0x75, 0x69, 0x64, 0x12, 0x1d, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65,
+	0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x46, 0x69, 0x65, 0x6c, 0x64, 0x4f,
+	0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0xe7, 0x89, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x04,
+	0x75, 0x75, 0x69, 0x64, 0x42, 0x24, 0x5a, 0x22, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63,
+	0x6f, 0x6d, 0x2f, 0x72, 0x6f, 0x6d, 0x6e, 0x6e, 0x2f, 0x62, 0x73, 0x6f, 0x6e, 0x70, 0x62, 0x2f,
+	0x76, 0x32, 0x2f, 0x6f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73,
+}
+
+var file_v2_options_options_proto_goTypes = []interface{}{
+	(*descriptorpb.FieldOptions)(nil), // 0: google.protobuf.FieldOptions
+}
+var file_v2_options_options_proto_depIdxs = []int32{
+	0, // 0: bsonpb.sensitive:extendee -> google.protobuf.FieldOptions
+	0, // 1: bsonpb.encrypted:extendee -> google.protobuf.FieldOptions
+	0, // 2: bsonpb.catch_all:extendee -> google.protobuf.FieldOptions
+	0, // 3: bsonpb.inline:extendee -> google.protobuf.FieldOptions
+	0, // 4: bsonpb.key_field:extendee -> google.protobuf.FieldOptions
+	0, // 5: bsonpb.binary_subtype:extendee -> google.protobuf.FieldOptions
+	0, // 6: bsonpb.uuid:extendee -> google.protobuf.FieldOptions
+	7, // [7:7] is the sub-list for method output_type
+	7, // [7:7] is the sub-list for method input_type
+	7, // [7:7] is the sub-list for extension type_name
+	0, // [0:7] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_v2_options_options_proto_init() }
+func file_v2_options_options_proto_init() {
+	if File_v2_options_options_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_v2_options_options_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   0,
+			NumExtensions: 7,
+			NumServices:   0,
+		},
+		GoTypes:           file_v2_options_options_proto_goTypes,
+		DependencyIndexes: file_v2_options_options_proto_depIdxs,
+		ExtensionInfos:    file_v2_options_options_proto_extTypes,
+	}.Build()
+	File_v2_options_options_proto = out.File
+	file_v2_options_options_proto_rawDesc = nil
+	file_v2_options_options_proto_goTypes = nil
+	file_v2_options_options_proto_depIdxs = nil
+}
@@ -0,0 +1,123 @@
+package bsonpb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/proto"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// RedactionMode selects how the values of sensitive fields are redacted.
+type RedactionMode int
+
+const (
+	// RedactDrop omits sensitive fields from the output.
+	RedactDrop RedactionMode = iota
+	// RedactHash replaces values with the hex encoded HMAC-SHA256 of the
+	// value, keyed with RedactionPolicy.Key. Equal values have equal hashes,
+	// so they can still be joined on and counted.
+	RedactHash
+	// RedactMask replaces values with RedactionPolicy.Mask.
+	RedactMask
+)
+
+// defaultRedactionMask is used by RedactMask if no mask is set.
+const defaultRedactionMask = "REDACTED"
+
+// RedactionPolicy redacts fields that are marked with the debug_redact or
+// the (bsonpb.sensitive) field option. It applies to fields of nested
+// messages, extensions and messages inside google.protobuf.Any alike. The
+// elements of repeated fields and the values of map fields are redacted one
+// by one, map keys are kept.
+type RedactionPolicy struct {
+	// Mode selects how values are redacted.
+	Mode RedactionMode
+
+	// Key is the secret HMAC key used by RedactHash. It must not be empty.
+	Key []byte
+
+	// Mask replaces values in RedactMask mode. If empty, "REDACTED" is used.
+	Mask string
+}
+
+// check reports a policy that can not be applied.
+func (p *RedactionPolicy) check() error {
+	switch p.Mode {
+	case RedactDrop, RedactMask:
+		return nil
+	case RedactHash:
+		if len(p.Key) == 0 {
+			return newError(CategoryInvalidValue, "redaction policy has an empty HMAC key")
+		}
+		return nil
+	}
+	return newError(CategoryUnsupported, "unknown redaction mode %d", p.Mode)
+}
+
+// redact returns the redacted value of the sensitive field fd in the shape
+// of the field. It must not be called in RedactDrop mode.
+func (p *RedactionPolicy) redact(val pref.Value, fd pref.FieldDescriptor) interface{} {
+	switch {
+	case fd.IsList():
+		list := val.List()
+		result := bson.A{}
+		for i := 0; i < list.Len(); i++ {
+			result = append(result, p.redactSingular(list.Get(i), fd))
+		}
+		return result
+	case fd.IsMap():
+		entries := make([]mapEntry, 0, val.Map().Len())
+		val.Map().Range(func(key pref.MapKey, v pref.Value) bool {
+			entries = append(entries, mapEntry{key: key, value: v})
+			return true
+		})
+		sortMap(fd.MapKey().Kind(), entries)
+		result := bson.D{}
+		for _, entry := range entries {
+			result = append(result, bson.E{Key: entry.key.String(), Value: p.redactSingular(entry.value, fd.MapValue())})
+		}
+		return result
+	}
+	return p.redactSingular(val, fd)
+}
+
+func (p *RedactionPolicy) redactSingular(val pref.Value, fd pref.FieldDescriptor) interface{} {
+	if !val.IsValid() {
+		return primitive.Null{}
+	}
+	if p.Mode == RedactMask {
+		if p.Mask == "" {
+			return defaultRedactionMask
+		}
+		return p.Mask
+	}
+	mac := hmac.New(sha256.New, p.Key)
+	mac.Write(redactionBytes(val, fd))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// redactionBytes returns the bytes that are hashed for a value. Strings and
+// bytes are hashed as is, messages as their deterministic wire encoding and
+// other scalars in their textual form.
+func redactionBytes(val pref.Value, fd pref.FieldDescriptor) []byte {
+	switch fd.Kind() {
+	case pref.StringKind:
+		return []byte(val.String())
+	case pref.BytesKind:
+		return val.Bytes()
+	case pref.EnumKind:
+		if desc := fd.Enum().Values().ByNumber(val.Enum()); desc != nil {
+			return []byte(desc.Name())
+		}
+		return []byte(fmt.Sprint(int32(val.Enum())))
+	case pref.MessageKind, pref.GroupKind:
+		b, _ := proto.MarshalOptions{AllowPartial: true, Deterministic: true}.Marshal(val.Message().Interface())
+		return b
+	}
+	return []byte(fmt.Sprint(val.Interface()))
+}
@@ -0,0 +1,196 @@
+package bsonpb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	pb2 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb2_proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestMarshalRedaction(t *testing.T) {
+	key := []byte("secret")
+	hash := func(s string) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(s))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	address := &pb2.Nested{OptString: proto.String("street")}
+	addressBytes, err := proto.MarshalOptions{Deterministic: true}.Marshal(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := &pb2.Sensitive{
+		Name:    proto.String("name"),
+		Email:   proto.String("a@example.com"),
+		Token:   proto.String("token"),
+		Account: proto.Int64(42),
+		Phones:  []string{"1", "2"},
+		Secrets: map[string]string{"b": "y", "a": "x"},
+		Address: address,
+	}
+	proto.SetExtension(input, pb2.E_ExtSecret, "ext")
+
+	details, err := anypb.New(&pb2.Sensitive{Name: proto.String("inner"), Email: proto.String("b@example.com")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc    string
+		mo      MarshalOptions
+		input   proto.Message
+		want    bson.D
+		wantErr string
+	}{{
+		desc:  "without policy",
+		input: &pb2.Sensitive{Name: proto.String("name"), Email: proto.String("a@example.com")},
+		want: bson.D{
+			{Key: "name", Value: "name"},
+			{Key: "email", Value: "a@example.com"},
+		},
+	}, {
+		desc:  "drop",
+		mo:    MarshalOptions{Redaction: &RedactionPolicy{}},
+		input: input,
+		want:  bson.D{{Key: "name", Value: "name"}},
+	}, {
+		desc:  "drop unpopulated",
+		mo:    MarshalOptions{Redaction: &RedactionPolicy{}, EmitUnpopulated: true},
+		input: &pb2.Sensitive{},
+		want: bson.D{
+			{Key: "name", Value: primitive.Null{}},
+			{Key: "child", Value: primitive.Null{}},
+			{Key: "details", Value: primitive.Null{}},
+		},
+	}, {
+		desc:  "mask",
+		mo:    MarshalOptions{Redaction: &RedactionPolicy{Mode: RedactMask}},
+		input: input,
+		want: bson.D{
+			{Key: "name", Value: "name"},
+			{Key: "email", Value: "REDACTED"},
+			{Key: "token", Value: "REDACTED"},
+			{Key: "account", Value: "REDACTED"},
+			{Key: "phones", Value: bson.A{"REDACTED", "REDACTED"}},
+			{Key: "secrets", Value: bson.D{{Key: "a", Value: "REDACTED"}, {Key: "b", Value: "REDACTED"}}},
+			{Key: "address", Value: "REDACTED"},
+			{Key: "[textpb2_proto.ext_secret]", Value: "REDACTED"},
+		},
+	}, {
+		desc:  "custom mask",
+		mo:    MarshalOptions{Redaction: &RedactionPolicy{Mode: RedactMask, Mask: "***"}},
+		input: &pb2.Sensitive{Email: proto.String("a@example.com")},
+		want:  bson.D{{Key: "email", Value: "***"}},
+	}, {
+		desc:  "hash",
+		mo:    MarshalOptions{Redaction: &RedactionPolicy{Mode: RedactHash, Key: key}},
+		input: input,
+		want: bson.D{
+			{Key: "name", Value: "name"},
+			{Key: "email", Value: hash("a@example.com")},
+			{Key: "token", Value: hash("token")},
+			{Key: "account", Value: hash("42")},
+			{Key: "phones", Value: bson.A{hash("1"), hash("2")}},
+			{Key: "secrets", Value: bson.D{{Key: "a", Value: hash("x")}, {Key: "b", Value: hash("y")}}},
+			{Key: "address", Value: hash(string(addressBytes))},
+			{Key: "[textpb2_proto.ext_secret]", Value: hash("ext")},
+		},
+	}, {
+		desc: "nested messages and any",
+		mo:   MarshalOptions{Redaction: &RedactionPolicy{Mode: RedactMask}},
+		input: &pb2.Sensitive{
+			Child:   &pb2.Sensitive{Email: proto.String("c@example.com")},
+			Details: details,
+		},
+		want: bson.D{
+			{Key: "child", Value: bson.D{{Key: "email", Value: "REDACTED"}}},
+			{Key: "details", Value: bson.D{
+				{Key: "@type", Value: "type.googleapis.com/textpb2_proto.Sensitive"},
+				{Key: "name", Value: "inner"},
+				{Key: "email", Value: "REDACTED"},
+			}},
+		},
+	}, {
+		desc:    "hash without key",
+		mo:      MarshalOptions{Redaction: &RedactionPolicy{Mode: RedactHash}},
+		input:   input,
+		wantErr: "redaction policy has an empty HMAC key",
+	}, {
+		desc:    "unknown mode",
+		mo:      MarshalOptions{Redaction: &RedactionPolicy{Mode: RedactionMode(10)}},
+		input:   input,
+		wantErr: "unknown redaction mode 10",
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := tt.mo.Marshal(tt.input)
+			if err != nil {
+				if tt.wantErr == "" {
+					t.Errorf("Marshal() got unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Marshal() error got %q, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if tt.wantErr != "" {
+				t.Errorf("Marshal() got nil error, want error %q", tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Marshal() diff -want +got\n%v\n", diff)
+			}
+		})
+	}
+}
+
+func TestDebugRedactOption(t *testing.T) {
+	// Newer versions of descriptorpb declare debug_redact as a known field.
+	fdp := protodesc.ToFileDescriptorProto(descriptorpb.File_google_protobuf_descriptor_proto)
+	for _, mdp := range fdp.MessageType {
+		if mdp.GetName() == "FieldOptions" {
+			mdp.Field = append(mdp.Field, &descriptorpb.FieldDescriptorProto{
+				Name:     proto.String("debug_redact"),
+				JsonName: proto.String("debugRedact"),
+				Number:   proto.Int32(int32(debugRedactFieldNumber)),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				Type:     descriptorpb.FieldDescriptorProto_TYPE_BOOL.Enum(),
+			})
+		}
+	}
+	fd, err := protodesc.NewFile(fdp, new(protoregistry.Files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := fd.Messages().ByName("FieldOptions")
+	known := dynamicpb.NewMessage(md)
+	if debugRedact(known) {
+		t.Errorf("debugRedact() of unset known field got true, want false")
+	}
+	known.Set(md.Fields().ByNumber(debugRedactFieldNumber), pref.ValueOfBool(true))
+	if !debugRedact(known) {
+		t.Errorf("debugRedact() of known field got false, want true")
+	}
+
+	unknown := &descriptorpb.FieldOptions{}
+	unknown.ProtoReflect().SetUnknown(protowire.AppendVarint(protowire.AppendTag(nil, debugRedactFieldNumber, protowire.VarintType), 1))
+	if !debugRedact(unknown.ProtoReflect()) {
+		t.Errorf("debugRedact() of unknown field got false, want true")
+	}
+}
@@ -0,0 +1,568 @@
+package bsonpb
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/romnn/bsonpb/v2/internal/genid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/proto"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// MaxBSONDocumentSize is the largest document MongoDB accepts.
+const MaxBSONDocumentSize = 16 * 1024 * 1024
+
+// maxLargestFields limits how many fields a DocumentSizeError lists.
+const maxLargestFields = 5
+
+// FieldSize is the number of bytes a field contributes to an encoded
+// document, including its type byte and key.
+type FieldSize struct {
+	Path string
+	Size int
+}
+
+// DocumentSizeError is returned when an encoded document exceeds
+// MarshalOptions.MaxDocumentSize.
+type DocumentSizeError struct {
+	Size    int
+	MaxSize int
+
+	// Largest lists the fields that contribute the most bytes, largest first.
+	// Nested fields are listed alongside their parents.
+	Largest []FieldSize
+}
+
+func (e *DocumentSizeError) Error() string {
+	fields := make([]string, len(e.Largest))
+	for i, f := range e.Largest {
+		fields[i] = fmt.Sprintf("%s (%d bytes)", f.Path, f.Size)
+	}
+	return fmt.Sprintf("document size of %d bytes exceeds maximum of %d bytes, largest fields: %s", e.Size, e.MaxSize, strings.Join(fields, ", "))
+}
+
+// Size returns the number of bytes the BSON document m is encoded as using
+// the given options. The size is computed from the fields of m without
+// building the document. Only values of custom and well-known types,
+// catch-all fields, redacted and encrypted fields and extensions are
+// marshaled on their own to measure them.
+func Size(m proto.Message, opts MarshalOptions) (int, error) {
+	if opts.Resolver == nil {
+		opts.Resolver = protoregistry.GlobalTypes
+	}
+	if m == nil {
+		return emptyDocumentSize, nil
+	}
+	enc, err := opts.newEncoder(m.ProtoReflect().Descriptor())
+	if err != nil {
+		return 0, err
+	}
+	size, err := enc.sizeDocument(m.ProtoReflect())
+	if err != nil {
+		return 0, err
+	}
+	if !opts.AllowPartial {
+		if err := opts.requiredPaths().checkInitialized(m, nil); err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// emptyDocumentSize is the size of the length and terminator of documents and
+// arrays.
+const emptyDocumentSize = 4 + 1
+
+// elementSize returns the size of an element with the given key and value
+// size, including its type byte.
+func elementSize(key string, n int) int {
+	return 1 + len(key) + 1 + n
+}
+
+// sizeDocument returns the size of the document Marshal returns for m.
+func (e encoder) sizeDocument(m pref.Message) (int, error) {
+	md := m.Descriptor()
+	if e.typeMarshaler(md.FullName()) != nil {
+		result, err := e.marshalMessage(m)
+		if err == nil && e.opts.TypeKey != "" {
+			result, err = e.withTypeKey(result, m)
+		}
+		if err != nil {
+			return 0, err
+		}
+		doc, ok := result.(bson.D)
+		if !ok {
+			return 0, newError(CategoryUnsupported, "%v is not encoded as a document", md.FullName())
+		}
+		return sizer{}.message(doc, "", md)
+	}
+
+	var keys []string
+	size, err := e.sizeFields(m, &keys)
+	if err != nil {
+		return 0, err
+	}
+	if e.opts.TypeKey == "" {
+		return emptyDocumentSize + size, nil
+	}
+	// The type key is added like withTypeKey does.
+	typeSize := elementSize(e.opts.TypeKey, 4+len(e.opts.typeKeyValue(md))+1)
+	if len(keys) == 1 && keys[0] == "value" {
+		return emptyDocumentSize + typeSize + elementSize("value", emptyDocumentSize+size), nil
+	}
+	for _, key := range keys {
+		if key == e.opts.TypeKey {
+			return 0, typeKeyConflict(key)
+		}
+	}
+	return emptyDocumentSize + typeSize + size, nil
+}
+
+// sizeMessage returns the size of the marshaled message m.
+func (e encoder) sizeMessage(m pref.Message) (int, error) {
+	if marshal := e.typeMarshaler(m.Descriptor().FullName()); marshal != nil {
+		e.mask = nil
+		v, err := marshal(e, m)
+		if err != nil {
+			return 0, err
+		}
+		return sizer{}.message(v, "", m.Descriptor())
+	}
+	size, err := e.sizeFields(m, nil)
+	if err != nil {
+		return 0, err
+	}
+	return emptyDocumentSize + size, nil
+}
+
+// sizeFields returns the size of the elements marshalFields writes for m. It
+// appends their keys to keys if non-nil.
+func (e encoder) sizeFields(m pref.Message, keys *[]string) (int, error) {
+	messageDesc := m.Descriptor()
+	if !protoLegacy && IsMessageSet(messageDesc) {
+		return 0, newError(CategoryUnsupported, "no support for proto1 MessageSets")
+	}
+
+	catchAll, err := catchAllField(messageDesc)
+	if err != nil {
+		return 0, err
+	}
+	if catchAll != nil {
+		// Captured keys are checked against the whole document.
+		doc, err := e.marshalFields(m)
+		if err != nil {
+			return 0, err
+		}
+		if keys != nil {
+			for _, elem := range doc {
+				*keys = append(*keys, elem.Key)
+			}
+		}
+		size, err := sizer{}.message(doc, "", messageDesc)
+		return size - emptyDocumentSize, err
+	}
+	inline, err := analyzeInline(messageDesc)
+	if err != nil {
+		return 0, err
+	}
+
+	unknownKey := e.opts.UnknownFieldsKey
+	hasUnknown := unknownKey != "" && len(m.GetUnknown()) > 0 && e.mask == nil
+	var size int
+	var fieldKeys []string
+	add := func(key string, n int) {
+		size += elementSize(key, n)
+		if keys != nil || hasUnknown {
+			fieldKeys = append(fieldKeys, key)
+		}
+	}
+
+	fieldDescs := messageDesc.Fields()
+	for i := 0; i < fieldDescs.Len(); {
+		fd := fieldDescs.Get(i)
+		if od := fd.ContainingOneof(); od != nil {
+			fd = m.WhichOneof(od)
+			i += od.Fields().Len()
+			if fd == nil {
+				continue
+			}
+		} else {
+			i++
+		}
+
+		mask, ok := e.mask.field(fd)
+		if !ok {
+			continue
+		}
+		fe := e
+		fe.mask = mask
+
+		if inline.isInline(fd) {
+			if !m.Has(fd) {
+				continue
+			}
+			fe.opts.UnknownFieldsKey = inlineUnknownFieldsKey(unknownKey, fd)
+			n, err := fe.sizeFields(m.Get(fd).Message(), &fieldKeys)
+			if err != nil {
+				return 0, err
+			}
+			size += n
+			continue
+		}
+
+		val := m.Get(fd)
+		if !m.Has(fd) {
+			if !e.opts.EmitUnpopulated {
+				continue
+			}
+			isProto2Scalar := fd.Syntax() == pref.Proto2 && fd.Default().IsValid()
+			isSingularMessage := fd.Cardinality() != pref.Repeated && fd.Message() != nil
+			if isProto2Scalar || isSingularMessage {
+				val = pref.Value{}
+			}
+		}
+
+		name := fieldKey(fd, e.opts.UseProtoNames)
+		var n int
+		switch p := e.opts.Redaction; {
+		case p != nil && isSensitive(fd):
+			if p.Mode == RedactDrop {
+				continue
+			}
+			n, err = sizer{}.scalar(p.redact(val, fd), "")
+		case m.Has(fd) && isEncrypted(fd):
+			var marshaled interface{}
+			marshaled, err = fe.marshalValue(val, fd)
+			if err == nil {
+				marshaled, err = e.encrypt(marshaled, fd)
+			}
+			if err == nil {
+				n, err = sizer{}.scalar(marshaled, "")
+			}
+		default:
+			n, err = fe.sizeValue(val, fd)
+		}
+		if err != nil {
+			return 0, withField(err, name)
+		}
+		e.sizeOneofEntries(fd, name, n, add)
+	}
+
+	if e.mask == nil {
+		extensions, _, err := e.marshalExtensions(m)
+		if err != nil {
+			return 0, err
+		}
+		for _, elem := range extensions {
+			n, err := sizer{}.scalar(elem.Value, "")
+			if err != nil {
+				return 0, err
+			}
+			add(elem.Key, n)
+		}
+	}
+
+	if hasUnknown {
+		for _, key := range fieldKeys {
+			if key == unknownKey {
+				return 0, unknownFieldsKeyConflict(key)
+			}
+		}
+		add(unknownKey, 4+1+len(m.GetUnknown()))
+	}
+	if keys != nil {
+		*keys = append(*keys, fieldKeys...)
+	}
+	return size, nil
+}
+
+// sizeOneofEntries adds the sizes of the elements oneofEntries writes for a
+// value of size n of the field fd.
+func (e encoder) sizeOneofEntries(fd pref.FieldDescriptor, name string, n int, add func(key string, n int)) {
+	od := fd.ContainingOneof()
+	if od == nil || od.IsSynthetic() {
+		add(name, n)
+		return
+	}
+	switch e.opts.OneofEncoding {
+	case OneofTagged:
+		tagged := emptyDocumentSize + elementSize(oneofCaseKey, 4+len(name)+1) + elementSize(oneofValueKey, n)
+		add(oneofKey(od, e.opts.UseProtoNames), tagged)
+	case OneofDiscriminator:
+		add(oneofDiscriminatorKey(od, e.opts.UseProtoNames), 4+len(name)+1)
+		add(name, n)
+	default:
+		add(name, n)
+	}
+}
+
+// sizeValue returns the size of the marshaled value of the field fd.
+func (e encoder) sizeValue(val pref.Value, fd pref.FieldDescriptor) (int, error) {
+	switch {
+	case fd.IsList():
+		return e.sizeList(val.List(), fd)
+	case fd.IsMap():
+		return e.sizeMap(val.Map(), fd)
+	default:
+		return e.sizeSingular(val, fd)
+	}
+}
+
+// sizeSingular returns the size of the marshaled singular value of the field
+// fd. Scalars are marshaled to encode them as the same BSON types as Marshal.
+func (e encoder) sizeSingular(val pref.Value, fd pref.FieldDescriptor) (int, error) {
+	if val.IsValid() && fd.Message() != nil {
+		return e.sizeMessage(val.Message())
+	}
+	v, err := e.marshalSingular(val, fd)
+	if err != nil {
+		return 0, err
+	}
+	return sizer{}.scalar(v, "")
+}
+
+func (e encoder) sizeList(list pref.List, fd pref.FieldDescriptor) (int, error) {
+	key, err := keyField(fd)
+	if err != nil {
+		return 0, err
+	}
+	size := emptyDocumentSize
+	if key != nil {
+		keys, err := elementKeys(list, key)
+		if err != nil {
+			return 0, err
+		}
+		for i, k := range keys {
+			n, err := e.sizeSingular(list.Get(i), fd)
+			if err != nil {
+				return 0, withMapKey(err, k, key.Kind())
+			}
+			size += elementSize(k, n)
+		}
+		return size, nil
+	}
+	for i := 0; i < list.Len(); i++ {
+		n, err := e.sizeSingular(list.Get(i), fd)
+		if err != nil {
+			return 0, withIndex(err, i)
+		}
+		size += elementSize(strconv.Itoa(i), n)
+	}
+	return size, nil
+}
+
+func (e encoder) sizeMap(mmap pref.Map, fd pref.FieldDescriptor) (int, error) {
+	entries := make([]mapEntry, 0, mmap.Len())
+	mmap.Range(func(key pref.MapKey, val pref.Value) bool {
+		entries = append(entries, mapEntry{key: key, value: val})
+		return true
+	})
+	// Sort like marshalMap so that errors are reported for the same entry.
+	sortMap(fd.MapKey().Kind(), entries)
+
+	size := emptyDocumentSize
+	for _, entry := range entries {
+		mask, ok := e.mask.entry(entry.key.String())
+		if !ok {
+			continue
+		}
+		ve := e
+		ve.mask = mask
+		n, err := ve.sizeSingular(entry.value, fd.MapValue())
+		if err != nil {
+			return 0, withMapKey(err, entry.key.String(), fd.MapKey().Kind())
+		}
+		size += elementSize(entry.key.String(), n)
+	}
+	return size, nil
+}
+
+// checkDocumentSize returns a DocumentSizeError if doc, the document of a
+// message of type md, is larger than max.
+func checkDocumentSize(doc bson.D, md pref.MessageDescriptor, max int) error {
+	var fields []FieldSize
+	size, err := sizer{fields: &fields}.message(doc, "", md)
+	if err != nil {
+		return err
+	}
+	if size <= max {
+		return nil
+	}
+	sort.SliceStable(fields, func(i, j int) bool {
+		return fields[i].Size > fields[j].Size
+	})
+	if len(fields) > maxLargestFields {
+		fields = fields[:maxLargestFields]
+	}
+	return &Error{Category: CategoryLimitExceeded, Err: &DocumentSizeError{Size: size, MaxSize: max, Largest: fields}}
+}
+
+// sizer computes the encoded size of marshaled values the way the default
+// registry of the mongo driver encodes them. Paths of fields have the format
+// of Error.Path, as far as the descriptors of the marshaled values tell.
+type sizer struct {
+	// fields collects the size of every field if non-nil.
+	fields *[]FieldSize
+}
+
+// message returns the size of v, the marshaled value of a message of type
+// md, which may be nil if unknown.
+func (s sizer) message(v interface{}, path string, md pref.MessageDescriptor) (int, error) {
+	if md != nil {
+		// Struct and ListValue are encoded as their only field.
+		switch md.FullName() {
+		case genid.Struct_message_fullname:
+			return s.value(v, path, md.Fields().ByNumber(genid.Struct_Fields_field_number), false)
+		case genid.ListValue_message_fullname:
+			return s.value(v, path, md.Fields().ByNumber(genid.ListValue_Values_field_number), false)
+		case genid.Value_message_fullname:
+			switch v.(type) {
+			case bson.D:
+				return s.value(v, path, md.Fields().ByNumber(genid.Value_StructValue_field_number), false)
+			case bson.A:
+				return s.value(v, path, md.Fields().ByNumber(genid.Value_ListValue_field_number), false)
+			}
+		}
+	}
+	doc, ok := v.(bson.D)
+	if !ok {
+		return s.value(v, path, nil, false)
+	}
+	size := emptyDocumentSize
+	for _, elem := range doc {
+		var fd pref.FieldDescriptor
+		if md != nil {
+			fd = fieldByKey(md, elem.Key)
+		}
+		n, err := s.element(elem.Key, elem.Value, joinPath(path, elem.Key), fd, false)
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+	return size, nil
+}
+
+// fieldByKey returns the field of md with the given JSON or proto name.
+func fieldByKey(md pref.MessageDescriptor, key string) pref.FieldDescriptor {
+	fields := md.Fields()
+	if fd := fields.ByJSONName(key); fd != nil {
+		return fd
+	}
+	if fd := fields.ByName(pref.Name(key)); fd != nil && fd.Kind() != pref.GroupKind {
+		return fd
+	}
+	if fd := fields.ByName(pref.Name(strings.ToLower(key))); fd != nil && fd.Kind() == pref.GroupKind && fd.Message().Name() == pref.Name(key) {
+		return fd
+	}
+	return nil
+}
+
+// entries returns the size of doc, whose keys are the map keys of the map
+// field fd or the keys of the keyed list field fd.
+func (s sizer) entries(doc bson.D, path string, fd pref.FieldDescriptor, kind pref.Kind) (int, error) {
+	size := emptyDocumentSize
+	for _, elem := range doc {
+		n, err := s.element(elem.Key, elem.Value, joinPath(path, mapKeySegment(elem.Key, kind)), fd, true)
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+	return size, nil
+}
+
+func (s sizer) array(arr bson.A, path string, fd pref.FieldDescriptor) (int, error) {
+	size := emptyDocumentSize
+	for i, v := range arr {
+		n, err := s.element(strconv.Itoa(i), v, joinPath(path, indexSegment(i)), fd, fd != nil)
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+	return size, nil
+}
+
+// element returns the size of a value including its type byte and key.
+func (s sizer) element(key string, v interface{}, path string, fd pref.FieldDescriptor, elem bool) (int, error) {
+	n, err := s.value(v, path, fd, elem)
+	if err != nil {
+		return 0, err
+	}
+	n = elementSize(key, n)
+	if s.fields != nil {
+		*s.fields = append(*s.fields, FieldSize{Path: path, Size: n})
+	}
+	return n, nil
+}
+
+// value returns the size of v, the marshaled value of the field fd, or of an
+// element or map value of fd if elem is set. fd is nil if unknown.
+func (s sizer) value(v interface{}, path string, fd pref.FieldDescriptor, elem bool) (int, error) {
+	if fd != nil {
+		switch v := v.(type) {
+		case bson.D:
+			if !elem && fd.IsMap() {
+				return s.entries(v, path, fd.MapValue(), fd.MapKey().Kind())
+			}
+			if !elem && fd.IsList() {
+				if key, _ := keyField(fd); key != nil {
+					return s.entries(v, path, fd, key.Kind())
+				}
+			}
+		case bson.A:
+			if !elem && fd.IsList() {
+				return s.array(v, path, fd)
+			}
+		}
+		if (elem || !fd.IsList()) && fd.Message() != nil {
+			return s.message(v, path, fd.Message())
+		}
+	}
+	return s.scalar(v, path)
+}
+
+func (s sizer) scalar(v interface{}, path string) (int, error) {
+	switch v := v.(type) {
+	case bson.D:
+		return s.message(v, path, nil)
+	case bson.A:
+		return s.array(v, path, nil)
+	case string:
+		return 4 + len(v) + 1, nil
+	case primitive.Binary:
+		n := 4 + 1 + len(v.Data)
+		if v.Subtype == 0x02 {
+			// The old binary subtype repeats the length.
+			n += 4
+		}
+		return n, nil
+	}
+
+	switch bsonTypeOf(v) {
+	case bsontype.Boolean:
+		return 1, nil
+	case bsontype.Int32:
+		return 4, nil
+	case bsontype.Int64, bsontype.Double, bsontype.DateTime, bsontype.Timestamp:
+		return 8, nil
+	case bsontype.Null, bsontype.Undefined, bsontype.MinKey, bsontype.MaxKey:
+		return 0, nil
+	case bsontype.ObjectID:
+		return 12, nil
+	case bsontype.Decimal128:
+		return 16, nil
+	}
+	_, b, err := bson.MarshalValue(v)
+	if err != nil {
+		return 0, withPath(err, path)
+	}
+	return len(b), nil
+}
@@ -0,0 +1,316 @@
+package bsonpb
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	pb2 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb2_proto"
+	pb3 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb3_proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestSize(t *testing.T) {
+	anyNested, err := anypb.New(&pb2.Nested{OptString: proto.String("embedded")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const uuid = "123e4567-e89b-12d3-a456-426614174000"
+	unknown := []byte{0x92, 0x06, 0x04, 'a', 'b', 'c', 'd'}
+	inlined := &pb2.Inlined{
+		Name: proto.String("name"),
+		Audit: &pb2.Audit{
+			CreatedBy: proto.String("me"),
+			Source:    &pb2.AuditSource{Host: proto.String("host")},
+		},
+	}
+	inlined.ProtoReflect().SetUnknown(unknown)
+	inlined.Audit.ProtoReflect().SetUnknown(unknown)
+	sensitive := &pb2.Sensitive{
+		Name:    proto.String("name"),
+		Email:   proto.String("a@example.com"),
+		Phones:  []string{"1", "2"},
+		Secrets: map[string]string{"k": "v"},
+		Address: &pb2.Nested{OptString: proto.String("street")},
+	}
+	proto.SetExtension(sensitive, pb2.E_ExtSecret, "ext")
+	extensions := &pb2.Extensions{OptString: proto.String("string"), OptInt32: proto.Int32(42)}
+	proto.SetExtension(extensions, pb2.E_OptExtString, "extension")
+	proto.SetExtension(extensions, pb2.E_OptExtBool, true)
+
+	tests := []struct {
+		desc  string
+		mo    MarshalOptions
+		input proto.Message
+	}{{
+		desc:  "empty message",
+		input: &pb3.Scalars{},
+	}, {
+		desc: "proto3 scalars",
+		input: &pb3.Scalars{
+			SBool:     true,
+			SInt32:    -1,
+			SInt64:    2,
+			SUint32:   3,
+			SUint64:   4,
+			SFixed32:  5,
+			SSfixed64: 6,
+			SFloat:    1.5,
+			SDouble:   2.5,
+			SBytes:    []byte("bytes"),
+			SString:   "谷歌",
+		},
+	}, {
+		desc:  "unpopulated fields",
+		mo:    MarshalOptions{EmitUnpopulated: true},
+		input: &pb2.Scalars{},
+	}, {
+		desc: "enums by name and number",
+		mo:   MarshalOptions{UseEnumNumbers: true},
+		input: &pb2.Enums{
+			OptEnum: pb2.Enum_TEN.Enum(),
+			RptEnum: []pb2.Enum{pb2.Enum_ONE, pb2.Enum_TWO},
+		},
+	}, {
+		desc: "nested, repeated and maps",
+		mo:   MarshalOptions{UseProtoNames: true},
+		input: &pb3.Maps{
+			Int32ToStr:   map[int32]string{1: "one", -10: "minus ten"},
+			BoolToUint32: map[bool]uint32{true: 1},
+			StrToNested:  map[string]*pb3.Nested{"x": {SNested: &pb3.Nested{SString: "deep"}}},
+		},
+	}, {
+		desc: "well-known types",
+		input: &pb2.KnownTypes{
+			OptBool:      wrapperspb.Bool(true),
+			OptInt64:     wrapperspb.Int64(1),
+			OptString:    wrapperspb.String("s"),
+			OptBytes:     wrapperspb.Bytes([]byte("b")),
+			OptTimestamp: timestamppb.New(time.Unix(1, 0)),
+			OptDuration:  durationpb.New(time.Second),
+			OptStruct: &structpb.Struct{Fields: map[string]*structpb.Value{
+				"n": structpb.NewNullValue(),
+				"l": structpb.NewListValue(&structpb.ListValue{Values: []*structpb.Value{structpb.NewNumberValue(1)}}),
+			}},
+			OptAny: anyNested,
+		},
+	}, {
+		desc:  "deterministic",
+		mo:    MarshalOptions{Deterministic: true, UseEnumNumbers: true},
+		input: &pb3.Scalars{SUint32: 1, SUint64: 2, SFloat: 1.5},
+	}, {
+		desc:  "tagged oneof",
+		mo:    MarshalOptions{OneofEncoding: OneofTagged},
+		input: &pb3.Oneofs{Union: &pb3.Oneofs_OneofNested{OneofNested: &pb3.Nested{SString: "x"}}},
+	}, {
+		desc:  "oneof with discriminator",
+		mo:    MarshalOptions{OneofEncoding: OneofDiscriminator, UseProtoNames: true},
+		input: &pb3.Oneofs{Union: &pb3.Oneofs_OneofString{OneofString: "x"}},
+	}, {
+		desc: "keyed list",
+		input: &pb2.Cart{
+			Items: []*pb2.Item{{Sku: proto.String("a"), Qty: proto.Int32(1)}, {Sku: proto.String("bb")}},
+			Slots: []*pb2.Slot{{Position: proto.Int64(-10)}},
+		},
+	}, {
+		desc:  "binary subtypes",
+		mo:    MarshalOptions{EmitUnpopulated: true},
+		input: &pb3.UUIDs{Id: uuid, Refs: []string{"", uuid}, RawRefs: [][]byte{make([]byte, 16)}},
+	}, {
+		desc:  "inline with unknown fields",
+		mo:    MarshalOptions{UnknownFieldsKey: DefaultUnknownFieldsKey},
+		input: inlined,
+	}, {
+		desc: "catch-all",
+		input: &pb2.CatchAll{
+			Name: proto.String("name"),
+			Extra: &structpb.Struct{Fields: map[string]*structpb.Value{
+				"x": structpb.NewStringValue("captured"),
+			}},
+			Child: &pb2.CatchAllMap{Attributes: map[string]*structpb.Value{"y": structpb.NewBoolValue(true)}},
+		},
+	}, {
+		desc:  "redaction",
+		mo:    MarshalOptions{Redaction: &RedactionPolicy{Mode: RedactMask}},
+		input: sensitive,
+	}, {
+		desc:  "extensions",
+		input: extensions,
+	}, {
+		desc:  "field mask",
+		mo:    MarshalOptions{Mask: &fieldmaskpb.FieldMask{Paths: []string{"int32_to_str"}}},
+		input: &pb3.Maps{Int32ToStr: map[int32]string{1: "one"}, StrToNested: map[string]*pb3.Nested{"x": {}}},
+	}, {
+		desc:  "type key",
+		mo:    MarshalOptions{TypeKey: "_t", TypeURLPrefix: "type.googleapis.com"},
+		input: &pb3.Nested{SString: "x"},
+	}, {
+		desc:  "type key with embedded value",
+		mo:    MarshalOptions{TypeKey: "_t"},
+		input: timestamppb.New(time.Unix(1, 0)),
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			doc, err := tt.mo.Marshal(tt.input)
+			if err != nil {
+				t.Fatalf("Marshal() got error: %v", err)
+			}
+			b, err := bson.Marshal(doc)
+			if err != nil {
+				t.Fatalf("bson.Marshal() got error: %v", err)
+			}
+			got, err := Size(tt.input, tt.mo)
+			if err != nil {
+				t.Fatalf("Size() got error: %v", err)
+			}
+			if got != len(b) {
+				t.Errorf("Size() got %d, want %d", got, len(b))
+			}
+		})
+	}
+}
+
+func TestSizeErrors(t *testing.T) {
+	unknown := &pb3.Nested{SString: "x"}
+	unknown.ProtoReflect().SetUnknown([]byte{0x92, 0x06, 0x00})
+	tests := []struct {
+		desc  string
+		mo    MarshalOptions
+		input proto.Message
+	}{{
+		desc:  "invalid UTF-8",
+		input: &pb3.Maps{StrToNested: map[string]*pb3.Nested{"a": {SString: "\xff"}}},
+	}, {
+		desc:  "duplicate key",
+		input: &pb2.Cart{Slots: []*pb2.Slot{{Position: proto.Int64(1)}, {Position: proto.Int64(1)}}},
+	}, {
+		desc:  "invalid UUID",
+		input: &pb2.BinaryFields{Refs: []string{"123e4567-e89b-12d3-a456-426614174000", "x"}},
+	}, {
+		desc:  "type key conflict",
+		mo:    MarshalOptions{TypeKey: "sString"},
+		input: &pb3.Nested{SString: "x"},
+	}, {
+		desc:  "unknown fields key conflict",
+		mo:    MarshalOptions{UnknownFieldsKey: "sString"},
+		input: unknown,
+	}, {
+		desc:  "missing required field",
+		input: &pb2.Requireds{},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			_, want := tt.mo.Marshal(tt.input)
+			if want == nil {
+				t.Fatal("Marshal() got nil error")
+			}
+			if _, err := Size(tt.input, tt.mo); err == nil || err.Error() != want.Error() {
+				t.Errorf("Size() got error %v, want %v", err, want)
+			}
+		})
+	}
+}
+
+func TestMaxDocumentSize(t *testing.T) {
+	input := &pb2.Nests{
+		OptNested: &pb2.Nested{OptString: proto.String("small")},
+		RptNested: []*pb2.Nested{
+			{OptString: proto.String(strings.Repeat("x", 100))},
+			{OptString: proto.String(strings.Repeat("y", 200))},
+		},
+	}
+	size, err := Size(input, MarshalOptions{})
+	if err != nil {
+		t.Fatalf("Size() got error: %v", err)
+	}
+
+	if _, err := (MarshalOptions{MaxDocumentSize: size}).Marshal(input); err != nil {
+		t.Errorf("Marshal() got unexpected error: %v", err)
+	}
+
+	_, err = MarshalOptions{MaxDocumentSize: size - 1}.Marshal(input)
+	var sizeErr *DocumentSizeError
+	if !errors.As(err, &sizeErr) {
+		t.Fatalf("Marshal() got error %v, want DocumentSizeError", err)
+	}
+	var e *Error
+	if !errors.As(err, &e) || e.Category != CategoryLimitExceeded {
+		t.Errorf("Marshal() got error %v, want category %v", err, CategoryLimitExceeded)
+	}
+	if sizeErr.Size != size || sizeErr.MaxSize != size-1 {
+		t.Errorf("DocumentSizeError got size %d and max %d, want %d and %d", sizeErr.Size, sizeErr.MaxSize, size, size-1)
+	}
+	var gotPaths []string
+	for _, f := range sizeErr.Largest {
+		gotPaths = append(gotPaths, f.Path)
+	}
+	wantPaths := []string{"rptNested", "rptNested[1]", "rptNested[1].optString", "rptNested[0]", "rptNested[0].optString"}
+	if diff := cmp.Diff(wantPaths, gotPaths); diff != "" {
+		t.Errorf("DocumentSizeError largest fields diff -want +got\n%v\n", diff)
+	}
+	if want := "rptNested (364 bytes)"; !strings.Contains(err.Error(), want) {
+		t.Errorf("Marshal() error got %q, want %q", err, want)
+	}
+}
+
+func TestDocumentSizePaths(t *testing.T) {
+	big := strings.Repeat("x", 100)
+	tests := []struct {
+		desc      string
+		input     proto.Message
+		wantPaths []string
+	}{{
+		desc: "maps",
+		input: &pb3.Maps{
+			Int32ToStr:  map[int32]string{1: big},
+			StrToNested: map[string]*pb3.Nested{"a": {SString: big}},
+		},
+		wantPaths: []string{`int32ToStr`, `int32ToStr[1]`, `strToNested`, `strToNested["a"]`, `strToNested["a"].sString`},
+	}, {
+		desc:      "keyed list",
+		input:     &pb2.Cart{Items: []*pb2.Item{{Sku: proto.String(big)}}},
+		wantPaths: []string{`items`, `items["` + big + `"]`, `items["` + big + `"].sku`},
+	}, {
+		desc: "struct",
+		input: &pb2.KnownTypes{OptStruct: &structpb.Struct{Fields: map[string]*structpb.Value{
+			"a": structpb.NewListValue(&structpb.ListValue{Values: []*structpb.Value{
+				structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{"b": structpb.NewStringValue(big)}}),
+			}}),
+		}}},
+		wantPaths: []string{`optStruct`, `optStruct["a"]`, `optStruct["a"][0]`, `optStruct["a"][0]["b"]`},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			_, err := MarshalOptions{MaxDocumentSize: 1}.Marshal(tt.input)
+			var sizeErr *DocumentSizeError
+			if !errors.As(err, &sizeErr) {
+				t.Fatalf("Marshal() got error %v, want DocumentSizeError", err)
+			}
+			var gotPaths []string
+			for _, f := range sizeErr.Largest {
+				gotPaths = append(gotPaths, f.Path)
+			}
+			sort.Strings(gotPaths)
+			if diff := cmp.Diff(tt.wantPaths, gotPaths); diff != "" {
+				t.Errorf("DocumentSizeError largest fields diff -want +got\n%v\n", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package bsonpb
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/proto"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// DefaultTypeKey is the type key used by UnmarshalAny.
+const DefaultTypeKey = "_t"
+
+// Resolver looks up message and extension types, e.g. when expanding
+// google.protobuf.Any messages. protoregistry.Types implements it.
+type Resolver interface {
+	protoregistry.MessageTypeResolver
+	protoregistry.ExtensionTypeResolver
+}
+
+// UnmarshalAny decodes a document written with a type key, using
+// DefaultTypeKey, into a new message of the type named by the key. If
+// resolver is nil, protoregistry.GlobalTypes is used.
+func UnmarshalAny(doc interface{}, resolver Resolver) (proto.Message, error) {
+	return UnmarshalOptions{Resolver: resolver}.UnmarshalAny(doc)
+}
+
+// UnmarshalAny decodes a document written with a type key into a new message
+// of the type named by the key, which may be a full name or a type URL. The
+// type is looked up with Resolver. If TypeKey is empty, DefaultTypeKey is
+// used.
+func (o UnmarshalOptions) UnmarshalAny(doc interface{}) (proto.Message, error) {
+	if o.TypeKey == "" {
+		o.TypeKey = DefaultTypeKey
+	}
+	if o.Resolver == nil {
+		o.Resolver = protoregistry.GlobalTypes
+	}
+	docD, ok := doc.(bson.D)
+	if !ok {
+		return nil, newValueError(CategoryTypeMismatch, pref.MessageKind, doc, "unexpected message value: %v", doc)
+	}
+	typeName, found, _, err := splitTypeKey(docD, o.TypeKey)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(CategoryMissingRequired, "missing type key %q", o.TypeKey)
+	}
+	mt, err := o.Resolver.FindMessageByURL(typeName)
+	if err != nil {
+		return nil, withField(newError(CategoryUnresolvable, "unable to resolve %q: %v", typeName, err), o.TypeKey)
+	}
+	m := mt.New().Interface()
+	if err := o.unmarshal(docD, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// typeKeyValue returns the value of the type key for messages of type md.
+func (o MarshalOptions) typeKeyValue(md pref.MessageDescriptor) string {
+	if o.TypeURLPrefix == "" {
+		return string(md.FullName())
+	}
+	return strings.TrimSuffix(o.TypeURLPrefix, "/") + "/" + string(md.FullName())
+}
+
+// withTypeKey adds the type key to the marshaled message m. Results that are
+// not documents, e.g. of well-known and custom types, are embedded in a
+// "value" field like in google.protobuf.Any. So are documents that consist of
+// a "value" field only and documents of custom types that contain the type
+// key, so that stripTypeKey can tell them apart.
+func (e encoder) withTypeKey(result interface{}, m pref.Message) (bson.D, error) {
+	key := e.opts.TypeKey
+	typeElem := bson.E{Key: key, Value: e.opts.typeKeyValue(m.Descriptor())}
+	doc, ok := result.(bson.D)
+	if !ok || isEmbeddedValue(doc) {
+		return bson.D{typeElem, {Key: "value", Value: result}}, nil
+	}
+	for _, elem := range doc {
+		if elem.Key != key {
+			continue
+		}
+		if e.typeMarshaler(m.Descriptor().FullName()) != nil {
+			return bson.D{typeElem, {Key: "value", Value: result}}, nil
+		}
+		return bson.D{}, typeKeyConflict(key)
+	}
+	return append(bson.D{typeElem}, doc...), nil
+}
+
+// typeKeyConflict returns the error for a type key that is also the key of a
+// field.
+func typeKeyConflict(key string) error {
+	return withField(newError(CategoryDuplicateField, "type key %q conflicts with a field", key), key)
+}
+
+// isEmbeddedValue reports whether doc consists of a "value" field only, which
+// is how withTypeKey embeds marshaled messages.
+func isEmbeddedValue(doc bson.D) bool {
+	return len(doc) == 1 && doc[0].Key == "value"
+}
+
+// splitTypeKey returns the value of the type key and the remaining document.
+func splitTypeKey(doc bson.D, key string) (typeName string, found bool, rest bson.D, err error) {
+	rest = make(bson.D, 0, len(doc))
+	for _, elem := range doc {
+		if elem.Key != key {
+			rest = append(rest, elem)
+			continue
+		}
+		if found {
+			return "", false, nil, withField(newError(CategoryDuplicateField, "duplicate type key %q", key), key)
+		}
+		s, ok := elem.Value.(string)
+		if !ok || s == "" {
+			return "", false, nil, withField(newValueError(CategoryInvalidValue, pref.StringKind, elem.Value, "invalid type %v", elem.Value), key)
+		}
+		typeName, found = s, true
+	}
+	return typeName, found, rest, nil
+}
+
+// stripTypeKey removes the type key from the document of the message m and
+// checks that it names the type of m. Messages embedded by withTypeKey are
+// taken from the "value" field.
+func (d decoder) stripTypeKey(doc bson.D, m pref.Message) (interface{}, error) {
+	typeName, found, rest, err := splitTypeKey(doc, d.opts.TypeKey)
+	if err != nil || !found {
+		return doc, err
+	}
+	name := pref.FullName(typeName)
+	if i := strings.LastIndexByte(typeName, '/'); i >= 0 {
+		name = pref.FullName(typeName[i+1:])
+	}
+	if name != m.Descriptor().FullName() {
+		return nil, withField(newError(CategoryTypeMismatch, "type %q does not match %v", typeName, m.Descriptor().FullName()), d.opts.TypeKey)
+	}
+	if !isEmbeddedValue(rest) {
+		return rest, nil
+	}
+	return rest[0].Value, nil
+}
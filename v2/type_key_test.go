@@ -0,0 +1,191 @@
+package bsonpb
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	pb2 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb2_proto"
+	pb3 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb3_proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/proto"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestTypeKey(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	marshalOnly := NewTypeRegistry()
+	err := marshalOnly.Register("textpb3_proto.Nested", func(enc *Encoder, m pref.Message) (interface{}, error) {
+		return enc.MarshalFields(m)
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		desc  string
+		mo    MarshalOptions
+		input proto.Message
+		want  bson.D
+	}{{
+		desc:  "full name",
+		mo:    MarshalOptions{TypeKey: "_t"},
+		input: &pb3.Nested{SString: "x"},
+		want: bson.D{
+			{Key: "_t", Value: "textpb3_proto.Nested"},
+			{Key: "sString", Value: "x"},
+		},
+	}, {
+		desc:  "type url",
+		mo:    MarshalOptions{TypeKey: "_type", TypeURLPrefix: "type.googleapis.com/", Deterministic: true, FieldOrder: OrderByName},
+		input: &pb2.Nested{OptString: proto.String("x"), OptNested: &pb2.Nested{}},
+		want: bson.D{
+			{Key: "_type", Value: "type.googleapis.com/textpb2_proto.Nested"},
+			{Key: "optNested", Value: bson.D{}},
+			{Key: "optString", Value: "x"},
+		},
+	}, {
+		desc:  "well-known type",
+		mo:    MarshalOptions{TypeKey: "_t"},
+		input: timestamppb.New(ts),
+		want: bson.D{
+			{Key: "_t", Value: "google.protobuf.Timestamp"},
+			{Key: "value", Value: primitive.NewDateTimeFromTime(ts)},
+		},
+	}, {
+		desc: "well-known type encoded as a document",
+		mo:   MarshalOptions{TypeKey: "_t"},
+		input: &structpb.Struct{Fields: map[string]*structpb.Value{
+			"_t": structpb.NewBoolValue(true),
+		}},
+		want: bson.D{
+			{Key: "_t", Value: "google.protobuf.Struct"},
+			{Key: "value", Value: bson.D{{Key: "_t", Value: true}}},
+		},
+	}, {
+		desc: "document of a value field only",
+		mo:   MarshalOptions{TypeKey: "_t"},
+		input: &structpb.Struct{Fields: map[string]*structpb.Value{
+			"value": structpb.NewNumberValue(1),
+		}},
+		want: bson.D{
+			{Key: "_t", Value: "google.protobuf.Struct"},
+			{Key: "value", Value: bson.D{{Key: "value", Value: float64(1)}}},
+		},
+	}, {
+		desc:  "marshal-only custom type",
+		mo:    MarshalOptions{TypeKey: "_t", Types: marshalOnly},
+		input: &pb3.Nested{SString: "x"},
+		want: bson.D{
+			{Key: "_t", Value: "textpb3_proto.Nested"},
+			{Key: "sString", Value: "x"},
+		},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := tt.mo.Marshal(tt.input)
+			if err != nil {
+				t.Fatalf("Marshal() got error: %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Marshal() diff -want +got\n%v\n", diff)
+			}
+
+			decoded, err := UnmarshalOptions{TypeKey: tt.mo.TypeKey, Types: tt.mo.Types}.UnmarshalAny(got)
+			if err != nil {
+				t.Fatalf("UnmarshalAny() got error: %v", err)
+			}
+			if !proto.Equal(decoded, tt.input) {
+				t.Errorf("UnmarshalAny()\n<got>\n%v\n<want>\n%v\n", decoded, tt.input)
+			}
+
+			// The type key is checked when the type is known upfront.
+			known := tt.input.ProtoReflect().New().Interface()
+			if err := (UnmarshalOptions{TypeKey: tt.mo.TypeKey, Types: tt.mo.Types}).Unmarshal(got, known); err != nil {
+				t.Fatalf("Unmarshal() got error: %v", err)
+			}
+			if !proto.Equal(known, tt.input) {
+				t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", known, tt.input)
+			}
+		})
+	}
+}
+
+func TestUnmarshalAny(t *testing.T) {
+	got, err := UnmarshalAny(bson.D{
+		{Key: "sString", Value: "x"},
+		{Key: "_t", Value: "textpb3_proto.Nested"},
+	}, protoregistry.GlobalTypes)
+	if err != nil {
+		t.Fatalf("UnmarshalAny() got error: %v", err)
+	}
+	if want := (&pb3.Nested{SString: "x"}); !proto.Equal(got, want) {
+		t.Errorf("UnmarshalAny()\n<got>\n%v\n<want>\n%v\n", got, want)
+	}
+
+	tests := []struct {
+		desc    string
+		input   interface{}
+		wantErr string
+	}{{
+		desc:    "not a document",
+		input:   bson.A{},
+		wantErr: "unexpected message value",
+	}, {
+		desc:    "missing type key",
+		input:   bson.D{{Key: "sString", Value: "x"}},
+		wantErr: `missing type key "_t"`,
+	}, {
+		desc:    "invalid type",
+		input:   bson.D{{Key: "_t", Value: int32(1)}},
+		wantErr: "_t: invalid type 1",
+	}, {
+		desc:    "duplicate type key",
+		input:   bson.D{{Key: "_t", Value: "textpb3_proto.Nested"}, {Key: "_t", Value: "textpb3_proto.Nested"}},
+		wantErr: `_t: duplicate type key "_t"`,
+	}, {
+		desc:    "unresolvable type",
+		input:   bson.D{{Key: "_t", Value: "example.Missing"}},
+		wantErr: `_t: unable to resolve "example.Missing"`,
+	}, {
+		desc:    "invalid fields",
+		input:   bson.D{{Key: "_t", Value: "textpb3_proto.Nested"}, {Key: "sMissing", Value: "x"}},
+		wantErr: `unknown field "sMissing"`,
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			_, err := UnmarshalAny(tt.input, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("UnmarshalAny() got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTypeKeyErrors(t *testing.T) {
+	_, err := MarshalOptions{TypeKey: "sString"}.Marshal(&pb3.Nested{SString: "x"})
+	if want := `sString: type key "sString" conflicts with a field`; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Marshal() got error %v, want %q", err, want)
+	}
+
+	doc := bson.D{{Key: "_t", Value: "type.googleapis.com/textpb3_proto.Nests"}}
+	err = UnmarshalOptions{TypeKey: "_t"}.Unmarshal(doc, &pb3.Nested{})
+	if want := `_t: type "type.googleapis.com/textpb3_proto.Nests" does not match textpb3_proto.Nested`; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Unmarshal() got error %v, want %q", err, want)
+	}
+
+	doc = bson.D{{Key: "_t", Value: "google.protobuf.Timestamp"}}
+	err = UnmarshalOptions{TypeKey: "_t"}.Unmarshal(doc, &timestamppb.Timestamp{})
+	if want := "invalid google.protobuf.Timestamp value"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Unmarshal() got error %v, want %q", err, want)
+	}
+}
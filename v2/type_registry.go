@@ -0,0 +1,140 @@
+package bsonpb
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// MarshalFunc returns the BSON value of the message m, e.g. a bson.D or a
+// primitive value. Nested messages and fields can be marshaled with enc.
+type MarshalFunc func(enc *Encoder, m pref.Message) (interface{}, error)
+
+// UnmarshalFunc populates the message m from the BSON value val. Nested
+// messages and fields can be unmarshaled with dec.
+type UnmarshalFunc func(dec *Decoder, val interface{}, m pref.Message) error
+
+// TypeRegistry maps message types to custom marshal and unmarshal functions,
+// e.g. to store a Money message as a Decimal128. Custom functions take
+// precedence over the encoding of well-known types and also apply to
+// messages inside google.protobuf.Any, which are embedded in a "value"
+// field like well-known types. A TypeRegistry must not be modified while it
+// is used by a marshal or unmarshal operation.
+type TypeRegistry struct {
+	marshalers   map[pref.FullName]MarshalFunc
+	unmarshalers map[pref.FullName]UnmarshalFunc
+}
+
+// NewTypeRegistry returns an empty TypeRegistry.
+func NewTypeRegistry() *TypeRegistry {
+	return &TypeRegistry{
+		marshalers:   make(map[pref.FullName]MarshalFunc),
+		unmarshalers: make(map[pref.FullName]UnmarshalFunc),
+	}
+}
+
+// Register sets the functions used for messages with the given full name.
+// Either function may be nil to keep the default encoding in that direction.
+// Registering the same name twice is an error.
+func (r *TypeRegistry) Register(name pref.FullName, marshal MarshalFunc, unmarshal UnmarshalFunc) error {
+	if !name.IsValid() {
+		return newError(CategoryInvalidValue, "invalid message name %q", name)
+	}
+	if marshal == nil && unmarshal == nil {
+		return newError(CategoryInvalidValue, "no functions given for %v", name)
+	}
+	if _, ok := r.marshalers[name]; ok {
+		return newError(CategoryInvalidValue, "%v is already registered", name)
+	}
+	if _, ok := r.unmarshalers[name]; ok {
+		return newError(CategoryInvalidValue, "%v is already registered", name)
+	}
+	if marshal != nil {
+		r.marshalers[name] = marshal
+	}
+	if unmarshal != nil {
+		r.unmarshalers[name] = unmarshal
+	}
+	return nil
+}
+
+// typeMarshaler returns the marshal function of a message type with a custom
+// or well-known encoding. It returns nil otherwise.
+func (e encoder) typeMarshaler(name pref.FullName) marshalFunc {
+	if r := e.opts.Types; r != nil {
+		if marshal, ok := r.marshalers[name]; ok {
+			return func(e encoder, m pref.Message) (interface{}, error) {
+				return marshal(&Encoder{e: e}, m)
+			}
+		}
+	}
+	return wellKnownTypeMarshaler(name)
+}
+
+// typeUnmarshaler returns the unmarshal function of a message type with a
+// custom or well-known encoding. It returns nil otherwise.
+func (d decoder) typeUnmarshaler(name pref.FullName) unmarshalFunc {
+	if r := d.opts.Types; r != nil {
+		if unmarshal, ok := r.unmarshalers[name]; ok {
+			return func(d decoder, val interface{}, m pref.Message) error {
+				return unmarshal(&Decoder{d: d}, val, m)
+			}
+		}
+	}
+	return wellKnownTypeUnmarshaler(name)
+}
+
+// Encoder gives custom marshal functions access to the encoder that is
+// running, including its options.
+type Encoder struct {
+	e encoder
+}
+
+// Options returns the options of the marshal operation.
+func (enc *Encoder) Options() MarshalOptions {
+	return enc.e.opts
+}
+
+// MarshalMessage returns the BSON value of m, using custom functions for its
+// type if there are any.
+func (enc *Encoder) MarshalMessage(m pref.Message) (interface{}, error) {
+	return enc.e.marshalMessage(m)
+}
+
+// MarshalFields returns the default encoding of the fields of m, ignoring
+// custom functions for its own type.
+func (enc *Encoder) MarshalFields(m pref.Message) (bson.D, error) {
+	return enc.e.marshalFields(m)
+}
+
+// MarshalValue returns the BSON value of the field fd with the value v.
+func (enc *Encoder) MarshalValue(v pref.Value, fd pref.FieldDescriptor) (interface{}, error) {
+	return enc.e.marshalValue(v, fd)
+}
+
+// Decoder gives custom unmarshal functions access to the decoder that is
+// running, including its options and limits.
+type Decoder struct {
+	d decoder
+}
+
+// Options returns the options of the unmarshal operation.
+func (dec *Decoder) Options() UnmarshalOptions {
+	return dec.d.opts
+}
+
+// UnmarshalMessage populates m from val, using custom functions for its
+// type if there are any.
+func (dec *Decoder) UnmarshalMessage(val interface{}, m pref.Message) error {
+	return dec.d.unmarshalMessage(val, m, false)
+}
+
+// UnmarshalFields populates the fields of m from the document val with the
+// default encoding, ignoring custom functions for its own type.
+func (dec *Decoder) UnmarshalFields(val interface{}, m pref.Message) error {
+	return dec.d.unmarshalFields(val, m)
+}
+
+// UnmarshalScalar returns the value of the scalar or enum field fd from val.
+func (dec *Decoder) UnmarshalScalar(val interface{}, fd pref.FieldDescriptor) (pref.Value, error) {
+	return dec.d.unmarshalScalar(val, fd)
+}
@@ -0,0 +1,193 @@
+package bsonpb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	pb2 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb2_proto"
+	pb3 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb3_proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/proto"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// testTypes encodes textpb2_proto.Nested as its string, followed by its
+// nested message if set, textpb3_proto.Nested with a version field and
+// google.protobuf.Timestamp as unix seconds.
+func testTypes(t *testing.T) *TypeRegistry {
+	r := NewTypeRegistry()
+	nestedFields := (&pb2.Nested{}).ProtoReflect().Descriptor().Fields()
+	optString := nestedFields.ByName("opt_string")
+	optNested := nestedFields.ByName("opt_nested")
+	err := r.Register("textpb2_proto.Nested",
+		func(enc *Encoder, m pref.Message) (interface{}, error) {
+			if !m.Has(optNested) {
+				return m.Get(optString).String(), nil
+			}
+			child, err := enc.MarshalMessage(m.Get(optNested).Message())
+			if err != nil {
+				return nil, err
+			}
+			return bson.A{m.Get(optString).String(), child}, nil
+		},
+		func(dec *Decoder, val interface{}, m pref.Message) error {
+			switch v := val.(type) {
+			case string:
+				m.Set(optString, pref.ValueOfString(v))
+				return nil
+			case bson.A:
+				if len(v) == 2 {
+					if s, ok := v[0].(string); ok {
+						m.Set(optString, pref.ValueOfString(s))
+						return dec.UnmarshalMessage(v[1], m.Mutable(optNested).Message())
+					}
+				}
+			}
+			return fmt.Errorf("invalid nested value %v", val)
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.Register("textpb3_proto.Nested",
+		func(enc *Encoder, m pref.Message) (interface{}, error) {
+			doc, err := enc.MarshalFields(m)
+			if err != nil {
+				return nil, err
+			}
+			return append(bson.D{{Key: "_v", Value: int32(1)}}, doc...), nil
+		},
+		func(dec *Decoder, val interface{}, m pref.Message) error {
+			doc, ok := val.(bson.D)
+			if !ok || len(doc) == 0 || doc[0].Key != "_v" {
+				return fmt.Errorf("missing version")
+			}
+			return dec.UnmarshalFields(doc[1:], m)
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.Register("google.protobuf.Timestamp",
+		func(enc *Encoder, m pref.Message) (interface{}, error) {
+			return m.Interface().(*timestamppb.Timestamp).GetSeconds(), nil
+		},
+		func(dec *Decoder, val interface{}, m pref.Message) error {
+			seconds, ok := val.(int64)
+			if !ok {
+				return fmt.Errorf("invalid timestamp %v", val)
+			}
+			proto.Merge(m.Interface(), timestamppb.New(time.Unix(seconds, 0)))
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestTypeRegistry(t *testing.T) {
+	types := testTypes(t)
+	anyNested, err := anypb.New(&pb2.Nested{OptString: proto.String("embedded")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc  string
+		input proto.Message
+		want  bson.D
+	}{{
+		desc: "custom types",
+		input: &pb2.Nests{
+			OptNested: &pb2.Nested{OptString: proto.String("a")},
+			RptNested: []*pb2.Nested{
+				{OptString: proto.String("b")},
+				{OptString: proto.String("c"), OptNested: &pb2.Nested{OptString: proto.String("d")}},
+			},
+		},
+		want: bson.D{
+			{Key: "optNested", Value: "a"},
+			{Key: "rptNested", Value: bson.A{"b", bson.A{"c", "d"}}},
+		},
+	}, {
+		desc: "default fields",
+		input: &pb3.Nests{SNested: &pb3.Nested{
+			SString: "x",
+			SNested: &pb3.Nested{SString: "y"},
+		}},
+		want: bson.D{{Key: "sNested", Value: bson.D{
+			{Key: "_v", Value: int32(1)},
+			{Key: "sString", Value: "x"},
+			{Key: "sNested", Value: bson.D{{Key: "_v", Value: int32(1)}, {Key: "sString", Value: "y"}}},
+		}}},
+	}, {
+		desc: "well-known types",
+		input: &pb2.KnownTypes{
+			OptTimestamp: timestamppb.New(time.Unix(1000, 0)),
+			OptAny:       anyNested,
+		},
+		want: bson.D{
+			{Key: "optTimestamp", Value: int64(1000)},
+			{Key: "optAny", Value: bson.D{
+				{Key: "@type", Value: "type.googleapis.com/textpb2_proto.Nested"},
+				{Key: "value", Value: "embedded"},
+			}},
+		},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := MarshalOptions{Types: types}.Marshal(tt.input)
+			if err != nil {
+				t.Fatalf("Marshal() got error: %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Marshal() diff -want +got\n%v\n", diff)
+			}
+
+			decoded := tt.input.ProtoReflect().New().Interface()
+			if err := (UnmarshalOptions{Types: types}).Unmarshal(got, decoded); err != nil {
+				t.Fatalf("Unmarshal() got error: %v", err)
+			}
+			if !proto.Equal(decoded, tt.input) {
+				t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", decoded, tt.input)
+			}
+		})
+	}
+}
+
+func TestTypeRegistryErrors(t *testing.T) {
+	types := testTypes(t)
+	umo := UnmarshalOptions{Types: types}
+
+	err := umo.Unmarshal(bson.D{{Key: "rptNested", Value: bson.A{"a", int32(1)}}}, &pb2.Nests{})
+	if want := "rptNested[1]: invalid nested value 1"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Unmarshal() got error %v, want %q", err, want)
+	}
+
+	umo.RecursionLimit = 3
+	deep := bson.A{"a", bson.A{"b", bson.A{"c", "d"}}}
+	err = umo.Unmarshal(bson.D{{Key: "optNested", Value: deep}}, &pb2.Nests{})
+	if want := "exceeded maximum recursion depth of 3"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Unmarshal() got error %v, want %q", err, want)
+	}
+
+	noop := func(*Encoder, pref.Message) (interface{}, error) { return nil, nil }
+	if err := types.Register("textpb2_proto.Nested", noop, nil); err == nil || !strings.Contains(err.Error(), "already registered") {
+		t.Errorf("Register() got error %v, want already registered", err)
+	}
+	if err := types.Register("not a name", noop, nil); err == nil || !strings.Contains(err.Error(), "invalid message name") {
+		t.Errorf("Register() got error %v, want invalid message name", err)
+	}
+	if err := types.Register("textpb2_proto.Scalars", nil, nil); err == nil || !strings.Contains(err.Error(), "no functions given") {
+		t.Errorf("Register() got error %v, want no functions given", err)
+	}
+}
@@ -0,0 +1,63 @@
+package bsonpb
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/encoding/protowire"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// DefaultUnknownFieldsKey is a suggested key for UnknownFieldsKey.
+const DefaultUnknownFieldsKey = "_unknown"
+
+// withUnknownFields appends the unknown fields of the message m to its
+// marshaled fields, as binary under UnknownFieldsKey.
+func (e encoder) withUnknownFields(result bson.D, m pref.Message) (bson.D, error) {
+	key := e.opts.UnknownFieldsKey
+	raw := m.GetUnknown()
+	if key == "" || len(raw) == 0 || e.mask != nil {
+		return result, nil
+	}
+	for _, elem := range result {
+		if elem.Key == key {
+			return bson.D{}, unknownFieldsKeyConflict(key)
+		}
+	}
+	return append(result, bson.E{Key: key, Value: primitive.Binary{Data: append([]byte(nil), raw...)}}), nil
+}
+
+// unknownFieldsKeyConflict returns the error for an unknown fields key that
+// is also the key of a field.
+func unknownFieldsKeyConflict(key string) error {
+	return withField(newError(CategoryDuplicateField, "unknown fields key %q conflicts with a field", key), key)
+}
+
+// unmarshalUnknownFields adds the unknown fields stored under
+// UnknownFieldsKey to the message m.
+func (d decoder) unmarshalUnknownFields(val interface{}, m pref.Message) error {
+	var raw []byte
+	switch v := val.(type) {
+	case primitive.Binary:
+		raw = v.Data
+	case []byte:
+		raw = v
+	default:
+		return newValueError(CategoryTypeMismatch, pref.BytesKind, val, "invalid unknown fields: %v", val)
+	}
+	for b := raw; len(b) > 0; {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n >= 0 {
+			b = b[n:]
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return newError(CategoryInvalidValue, "invalid unknown fields: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	if err := d.countBytes(len(raw)); err != nil {
+		return err
+	}
+	m.SetUnknown(append(m.GetUnknown(), raw...))
+	return nil
+}
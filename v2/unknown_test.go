@@ -0,0 +1,148 @@
+package bsonpb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	pb3 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb3_proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/testing/protopack"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+func TestUnknownFields(t *testing.T) {
+	raw := protopack.Message{
+		protopack.Tag{Number: 101, Type: protopack.BytesType}, protopack.String("hello"),
+		protopack.Tag{Number: 102, Type: protopack.VarintType}, protopack.Varint(7),
+	}.Marshal()
+	withUnknown := func(m proto.Message) proto.Message {
+		m.ProtoReflect().SetUnknown(raw)
+		return m
+	}
+
+	tests := []struct {
+		desc  string
+		mo    MarshalOptions
+		input proto.Message
+		want  bson.D
+	}{{
+		desc:  "top-level message",
+		mo:    MarshalOptions{UnknownFieldsKey: DefaultUnknownFieldsKey},
+		input: withUnknown(&pb3.Nested{SString: "x"}),
+		want: bson.D{
+			{Key: "sString", Value: "x"},
+			{Key: "_unknown", Value: primitive.Binary{Data: raw}},
+		},
+	}, {
+		desc: "nested message",
+		mo:   MarshalOptions{UnknownFieldsKey: "@unknown", Deterministic: true, FieldOrder: OrderByName},
+		input: &pb3.Nests{SNested: withUnknown(&pb3.Nested{
+			SString: "x",
+			SNested: &pb3.Nested{SString: "y"},
+		}).(*pb3.Nested)},
+		want: bson.D{{Key: "sNested", Value: bson.D{
+			{Key: "sNested", Value: bson.D{{Key: "sString", Value: "y"}}},
+			{Key: "sString", Value: "x"},
+			{Key: "@unknown", Value: primitive.Binary{Data: raw}},
+		}}},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := tt.mo.Marshal(tt.input)
+			if err != nil {
+				t.Fatalf("Marshal() got error: %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Marshal() diff -want +got\n%v\n", diff)
+			}
+
+			decoded := tt.input.ProtoReflect().New().Interface()
+			if err := (UnmarshalOptions{UnknownFieldsKey: tt.mo.UnknownFieldsKey}).Unmarshal(got, decoded); err != nil {
+				t.Fatalf("Unmarshal() got error: %v", err)
+			}
+			if !proto.Equal(decoded, tt.input) {
+				t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", decoded, tt.input)
+			}
+		})
+	}
+
+	// Unknown fields are dropped by default and if a mask is set.
+	input := withUnknown(&pb3.Nested{SString: "x"})
+	for _, mo := range []MarshalOptions{
+		{},
+		{UnknownFieldsKey: DefaultUnknownFieldsKey, Mask: &fieldmaskpb.FieldMask{Paths: []string{"s_string"}}},
+	} {
+		got, err := mo.Marshal(input)
+		if err != nil {
+			t.Fatalf("Marshal() got error: %v", err)
+		}
+		if want := (bson.D{{Key: "sString", Value: "x"}}); !cmp.Equal(want, got) {
+			t.Errorf("Marshal() got %v, want %v", got, want)
+		}
+	}
+
+	// Merging appends the unknown fields.
+	doc := bson.D{{Key: "_unknown", Value: primitive.Binary{Data: raw}}}
+	umo := UnmarshalOptions{UnknownFieldsKey: DefaultUnknownFieldsKey, Merge: true}
+	merged := withUnknown(&pb3.Nested{})
+	if err := umo.Unmarshal(doc, merged); err != nil {
+		t.Fatalf("Unmarshal() got error: %v", err)
+	}
+	if got, want := merged.ProtoReflect().GetUnknown(), append(append([]byte(nil), raw...), raw...); !cmp.Equal([]byte(got), want) {
+		t.Errorf("Unmarshal() got unknown fields %x, want %x", got, want)
+	}
+}
+
+func TestUnknownFieldsErrors(t *testing.T) {
+	m := &pb3.Nested{SString: "x"}
+	m.ProtoReflect().SetUnknown(protopack.Message{protopack.Tag{Number: 101, Type: protopack.VarintType}, protopack.Varint(1)}.Marshal())
+	_, err := MarshalOptions{UnknownFieldsKey: "sString"}.Marshal(m)
+	if want := `sString: unknown fields key "sString" conflicts with a field`; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Marshal() got error %v, want %q", err, want)
+	}
+
+	tests := []struct {
+		desc      string
+		umo       UnmarshalOptions
+		inputBson bson.D
+		wantErr   string
+	}{{
+		desc:      "not enabled",
+		inputBson: bson.D{{Key: "_unknown", Value: primitive.Binary{}}},
+		wantErr:   `unknown field "_unknown"`,
+	}, {
+		desc:      "invalid type",
+		umo:       UnmarshalOptions{UnknownFieldsKey: "_unknown"},
+		inputBson: bson.D{{Key: "_unknown", Value: "x"}},
+		wantErr:   "_unknown: invalid unknown fields: x",
+	}, {
+		desc:      "invalid wire format",
+		umo:       UnmarshalOptions{UnknownFieldsKey: "_unknown"},
+		inputBson: bson.D{{Key: "_unknown", Value: []byte{0x0a, 0x05, 'x'}}},
+		wantErr:   "_unknown: invalid unknown fields: unexpected EOF",
+	}, {
+		desc: "duplicate key",
+		umo:  UnmarshalOptions{UnknownFieldsKey: "_unknown"},
+		inputBson: bson.D{
+			{Key: "_unknown", Value: primitive.Binary{}},
+			{Key: "_unknown", Value: primitive.Binary{}},
+		},
+		wantErr: `_unknown: duplicate field "_unknown"`,
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			err := tt.umo.Unmarshal(tt.inputBson, &pb3.Nested{})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Unmarshal() got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
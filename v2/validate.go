@@ -0,0 +1,181 @@
+package bsonpb
+
+import (
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/proto"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Validate decodes the given document into a new message of the given
+// descriptor and reports every unknown field, type mismatch, duplicate field,
+// oneof conflict and missing required field as Errors. It returns nil if the
+// document is valid.
+func Validate(doc interface{}, md pref.MessageDescriptor) error {
+	return UnmarshalOptions{AllErrors: true}.Unmarshal(doc, dynamicpb.NewMessage(md))
+}
+
+// requiredPaths reports missing required fields at the document keys that
+// hold them. Documents being decoded are searched for the keys they use.
+// Otherwise, and for fields missing from the document, keys are named like
+// the encoder names them.
+type requiredPaths struct {
+	useProtoNames bool
+	oneofEncoding OneofEncoding
+}
+
+// missingRequired returns an Error for every required field that is not set
+// in m or any of its submessages, in field order. doc is the document m was
+// decoded from or nil.
+func (p requiredPaths) missingRequired(m pref.Message, doc interface{}) Errors {
+	var errs Errors
+	md := m.Descriptor()
+	docD, _ := doc.(bson.D)
+	if useProtoNames, ok := documentNaming(docD, md); ok {
+		p.useProtoNames = useProtoNames
+	}
+	// Invalid inline fields are reported by the encoder and decoder.
+	inline, _ := analyzeInline(md)
+	fieldDescs := md.Fields()
+	for i := 0; i < fieldDescs.Len(); i++ {
+		fd := fieldDescs.Get(i)
+		if !m.Has(fd) {
+			if fd.Cardinality() == pref.Required {
+				errs.add(withPath(newError(CategoryMissingRequired, "required field %v not set", fd.FullName()), p.fieldPath(fd)))
+			}
+			continue
+		}
+		if inline.isInline(fd) {
+			// The fields of inlined messages are part of the same document.
+			errs.add(p.missingRequired(m.Get(fd).Message(), doc).err())
+			continue
+		}
+		path, val := p.lookup(docD, md, fd)
+		errs.add(withPath(p.missingRequiredValue(m.Get(fd), fd, val), path))
+	}
+
+	var extensions []pref.FieldDescriptor
+	m.Range(func(fd pref.FieldDescriptor, _ pref.Value) bool {
+		if fd.IsExtension() {
+			extensions = append(extensions, fd)
+		}
+		return true
+	})
+	sort.Slice(extensions, func(i, j int) bool {
+		return extensions[i].Number() < extensions[j].Number()
+	})
+	for _, fd := range extensions {
+		key := "[" + string(fd.FullName()) + "]"
+		errs.add(withField(p.missingRequiredValue(m.Get(fd), fd, documentValue(docD, key)), key))
+	}
+	return errs
+}
+
+// missingRequiredValue checks the submessages of the given field value. doc
+// is the value the field was decoded from or nil.
+func (p requiredPaths) missingRequiredValue(v pref.Value, fd pref.FieldDescriptor, doc interface{}) error {
+	var errs Errors
+	switch {
+	case fd.IsList():
+		if fd.Message() == nil {
+			return nil
+		}
+		list := v.List()
+		if key, _ := keyField(fd); key != nil {
+			docD, _ := doc.(bson.D)
+			for i := 0; i < list.Len(); i++ {
+				k := list.Get(i).Message().Get(key).MapKey().String()
+				errs.add(withMapKey(p.missingRequired(list.Get(i).Message(), documentValue(docD, k)).err(), k, key.Kind()))
+			}
+			break
+		}
+		arr, _ := doc.(bson.A)
+		for i := 0; i < list.Len(); i++ {
+			var elem interface{}
+			if i < len(arr) {
+				elem = arr[i]
+			}
+			errs.add(withIndex(p.missingRequired(list.Get(i).Message(), elem).err(), i))
+		}
+	case fd.IsMap():
+		if fd.MapValue().Message() == nil {
+			return nil
+		}
+		var entries []mapEntry
+		v.Map().Range(func(key pref.MapKey, val pref.Value) bool {
+			entries = append(entries, mapEntry{key: key, value: val})
+			return true
+		})
+		sortMap(fd.MapKey().Kind(), entries)
+		docD, _ := doc.(bson.D)
+		for _, entry := range entries {
+			k := entry.key.String()
+			errs.add(withMapKey(p.missingRequired(entry.value.Message(), documentValue(docD, k)).err(), k, fd.MapKey().Kind()))
+		}
+	case fd.Message() != nil:
+		return p.missingRequired(v.Message(), doc).err()
+	}
+	return errs.err()
+}
+
+// fieldPath returns the path of the field fd as the encoder writes it.
+func (p requiredPaths) fieldPath(fd pref.FieldDescriptor) string {
+	if od := fd.ContainingOneof(); od != nil && !od.IsSynthetic() && p.oneofEncoding == OneofTagged {
+		return joinPath(oneofKey(od, p.useProtoNames), oneofValueKey)
+	}
+	return fieldKey(fd, p.useProtoNames)
+}
+
+// lookup returns the path of the field fd of a message of type md and its
+// value in doc, which may be nil.
+func (p requiredPaths) lookup(doc bson.D, md pref.MessageDescriptor, fd pref.FieldDescriptor) (string, interface{}) {
+	for _, elem := range doc {
+		if fieldByKey(md, elem.Key) == fd {
+			return elem.Key, elem.Value
+		}
+		od, discriminator := oneofByKey(md, elem.Key)
+		if od == nil || discriminator || od != fd.ContainingOneof() {
+			continue
+		}
+		// Tagged oneofs hold the value of the set field under "value".
+		if tagged, ok := elem.Value.(bson.D); ok {
+			return joinPath(elem.Key, oneofValueKey), documentValue(tagged, oneofValueKey)
+		}
+	}
+	return p.fieldPath(fd), nil
+}
+
+// documentNaming reports whether the keys of doc, a document of a message of
+// type md, are proto names rather than JSON names. It reports false for ok if
+// no key tells them apart.
+func documentNaming(doc bson.D, md pref.MessageDescriptor) (useProtoNames, ok bool) {
+	for _, elem := range doc {
+		fd := fieldByKey(md, elem.Key)
+		if fd == nil || fieldKey(fd, true) == fd.JSONName() {
+			continue
+		}
+		return elem.Key != fd.JSONName(), true
+	}
+	return false, false
+}
+
+// documentValue returns the value of the given key in doc or nil.
+func documentValue(doc bson.D, key string) interface{} {
+	for _, elem := range doc {
+		if elem.Key == key {
+			return elem.Value
+		}
+	}
+	return nil
+}
+
+// checkAllInitialized reports every missing required field of m, which was
+// decoded from doc.
+func checkAllInitialized(m proto.Message, doc interface{}) Errors {
+	if proto.CheckInitialized(m) == nil {
+		return nil
+	}
+	return requiredPaths{}.missingRequired(m.ProtoReflect(), doc)
+}
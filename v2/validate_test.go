@@ -0,0 +1,196 @@
+package bsonpb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	pb2 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb2_proto"
+	pb3 "github.com/romnn/bsonpb/internal/testprotos/v2/textpb3_proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/proto"
+	pref "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		desc       string
+		md         pref.MessageDescriptor
+		inputBson  interface{}
+		wantErrors []string
+	}{{
+		desc:      "valid document",
+		md:        (&pb3.Nests{}).ProtoReflect().Descriptor(),
+		inputBson: bson.D{{Key: "sNested", Value: bson.D{{Key: "sString", Value: "ok"}}}},
+	}, {
+		desc: "every problem is reported",
+		md:   (&pb2.IndirectRequired{}).ProtoReflect().Descriptor(),
+		inputBson: bson.D{
+			{Key: "unknown", Value: 1},
+			{Key: "optNested", Value: bson.D{
+				{Key: "reqString", Value: 5},
+				{Key: "other", Value: "x"},
+			}},
+			{Key: "rptNested", Value: bson.A{
+				bson.D{{Key: "reqString", Value: "ok"}},
+				bson.D{},
+				"not a document",
+			}},
+			{Key: "oneofNested", Value: bson.D{{Key: "reqString", Value: "a"}}},
+			{Key: "opt_nested", Value: bson.D{}},
+		},
+		wantErrors: []string{
+			`unknown: unknown field "unknown"`,
+			`optNested.reqString: invalid value for string type: 5 (has type int)`,
+			`optNested.other: unknown field "other"`,
+			`rptNested[2]: unexpected message value: not a document`,
+			`opt_nested: duplicate field "opt_nested"`,
+			`optNested.reqString: required field textpb2_proto.NestedWithRequired.req_string not set`,
+			`rptNested[1].reqString: required field textpb2_proto.NestedWithRequired.req_string not set`,
+		},
+	}, {
+		desc: "map and list errors",
+		md:   (&pb3.Maps{}).ProtoReflect().Descriptor(),
+		inputBson: bson.D{
+			{Key: "int32ToStr", Value: bson.D{
+				{Key: "one", Value: "1"},
+				{Key: "2", Value: 2},
+				{Key: "3", Value: "3"},
+			}},
+			{Key: "strToOneofs", Value: bson.D{
+				{Key: "x", Value: bson.D{
+					{Key: "oneofString", Value: "a"},
+					{Key: "oneofEnum", Value: "ONE"},
+				}},
+			}},
+		},
+		wantErrors: []string{
+			`int32ToStr[one]: invalid value for int32 key: "one"`,
+			`int32ToStr[2]: invalid value for string type: 2 (has type int)`,
+			`strToOneofs["x"].oneofEnum: error parsing "oneofEnum", oneof textpb3_proto.Oneofs.union is already set`,
+		},
+	}, {
+		desc: "list type mismatches",
+		md:   (&pb2.Nests{}).ProtoReflect().Descriptor(),
+		inputBson: bson.D{
+			{Key: "rptNested", Value: "x"},
+			{Key: "RptGroup", Value: bson.D{{Key: "rptString", Value: bson.A{"a"}}}},
+		},
+		wantErrors: []string{
+			`rptNested: unexpected list value: x`,
+			`RptGroup: unexpected list value: [{rptString [a]}]`,
+		},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			err := Validate(tt.inputBson, tt.md)
+			var got []string
+			if err != nil {
+				var errs Errors
+				if !errors.As(err, &errs) {
+					t.Fatalf("Validate() got error %v (%T), want Errors", err, err)
+				}
+				for _, e := range errs {
+					got = append(got, e.Error())
+				}
+			}
+			if diff := cmp.Diff(tt.wantErrors, got); diff != "" {
+				t.Errorf("Validate() errors diff -want +got\n%v\n", diff)
+			}
+		})
+	}
+}
+
+func TestMissingRequiredPaths(t *testing.T) {
+	missing := func(path string) string {
+		return path + ": required field textpb2_proto.NestedWithRequired.req_string not set"
+	}
+	tests := []struct {
+		desc       string
+		mo         MarshalOptions
+		input      proto.Message
+		inputBson  bson.D // validated unless nil
+		wantErrors []string
+	}{{
+		desc:       "proto names",
+		mo:         MarshalOptions{UseProtoNames: true},
+		input:      &pb2.IndirectRequired{OptNested: &pb2.NestedWithRequired{}},
+		inputBson:  bson.D{{Key: "opt_nested", Value: bson.D{}}},
+		wantErrors: []string{missing("opt_nested.req_string")},
+	}, {
+		desc:  "integer map keys",
+		input: &pb2.IndirectRequired{Int32ToNested: map[int32]*pb2.NestedWithRequired{10: {}, 9: {}}},
+		inputBson: bson.D{{Key: "int32ToNested", Value: bson.D{
+			{Key: "10", Value: bson.D{}},
+			{Key: "9", Value: bson.D{}},
+		}}},
+		wantErrors: []string{missing("int32ToNested[9].reqString"), missing("int32ToNested[10].reqString")},
+	}, {
+		desc:       "tagged oneof",
+		mo:         MarshalOptions{OneofEncoding: OneofTagged},
+		input:      &pb2.IndirectRequired{Union: &pb2.IndirectRequired_OneofNested{OneofNested: &pb2.NestedWithRequired{}}},
+		inputBson:  bson.D{{Key: "union", Value: bson.D{{Key: "case", Value: "oneofNested"}, {Key: "value", Value: bson.D{}}}}},
+		wantErrors: []string{missing("union.value.reqString")},
+	}, {
+		desc:       "inlined fields",
+		input:      &pb2.InlinedRequired{Name: proto.String("x"), Nested: &pb2.NestedWithRequired{}},
+		wantErrors: []string{"reqString: required field textpb2_proto.NestedWithRequired.req_string not set"},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			_, err := tt.mo.Marshal(tt.input)
+			if want := tt.wantErrors[0]; err == nil || err.Error() != want {
+				t.Errorf("Marshal() got error %v, want %q", err, want)
+			}
+
+			if tt.inputBson == nil {
+				return
+			}
+			err = Validate(tt.inputBson, tt.input.ProtoReflect().Descriptor())
+			var got []string
+			var errs Errors
+			if errors.As(err, &errs) {
+				for _, e := range errs {
+					got = append(got, e.Error())
+				}
+			}
+			if diff := cmp.Diff(tt.wantErrors, got); diff != "" {
+				t.Errorf("Validate() errors diff -want +got\n%v\n", diff)
+			}
+		})
+	}
+}
+
+func TestUnmarshalAllErrorsPopulatesMessage(t *testing.T) {
+	got := &pb3.Maps{}
+	err := UnmarshalOptions{AllErrors: true}.Unmarshal(bson.D{
+		{Key: "int32ToStr", Value: bson.D{
+			{Key: "1", Value: "one"},
+			{Key: "2", Value: 2},
+		}},
+		{Key: "strToNested", Value: bson.D{
+			{Key: "x", Value: bson.D{
+				{Key: "sString", Value: "nested"},
+				{Key: "unknown", Value: true},
+			}},
+		}},
+	}, got)
+	var errs Errors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("Unmarshal() got error %v, want 2 errors", err)
+	}
+	want := &pb3.Maps{
+		Int32ToStr: map[int32]string{1: "one"},
+		StrToNested: map[string]*pb3.Nested{
+			"x": {SString: "nested"},
+		},
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("Unmarshal()\n<got>\n%v\n<want>\n%v\n", got, want)
+	}
+}
@@ -2,7 +2,6 @@ package bsonpb
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"reflect"
 	"strconv"
@@ -12,6 +11,7 @@ import (
 
 	"github.com/romnn/bsonpb/v2/internal/genid"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"google.golang.org/protobuf/proto"
 	pref "google.golang.org/protobuf/reflect/protoreflect"
@@ -98,6 +98,13 @@ func wellKnownTypeUnmarshaler(name pref.FullName) unmarshalFunc {
 // contains the type URL. If the embedded message type is well-known and has a
 // custom JSON representation, that representation will be embedded adding a
 // field `value` which holds the custom JSON in addition to the `@type` field.
+//
+// With AllowUnresolvedAny, an Any message of an unresolvable type is
+// represented by the `@type` field and a field `@value` holding the serialized
+// message as binary.
+
+// anyRawValueKey is the key of the serialized message of an unresolved Any.
+const anyRawValueKey = "@value"
 
 func (e encoder) marshalAny(m pref.Message) (interface{}, error) {
 	result := bson.D{}
@@ -111,7 +118,7 @@ func (e encoder) marshalAny(m pref.Message) (interface{}, error) {
 			return bson.D{}, nil
 		}
 		// Return error if type_url field is not set, but value is set.
-		return nil, fmt.Errorf("%s: %v is not set", genid.Any_message_fullname, genid.Any_TypeUrl_field_name)
+		return nil, newError(CategoryInvalidValue, "%s: %v is not set", genid.Any_message_fullname, genid.Any_TypeUrl_field_name)
 	}
 
 	typeVal := m.Get(fdType)
@@ -123,8 +130,13 @@ func (e encoder) marshalAny(m pref.Message) (interface{}, error) {
 
 	// Resolve the type in order to unmarshal value field.
 	emt, err := e.opts.Resolver.FindMessageByURL(typeURL)
+	if err != nil && e.opts.AllowUnresolvedAny {
+		// Keep the serialized message as is.
+		result = append(result, bson.E{Key: anyRawValueKey, Value: primitive.Binary{Data: valueVal.Bytes()}})
+		return result, nil
+	}
 	if err != nil {
-		return result, fmt.Errorf("%s: unable to resolve %q: %v", genid.Any_message_fullname, typeURL, err)
+		return result, newError(CategoryUnresolvable, "%s: unable to resolve %q: %v", genid.Any_message_fullname, typeURL, err)
 	}
 
 	em := emt.New()
@@ -133,16 +145,16 @@ func (e encoder) marshalAny(m pref.Message) (interface{}, error) {
 		Resolver:     e.opts.Resolver,
 	}.Unmarshal(valueVal.Bytes(), em.Interface())
 	if err != nil {
-		return result, fmt.Errorf("%s: unable to unmarshal %q: %v", genid.Any_message_fullname, typeURL, err)
+		return result, newError(CategoryInvalidValue, "%s: unable to unmarshal %q: %v", genid.Any_message_fullname, typeURL, err)
 	}
 
 	// If type of value has custom JSON encoding, marshal out a field "value"
 	// with corresponding custom JSON encoding of the embedded message as a
 	// field.
-	if marshal := wellKnownTypeMarshaler(emt.Descriptor().FullName()); marshal != nil {
+	if marshal := e.typeMarshaler(emt.Descriptor().FullName()); marshal != nil {
 		val, err := marshal(e, em)
 		if err != nil {
-			return result, err
+			return result, withField(err, "value")
 		}
 		result = append(result, bson.E{Key: "value", Value: val})
 		return result, nil
@@ -163,8 +175,11 @@ func (d decoder) unmarshalAny(val interface{}, m pref.Message) error {
 	// Use another decoder to parse the unread bytes for @type field. This
 	// avoids advancing a read from current decoder because the current JSON
 	// object may contain the fields of the embedded type.
-	valD := val.(bson.D)
-	var found, nonEmpty, ok bool
+	valD, ok := val.(bson.D)
+	if !ok {
+		return newValueError(CategoryTypeMismatch, pref.MessageKind, val, "invalid %v value: %v", genid.Any_message_fullname, val)
+	}
+	var found, nonEmpty, raw bool
 	var typeURL string
 	for _, item := range valD {
 		switch item.Key {
@@ -172,15 +187,21 @@ func (d decoder) unmarshalAny(val interface{}, m pref.Message) error {
 			nonEmpty = true
 			if found {
 				// Duplicate
-				return errors.New("duplicate @type field")
+				return withField(newError(CategoryDuplicateField, "duplicate @type field"), "@type")
 			}
 			typeURL, ok = item.Value.(string)
 			if !ok || typeURL == "" {
-				return errors.New("@type field contains empty or invalid value")
+				return withField(newValueError(CategoryInvalidValue, pref.StringKind, item.Value, "@type field contains empty or invalid value"), "@type")
 			}
 			found = true
 		case "value":
 			nonEmpty = true
+		case anyRawValueKey:
+			if d.opts.AllowUnresolvedAny {
+				nonEmpty, raw = true, true
+			} else if !d.opts.DiscardUnknown {
+				nonEmpty = true
+			}
 		default:
 			if !d.opts.DiscardUnknown {
 				nonEmpty = true
@@ -191,20 +212,23 @@ func (d decoder) unmarshalAny(val interface{}, m pref.Message) error {
 		return nil
 	}
 	if !found {
-		return errors.New("missing @type field in non-empty message")
+		return newError(CategoryMissingRequired, "missing @type field in non-empty message")
+	}
+	if raw {
+		return d.unmarshalRawAny(valD, typeURL, m)
 	}
 
 	emt, err := d.opts.Resolver.FindMessageByURL(typeURL)
 	if err != nil {
-		return fmt.Errorf("unable to resolve %q: %s", typeURL, strings.Replace(err.Error(), "\u00a0", " ", -1))
+		return withField(newError(CategoryUnresolvable, "unable to resolve %q: %s", typeURL, strings.Replace(err.Error(), "\u00a0", " ", -1)), "@type")
 	}
 
 	// Create new message for the embedded message type and unmarshal into it.
 	em := emt.New()
-	if umFunc := wellKnownTypeUnmarshaler(emt.Descriptor().FullName()); umFunc != nil {
+	if d.typeUnmarshaler(emt.Descriptor().FullName()) != nil {
 		// If embedded message is a custom type,
 		// unmarshal the JSON "value" field into it.
-		if err := d.unmarshalAnyValue(valD, umFunc, em); err != nil {
+		if err := d.unmarshalAnyValue(valD, em); err != nil {
 			return err
 		}
 	} else {
@@ -239,32 +263,70 @@ func (d decoder) unmarshalAny(val interface{}, m pref.Message) error {
 	return nil
 }
 
-func (d decoder) unmarshalAnyValue(val bson.D, umFunc unmarshalFunc, m pref.Message) error {
+// unmarshalRawAny sets the serialized message of an Any message of the form
+// {"@type": url, "@value": Binary} as is, whether its type resolves or not.
+func (d decoder) unmarshalRawAny(val bson.D, typeURL string, m pref.Message) error {
+	var b []byte
+	for _, item := range val {
+		switch item.Key {
+		case "@type":
+		case anyRawValueKey:
+			switch v := item.Value.(type) {
+			case primitive.Binary:
+				b = v.Data
+			case []byte:
+				b = v
+			default:
+				return withField(newValueError(CategoryTypeMismatch, pref.BytesKind, item.Value, "invalid %s value: %v", anyRawValueKey, item.Value), item.Key)
+			}
+		default:
+			if !d.opts.DiscardUnknown {
+				return withField(newError(CategoryUnknownField, "unknown field %q next to %s", item.Key, anyRawValueKey), item.Key)
+			}
+		}
+	}
+	if err := d.countBytes(len(b)); err != nil {
+		return withField(err, anyRawValueKey)
+	}
+	fds := m.Descriptor().Fields()
+	m.Set(fds.ByNumber(genid.Any_TypeUrl_field_number), pref.ValueOfString(typeURL))
+	m.Set(fds.ByNumber(genid.Any_Value_field_number), pref.ValueOfBytes(b))
+	return nil
+}
+
+func (d decoder) unmarshalAnyValue(val bson.D, m pref.Message) error {
 	var found bool
+	var errs Errors
 	for _, item := range val {
 		switch item.Key {
 		case "@type":
 			// Skip the value as this was previously parsed already.
 		case "value":
 			if found {
-				return fmt.Errorf(`duplicate "value" field`)
+				return withField(newError(CategoryDuplicateField, `duplicate "value" field`), "value")
 			}
 			// Unmarshal the field value into the given message.
-			if err := umFunc(d, item.Value, m); err != nil {
-				return err
+			if err := d.unmarshalMessage(item.Value, m, false); err != nil {
+				if err := d.collect(&errs, withField(err, "value")); err != nil {
+					return err
+				}
 			}
 			found = true
 		default:
 			if d.opts.DiscardUnknown {
 				continue
 			}
-			return fmt.Errorf("unknown field %q", item.Key)
+			if err := d.collect(&errs, withField(newError(CategoryUnknownField, "unknown field %q", item.Key), item.Key)); err != nil {
+				return err
+			}
 		}
 	}
 	if !found {
-		return fmt.Errorf(`missing "value" field`)
+		if err := d.collect(&errs, newError(CategoryMissingRequired, `missing "value" field`)); err != nil {
+			return err
+		}
 	}
-	return nil
+	return errs.err()
 }
 
 // Wrapper types are encoded as JSON primitives like string, number or boolean.
@@ -292,15 +354,18 @@ func (e encoder) marshalEmpty(pref.Message) (interface{}, error) {
 }
 
 func (d decoder) unmarshalEmpty(val interface{}, m pref.Message) error {
+	var errs Errors
 	if valD, ok := val.(bson.D); ok {
 		for _, item := range valD {
 			if d.opts.DiscardUnknown {
 				continue
 			}
-			return fmt.Errorf("unknown field %q", item.Key)
+			if err := d.collect(&errs, withField(newError(CategoryUnknownField, "unknown field %q", item.Key), item.Key)); err != nil {
+				return err
+			}
 		}
 	}
-	return nil
+	return errs.err()
 }
 
 // The JSON representation for Struct is a JSON object that contains the encoded
@@ -312,8 +377,12 @@ func (e encoder) marshalStruct(m pref.Message) (interface{}, error) {
 }
 
 func (d decoder) unmarshalStruct(val interface{}, m pref.Message) error {
+	valD, ok := val.(bson.D)
+	if !ok {
+		return newValueError(CategoryTypeMismatch, pref.MessageKind, val, "invalid %v value: %v", genid.Struct_message_fullname, val)
+	}
 	fd := m.Descriptor().Fields().ByNumber(genid.Struct_Fields_field_number)
-	return d.unmarshalMap(val.(bson.D), m.Mutable(fd).Map(), fd)
+	return d.unmarshalMap(valD, m.Mutable(fd).Map(), fd)
 }
 
 // The JSON representation for ListValue is JSON array that contains the encoded
@@ -326,8 +395,12 @@ func (e encoder) marshalListValue(m pref.Message) (interface{}, error) {
 }
 
 func (d decoder) unmarshalListValue(val interface{}, m pref.Message) error {
+	valA, ok := val.(bson.A)
+	if !ok {
+		return newValueError(CategoryTypeMismatch, pref.MessageKind, val, "invalid %v value: %v", genid.ListValue_message_fullname, val)
+	}
 	fd := m.Descriptor().Fields().ByNumber(genid.ListValue_Values_field_number)
-	return d.unmarshalList(val.(bson.A), m.Mutable(fd).List(), fd)
+	return d.unmarshalList(valA, m.Mutable(fd).List(), fd)
 }
 
 // The JSON representation for a Value is dependent on the oneof field that is
@@ -338,7 +411,7 @@ func (e encoder) marshalKnownValue(m pref.Message) (interface{}, error) {
 	od := m.Descriptor().Oneofs().ByName(genid.Value_Kind_oneof_name)
 	fd := m.WhichOneof(od)
 	if fd == nil {
-		return nil, fmt.Errorf("%s: none of the oneof fields is set", genid.Value_message_fullname)
+		return nil, newError(CategoryInvalidValue, "%s: none of the oneof fields is set", genid.Value_message_fullname)
 	}
 	return e.marshalSingular(m.Get(fd), fd)
 }
@@ -346,9 +419,13 @@ func (e encoder) marshalKnownValue(m pref.Message) (interface{}, error) {
 func (d decoder) unmarshalKnownValue(val interface{}, m pref.Message) error {
 	var fd pref.FieldDescriptor
 	var pval pref.Value
-	valT := reflect.TypeOf(val)
 	valV := reflect.ValueOf(val)
-	switch valT.Kind() {
+	switch valV.Kind() {
+	case reflect.Invalid:
+		// BSON null is decoded as nil.
+		fd = m.Descriptor().Fields().ByNumber(genid.Value_NullValue_field_number)
+		pval = pref.ValueOfEnum(0)
+
 	case reflect.Bool:
 		fd = m.Descriptor().Fields().ByNumber(genid.Value_BoolValue_field_number)
 		pval = pref.ValueOfBool(valV.Bool())
@@ -357,14 +434,16 @@ func (d decoder) unmarshalKnownValue(val interface{}, m pref.Message) error {
 		reflect.Int8,
 		reflect.Int16,
 		reflect.Int32,
-		reflect.Int64,
-		reflect.Uint,
+		reflect.Int64:
+		fd = m.Descriptor().Fields().ByNumber(genid.Value_NumberValue_field_number)
+		pval = pref.ValueOfFloat64(float64(valV.Int()))
+	case reflect.Uint,
 		reflect.Uint8,
 		reflect.Uint16,
 		reflect.Uint32,
 		reflect.Uint64:
 		fd = m.Descriptor().Fields().ByNumber(genid.Value_NumberValue_field_number)
-		pval = pref.ValueOfFloat64(float64(valV.Int()))
+		pval = pref.ValueOfFloat64(float64(valV.Uint()))
 	case reflect.Float32, reflect.Float64:
 		fd = m.Descriptor().Fields().ByNumber(genid.Value_NumberValue_field_number)
 		pval = pref.ValueOfFloat64(valV.Float())
@@ -378,7 +457,10 @@ func (d decoder) unmarshalKnownValue(val interface{}, m pref.Message) error {
 		// encoding cannot be parsed back to the same field.
 		fd = m.Descriptor().Fields().ByNumber(genid.Value_StringValue_field_number)
 		if valid := utf8.Valid([]byte(valV.String())); !valid {
-			return fmt.Errorf("invalid UTF-8: %s", valV.String())
+			return newValueError(CategoryInvalidUTF8, pref.StringKind, val, "invalid UTF-8: %s", valV.String())
+		}
+		if err := d.countBytes(valV.Len()); err != nil {
+			return err
 		}
 		pval = pref.ValueOfString(valV.String())
 
@@ -411,9 +493,12 @@ func (d decoder) unmarshalKnownValue(val interface{}, m pref.Message) error {
 				return err
 			}
 		}
+		if fd == nil {
+			return newValueError(CategoryTypeMismatch, pref.MessageKind, val, "invalid %v: %v", genid.Value_message_fullname, val)
+		}
 
 	default:
-		return fmt.Errorf("invalid %v: %v", genid.Value_message_fullname, val)
+		return newValueError(CategoryTypeMismatch, pref.MessageKind, val, "invalid %v: %v", genid.Value_message_fullname, val)
 	}
 	m.Set(fd, pval)
 	return nil
@@ -438,13 +523,13 @@ const (
 
 func isValidDuration(secs, nanos int64) (bool, error) {
 	if secs < -maxSecondsInDuration || secs > maxSecondsInDuration {
-		return false, fmt.Errorf("%s: seconds out of range %v", genid.Duration_message_fullname, secs)
+		return false, newError(CategoryInvalidValue, "%s: seconds out of range %v", genid.Duration_message_fullname, secs)
 	}
 	if nanos < -secondsInNanos || nanos > secondsInNanos {
-		return false, fmt.Errorf("%s: nanos out of range %v", genid.Duration_message_fullname, nanos)
+		return false, newError(CategoryInvalidValue, "%s: nanos out of range %v", genid.Duration_message_fullname, nanos)
 	}
 	if (secs > 0 && nanos < 0) || (secs < 0 && nanos > 0) {
-		return false, fmt.Errorf("%s: signs of seconds and nanos do not match", genid.Duration_message_fullname)
+		return false, newError(CategoryInvalidValue, "%s: signs of seconds and nanos do not match", genid.Duration_message_fullname)
 	}
 	return true, nil
 }
@@ -469,7 +554,7 @@ func (e encoder) marshalDuration(m pref.Message) (interface{}, error) {
 }
 
 func (d decoder) unmarshalDuration(val interface{}, m pref.Message) error {
-	var err = fmt.Errorf("invalid google.protobuf.Duration value %s", quoted(val))
+	var err = newValueError(CategoryTypeMismatch, pref.MessageKind, val, "invalid google.protobuf.Duration value %s", quoted(val))
 	dur, ok := val.(bson.D)
 	if !ok {
 		return err
@@ -480,23 +565,23 @@ func (d decoder) unmarshalDuration(val interface{}, m pref.Message) error {
 
 	var secs, nanos int64
 	if seconds, ok := dur.Map()["Seconds"]; ok {
-		switch reflect.TypeOf(seconds).Kind() {
+		switch reflect.ValueOf(seconds).Kind() {
 		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 			secs = reflect.ValueOf(seconds).Int()
 		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 			secs = int64(reflect.ValueOf(seconds).Uint())
 		default:
-			return fmt.Errorf("invalid google.protobuf.Duration seconds: %v (want int64 but got %T)", quoted(seconds), seconds)
+			return withField(newValueError(CategoryTypeMismatch, pref.Int64Kind, seconds, "invalid google.protobuf.Duration seconds: %v (want int64 but got %T)", quoted(seconds), seconds), "Seconds")
 		}
 	}
 	if nanoseconds, ok := dur.Map()["Nanos"]; ok {
-		switch reflect.TypeOf(nanoseconds).Kind() {
+		switch reflect.ValueOf(nanoseconds).Kind() {
 		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 			nanos = int64(reflect.ValueOf(nanoseconds).Int())
 		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 			nanos = int64(reflect.ValueOf(nanoseconds).Uint())
 		default:
-			return fmt.Errorf("invalid google.protobuf.Duration nanoseconds: %v (want int32 but got %T)", quoted(nanoseconds), nanoseconds)
+			return withField(newValueError(CategoryTypeMismatch, pref.Int32Kind, nanoseconds, "invalid google.protobuf.Duration nanoseconds: %v (want int32 but got %T)", quoted(nanoseconds), nanoseconds), "Nanos")
 		}
 	}
 
@@ -639,10 +724,10 @@ const (
 
 func isValidTimestamp(secs, nanos int64) (bool, error) {
 	if secs < minTimestampSeconds || secs > maxTimestampSeconds {
-		return false, fmt.Errorf("%s: seconds out of range %v", genid.Timestamp_message_fullname, secs)
+		return false, newError(CategoryInvalidValue, "%s: seconds out of range %v", genid.Timestamp_message_fullname, secs)
 	}
 	if nanos < 0 || nanos > secondsInNanos {
-		return false, fmt.Errorf("%s: nanos out of range %v", genid.Timestamp_message_fullname, nanos)
+		return false, newError(CategoryInvalidValue, "%s: nanos out of range %v", genid.Timestamp_message_fullname, nanos)
 	}
 	return true, nil
 }
@@ -670,18 +755,27 @@ func (d decoder) unmarshalTimestamp(val interface{}, m pref.Message) error {
 
 	if ts, ok := val.(primitive.DateTime); ok {
 		t := ts.Time()
+		if _, err := isValidTimestamp(t.Unix(), int64(t.Nanosecond())); err != nil {
+			return err
+		}
 		m.Set(fdSeconds, pref.ValueOfInt64(t.Unix()))
 		m.Set(fdNanos, pref.ValueOfInt32(int32(t.Nanosecond())))
 		return nil
 	}
+	if d.opts.Strict {
+		return newValueError(CategoryTypeMismatch, pref.MessageKind, val, "strict mode requires BSON %v for google.protobuf.Timestamp, got %v", bsontype.DateTime, bsonTypeOf(val))
+	}
 	var secs int64
-	switch reflect.TypeOf(val).Kind() {
+	switch reflect.ValueOf(val).Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		secs = reflect.ValueOf(val).Int()
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		secs = int64(reflect.ValueOf(val).Uint())
 	default:
-		return fmt.Errorf("invalid google.protobuf.Timestamp value %s", quoted(val))
+		return newValueError(CategoryTypeMismatch, pref.MessageKind, val, "invalid google.protobuf.Timestamp value %s", quoted(val))
+	}
+	if _, err := isValidTimestamp(secs, 0); err != nil {
+		return err
 	}
 	m.Set(fdSeconds, pref.ValueOfInt64(secs))
 	return nil
@@ -700,12 +794,12 @@ func (e encoder) marshalFieldMask(m pref.Message) (interface{}, error) {
 	for i := 0; i < list.Len(); i++ {
 		s := list.Get(i).String()
 		if !pref.FullName(s).IsValid() {
-			return nil, fmt.Errorf("%s contains invalid path: %q", genid.FieldMask_Paths_field_fullname, s)
+			return nil, newError(CategoryInvalidValue, "%s contains invalid path: %q", genid.FieldMask_Paths_field_fullname, s)
 		}
 		// Return error if conversion to camelCase is not reversible.
 		cc := JSONCamelCase(s)
 		if s != JSONSnakeCase(cc) {
-			return nil, fmt.Errorf("%s contains irreversible value %q", genid.FieldMask_Paths_field_fullname, s)
+			return nil, newError(CategoryInvalidValue, "%s contains irreversible value %q", genid.FieldMask_Paths_field_fullname, s)
 		}
 		paths = append(paths, cc)
 	}